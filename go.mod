@@ -1,6 +1,6 @@
 module github.com/macronut/ghostcp
 
-go 1.16
+go 1.18
 
 require (
 	github.com/chai2010/winsvc v0.0.0-20200705094454-db7ec320025c
@@ -0,0 +1,406 @@
+package ghostcp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a problem CheckConfig found on a line of a config file.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Warning bool
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Warning {
+		return fmt.Sprintf("%s:%d: warning: %s", d.File, d.Line, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: error: %s", d.File, d.Line, d.Message)
+}
+
+// methodConflicts are the methods that undo each other when set together.
+var methodConflicts = [][2]string{
+	{"tfo", "w-tfo"},
+	{"df", "mode2"},
+}
+
+type configChecker struct {
+	diags   []Diagnostic
+	defined map[string]ConfigLine
+	option  uint32
+	minTTL  int
+	maxTTL  int
+	scopes  []checkScope
+
+	profiles    map[string]checkScope
+	profileLine map[string]ConfigLine
+	profileUsed map[string]bool
+	profileName string
+}
+
+type checkScope struct {
+	option uint32
+	minTTL int
+	maxTTL int
+}
+
+// CheckConfig reads a config file and its includes the way LoadConfig
+// does, without putting them in use, and reports every error and warning
+// it finds, by file and line.
+func CheckConfig(name string) ([]Diagnostic, error) {
+	c := &configChecker{
+		defined:     make(map[string]ConfigLine),
+		profiles:    make(map[string]checkScope),
+		profileLine: make(map[string]ConfigLine),
+		profileUsed: make(map[string]bool),
+	}
+	lines, files, err := readConfigFile(name, func(line ConfigLine, err error) {
+		c.errorf(line, "%v", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		c.checkLine(line)
+	}
+	for name, line := range c.profileLine {
+		if !c.profileUsed[name] {
+			c.warnf(line, "profile %s is not used", name)
+		}
+	}
+
+	order := make(map[string]int)
+	for i, file := range files {
+		order[file] = i
+	}
+	sort.SliceStable(c.diags, func(i, j int) bool {
+		a, b := c.diags[i], c.diags[j]
+		if a.File != b.File {
+			return order[a.File] < order[b.File]
+		}
+		return a.Line < b.Line
+	})
+	return c.diags, nil
+}
+
+func (c *configChecker) errorf(line ConfigLine, format string, v ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{line.File, line.Num, false, fmt.Sprintf(format, v...)})
+}
+
+func (c *configChecker) warnf(line ConfigLine, format string, v ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{line.File, line.Num, true, fmt.Sprintf(format, v...)})
+}
+
+// define records a rule; a rule defined again makes the earlier one
+// unreachable.
+func (c *configChecker) define(line ConfigLine, rule string) {
+	prev, ok := c.defined[rule]
+	if ok {
+		c.warnf(prev, "%s is overridden by %s:%d", rule, line.File, line.Num)
+	}
+	c.defined[rule] = line
+}
+
+func (c *configChecker) checkInt(line ConfigLine, key string, value string, max int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > max {
+		c.errorf(line, "%s must be a number from 0 to %d, not %q", key, max, value)
+		return 0
+	}
+	return n
+}
+
+func (c *configChecker) checkLine(l ConfigLine) {
+	keys := l.Keys
+	line := l
+
+	if keys[0] == "include" {
+		if len(keys) > 1 {
+			c.scopes = append(c.scopes, checkScope{c.option, c.minTTL, c.maxTTL})
+		} else if len(c.scopes) > 0 {
+			scope := c.scopes[len(c.scopes)-1]
+			c.scopes = c.scopes[:len(c.scopes)-1]
+			c.option, c.minTTL, c.maxTTL = scope.option, scope.minTTL, scope.maxTTL
+		}
+		return
+	}
+
+	if keys[0] == "profile" {
+		if len(keys) > 1 {
+			name := keys[1]
+			prev, ok := c.profileLine[name]
+			if ok {
+				c.errorf(line, "profile %s is already defined at %s:%d", name, prev.File, prev.Num)
+			}
+			c.profileLine[name] = line
+			c.profileName = name
+			c.scopes = append(c.scopes, checkScope{c.option, c.minTTL, c.maxTTL})
+			c.option, c.minTTL, c.maxTTL = OPT_NONE, 0, 0
+		} else if len(c.scopes) > 0 {
+			c.profiles[c.profileName] = checkScope{c.option, c.minTTL, c.maxTTL}
+			scope := c.scopes[len(c.scopes)-1]
+			c.scopes = c.scopes[:len(c.scopes)-1]
+			c.option, c.minTTL, c.maxTTL = scope.option, scope.minTTL, scope.maxTTL
+		}
+		return
+	}
+
+	if l.Profile != "" {
+		profile, ok := c.profiles[l.Profile]
+		if !ok {
+			c.errorf(line, "unknown profile %s", l.Profile)
+			return
+		}
+		c.profileUsed[l.Profile] = true
+		if len(keys) > 1 && profileKeys[keys[0]] {
+			c.warnf(line, "@%s has no effect on %s=", l.Profile, keys[0])
+		}
+		saved := checkScope{c.option, c.minTTL, c.maxTTL}
+		c.option, c.minTTL, c.maxTTL = profile.option, profile.minTTL, profile.maxTTL
+		defer func() {
+			c.option, c.minTTL, c.maxTTL = saved.option, saved.minTTL, saved.maxTTL
+		}()
+	}
+
+	if len(keys) > 1 {
+		switch keys[0] {
+		case "server":
+			c.checkUpstream(line, keys[1])
+		case "dns":
+			if keys[1] != "" && keys[1] != DNS_SYSTEM {
+				c.checkUpstream(line, keys[1])
+			}
+		case "subscribe":
+			s, err := parseSubscription(keys[1], line.File)
+			if err != nil {
+				c.errorf(line, "%v", err)
+			} else if _, err := os.Stat(s.cache); err != nil {
+				c.warnf(line, "%s is not downloaded yet", s.url)
+			}
+		case "ecs":
+			if net.ParseIP(keys[1]) == nil {
+				c.errorf(line, "bad ecs IP %q", keys[1])
+			}
+		case "hosts":
+			name := keys[1]
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(line.File), name)
+			}
+			if _, err := os.Stat(name); err != nil {
+				c.warnf(line, "%v", err)
+			}
+		case "ipv6", "ipv4", "hosts-static", "dns-race":
+			if keys[1] != "true" && keys[1] != "false" {
+				c.warnf(line, "%s=%s is read as false", keys[0], keys[1])
+			}
+		case "method":
+			c.checkMethod(line, keys[1])
+		case "ttl":
+			c.minTTL = c.checkInt(line, "ttl", keys[1], 255)
+			c.checkTTL(line)
+		case "max-ttl":
+			c.maxTTL = c.checkInt(line, "max-ttl", keys[1], 255)
+			c.checkTTL(line)
+		case "mss":
+			c.checkInt(line, "mss", keys[1], 65535)
+		case "ip-limit", "subdomain", "log":
+			c.checkInt(line, keys[0], keys[1], 1<<31-1)
+		default:
+			ip := net.ParseIP(keys[0])
+			if ip != nil {
+				if ip.To4() == nil {
+					c.warnf(line, "NAT64 is only done for IPv4, %s is ignored", keys[0])
+				}
+				prefix := net.ParseIP(keys[1])
+				if prefix == nil || prefix.To4() != nil {
+					c.errorf(line, "bad NAT64 prefix %q", keys[1])
+				}
+				return
+			}
+			if keys[0] != "*" && !c.checkDomain(line, keys[0]) {
+				return
+			}
+			if _, form := domainPattern(keys[0]); form == '!' {
+				c.errorf(line, "%s excludes the domain, it cannot have a value", keys[0])
+				return
+			}
+			c.checkDomainValue(line, keys[0], keys[1])
+			c.define(line, "domain "+keys[0])
+		}
+		return
+	}
+
+	key := keys[0]
+	switch key {
+	case "ipv6", "ipv4", "forward":
+		return
+	}
+
+	ip := net.ParseIP(key)
+	if ip != nil {
+		c.define(line, "ip "+ip.String())
+		return
+	}
+
+	if strings.Index(key, "/") > 0 {
+		ip, ipnet, err := net.ParseCIDR(key)
+		if err != nil {
+			c.errorf(line, "bad CIDR %q", key)
+			return
+		}
+		if !ip.Equal(ipnet.IP) {
+			c.warnf(line, "%s has host bits set and is read as %s", key, ipnet.String())
+		}
+		c.define(line, "ip "+ipnet.String())
+		return
+	}
+
+	host, _, err := net.SplitHostPort(key)
+	if err == nil {
+		c.checkAddr(line, key)
+		if c.option == 0 {
+			c.warnf(line, "%s has no method", key)
+		}
+		ip := net.ParseIP(host)
+		if ip != nil {
+			c.define(line, "ip "+ip.String())
+		}
+		return
+	}
+
+	if key == "*" {
+		c.define(line, "domain *")
+		return
+	}
+	if c.checkDomain(line, key) {
+		c.define(line, "domain "+key)
+	}
+}
+
+// checkAddr checks an ip:port. Host names are allowed but resolved once,
+// when the config is loaded.
+func (c *configChecker) checkAddr(line ConfigLine, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.errorf(line, "bad address %q: %v", addr, err)
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		c.errorf(line, "bad port %q", port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		c.warnf(line, "%s is resolved once when the config is loaded", host)
+	}
+}
+
+// checkUpstream checks an ip:port or the URL of a DoH or DoT server, or a
+// list of them.
+func (c *configChecker) checkUpstream(line ConfigLine, server string) {
+	if strings.Contains(server, ",") {
+		for _, s := range strings.Split(server, ",") {
+			c.checkUpstream(line, strings.TrimSpace(s))
+		}
+		return
+	}
+	if isDoT(server) {
+		host, _, _, err := parseDoT(server)
+		if err != nil {
+			c.errorf(line, "%v", err)
+		} else if net.ParseIP(host) == nil {
+			c.warnf(line, "%s is resolved once when the config is loaded", host)
+		}
+		return
+	}
+	if !isDoH(server) {
+		c.checkAddr(line, server)
+		return
+	}
+	u, err := url.Parse(strings.Replace(server, "{?dns}", "", 1))
+	if err != nil || u.Host == "" {
+		c.errorf(line, "bad DoH URL %q", server)
+		return
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		c.warnf(line, "%s is resolved once when the config is loaded", u.Hostname())
+	}
+}
+
+func (c *configChecker) checkMethod(line ConfigLine, value string) {
+	c.option = OPT_NONE
+	set := make(map[string]bool)
+	for _, m := range strings.Split(value, ",") {
+		method, ok := MethodMap[m]
+		if !ok {
+			c.errorf(line, "unknown method %q", m)
+			continue
+		}
+		c.option |= method
+		set[m] = true
+	}
+	for _, conflict := range methodConflicts {
+		if set[conflict[0]] && set[conflict[1]] {
+			c.errorf(line, "methods %s and %s conflict", conflict[0], conflict[1])
+		}
+	}
+}
+
+func (c *configChecker) checkTTL(line ConfigLine) {
+	if c.minTTL > 0 && c.maxTTL > 0 && c.maxTTL <= c.minTTL {
+		c.warnf(line, "max-ttl %d is not above ttl %d", c.maxTTL, c.minTTL)
+	}
+}
+
+// checkDomain reports a key that is neither a known key nor a domain rule.
+func (c *configChecker) checkDomain(line ConfigLine, rule string) bool {
+	if !strings.Contains(rule, ".") {
+		c.errorf(line, "unknown key %q", rule)
+		return false
+	}
+	domain, _ := domainPattern(rule)
+	for _, ch := range domain {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '.' || ch == '_') {
+			c.errorf(line, "bad domain %q", rule)
+			return false
+		}
+	}
+	return true
+}
+
+func (c *configChecker) checkDomainValue(line ConfigLine, domain string, value string) {
+	if strings.HasSuffix(value, ":") {
+		prefix := net.ParseIP(value)
+		if prefix == nil || prefix.To4() != nil {
+			c.errorf(line, "bad DNS64 prefix %q", value)
+		}
+		return
+	}
+
+	if strings.HasPrefix(value, "[") {
+		if !strings.HasSuffix(value, "]") {
+			c.errorf(line, "missing ] in %q", value)
+			return
+		}
+		alias := value[1 : len(value)-1]
+		_, ok := c.defined["domain "+alias]
+		if !ok {
+			c.errorf(line, "%s is not defined above", alias)
+		}
+		return
+	}
+
+	for _, ip := range strings.Split(value, ",") {
+		if net.ParseIP(ip) == nil {
+			c.errorf(line, "bad IP %q for %s", ip, domain)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package ghostcp
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkFixture runs CheckConfig on testdata/check/name and returns its
+// diagnostics, with the path of the file cut to its name.
+func checkFixture(t *testing.T, name string) []string {
+	path := filepath.Join("testdata", "check", name)
+	diags, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, d := range diags {
+		lines = append(lines, strings.ReplaceAll(d.String(), path, name))
+	}
+	return lines
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		diags []string
+	}{
+		{"conflicts.conf", []string{
+			"conflicts.conf:1: error: methods tfo and w-tfo conflict",
+			`conflicts.conf:3: error: unknown method "nope"`,
+			"conflicts.conf:3: error: methods df and mode2 conflict",
+			"conflicts.conf:7: warning: max-ttl 5 is not above ttl 10",
+		}},
+		{"keys.conf", []string{
+			`keys.conf:2: error: unknown key "frobnicate"`,
+			`keys.conf:3: error: unknown key "frobnicate"`,
+			"keys.conf:4: warning: ipv6=yes is read as false",
+			`keys.conf:5: error: ttl must be a number from 0 to 255, not "300"`,
+			`keys.conf:6: error: mss must be a number from 0 to 65535, not "x"`,
+			`keys.conf:7: error: bad domain "bad_domain!.example"`,
+		}},
+		{"alias.conf", []string{
+			"alias.conf:4: error: later.example is not defined above",
+			`alias.conf:6: error: missing ] in "[real.example"`,
+			"alias.conf:7: error: !gone.example excludes the domain, it cannot have a value",
+		}},
+		{"override.conf", []string{
+			"override.conf:2: warning: domain example.com is overridden by override.conf:5",
+			"override.conf:3: warning: ip 1.2.3.4 is overridden by override.conf:6",
+			"override.conf:7: warning: 10.0.0.1/8 has host bits set and is read as 10.0.0.0/8",
+		}},
+		//line 1 uses a profile defined below it
+		{"profiles.conf", []string{
+			"profiles.conf:3: error: profile slow is already defined at profiles.conf:2",
+			"profiles.conf:4: error: frobnicate=1 cannot be set in a profile",
+			"profiles.conf:5: error: unknown profile nope",
+			"profiles.conf:6: warning: profile idle is not used",
+			"profiles.conf:7: warning: @slow has no effect on ttl=",
+			"profiles.conf:8: error: missing ] in profile",
+			"profiles.conf:9: error: a profile is defined with [profile name]",
+		}},
+	}
+	for _, test := range tests {
+		if diags := checkFixture(t, test.name); !reflect.DeepEqual(diags, test.diags) {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, strings.Join(diags, "\n"), strings.Join(test.diags, "\n"))
+		}
+	}
+}
+
+// TestAliasUnknown loads an alias of a domain with no rule: the line is
+// skipped instead of giving the alias a rule with no method.
+func TestAliasUnknown(t *testing.T) {
+	cfg, err := loadConfigFile(filepath.Join("testdata", "check", "alias.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, ok := cfg.rules.Domain("alias.example"); !ok || config.Option != OPT_TTL {
+		t.Errorf("alias.example: %+v %v", config, ok)
+	}
+	if config, ok := cfg.rules.Domain("early.example"); ok {
+		t.Errorf("early.example: %+v", config)
+	}
+}
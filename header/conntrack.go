@@ -0,0 +1,164 @@
+package ghostcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+// ConnKey identifies a TCP connection by the 5-tuple of its outbound
+// packets. IPv4 addresses are stored in their IPv4-mapped form.
+type ConnKey struct {
+	Src      [16]byte
+	Dst      [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+const (
+	CONN_NONE = iota
+	CONN_SYN_SENT
+	CONN_ESTABLISHED
+	CONN_CH_SENT
+	CONN_CLOSED
+)
+
+// ConnSynTimeout is how long a connection waits for its handshake,
+// ConnIdleTimeout how long an established one is kept without packets and
+// ConnCloseTimeout how long a closed one lingers for late segments.
+var ConnSynTimeout = time.Minute
+var ConnIdleTimeout = 5 * time.Minute
+var ConnCloseTimeout = 10 * time.Second
+var ConnGCInterval = 30 * time.Second
+
+type connEntry struct {
+	info     *ConnInfo
+	state    int
+	lastSeen time.Time
+}
+
+// ConnTable tracks the connections TCPDaemon has a rule for, so TCPRecv and
+// the later segments of a connection find the ConnInfo of its SYN.
+type ConnTable struct {
+	mutex sync.Mutex
+	conns map[ConnKey]*connEntry
+}
+
+var Conns = NewConnTable()
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[ConnKey]*connEntry)}
+}
+
+// connKey returns the key of an outbound packet.
+func connKey(p *layers.Packet) ConnKey {
+	var key ConnKey
+	copy(key.Src[:], p.Src().To16())
+	copy(key.Dst[:], p.Dst().To16())
+	key.Protocol = layers.ProtocolTCP
+	if p.TCP != nil {
+		key.SrcPort = p.TCP.SrcPort
+		key.DstPort = p.TCP.DstPort
+	}
+	return key
+}
+
+// replyConnKey returns the key of the connection an inbound packet answers.
+func replyConnKey(p *layers.Packet) ConnKey {
+	var key ConnKey
+	copy(key.Src[:], p.Dst().To16())
+	copy(key.Dst[:], p.Src().To16())
+	key.Protocol = layers.ProtocolTCP
+	if p.TCP != nil {
+		key.SrcPort = p.TCP.DstPort
+		key.DstPort = p.TCP.SrcPort
+	}
+	return key
+}
+
+// Add starts tracking a connection whose SYN was just sent. A connection
+// already tracked under key is replaced.
+func (t *ConnTable) Add(key ConnKey, info *ConnInfo) {
+	t.mutex.Lock()
+	t.conns[key] = &connEntry{info, CONN_SYN_SENT, time.Now()}
+	t.mutex.Unlock()
+}
+
+// Lookup returns the ConnInfo and state of a connection and marks it as
+// seen, or nil and CONN_NONE if it is not tracked.
+func (t *ConnTable) Lookup(key ConnKey) (*ConnInfo, int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry, ok := t.conns[key]
+	if !ok {
+		return nil, CONN_NONE
+	}
+	entry.lastSeen = time.Now()
+	return entry.info, entry.state
+}
+
+// SetState moves a tracked connection to state. States only move forward,
+// so a late SYN-ACK does not reopen a closed connection.
+func (t *ConnTable) SetState(key ConnKey, state int) {
+	t.mutex.Lock()
+	entry, ok := t.conns[key]
+	if ok && state > entry.state {
+		entry.state = state
+		entry.lastSeen = time.Now()
+	}
+	t.mutex.Unlock()
+}
+
+func (t *ConnTable) Remove(key ConnKey) {
+	t.mutex.Lock()
+	delete(t.conns, key)
+	t.mutex.Unlock()
+}
+
+func (t *ConnTable) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+// Expire drops the connections that timed out in their state and returns
+// how many were dropped.
+func (t *ConnTable) Expire(now time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	count := 0
+	for key, entry := range t.conns {
+		timeout := ConnIdleTimeout
+		switch entry.state {
+		case CONN_SYN_SENT:
+			timeout = ConnSynTimeout
+		case CONN_CLOSED:
+			timeout = ConnCloseTimeout
+		}
+		if now.Sub(entry.lastSeen) > timeout {
+			delete(t.conns, key)
+			count++
+		}
+	}
+	return count
+}
+
+var connGCOnce sync.Once
+
+// startConnGC runs Expire on Conns every ConnGCInterval.
+func startConnGC() {
+	connGCOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(ConnGCInterval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				count := Conns.Expire(now)
+				if count > 0 {
+					logPrintln(4, count, "connections expired")
+				}
+			}
+		}()
+	})
+}
@@ -0,0 +1,171 @@
+package ghostcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnTable(t *testing.T) {
+	table := NewConnTable()
+	syn1 := goldenPacket("203.0.113.1", goldenISN, TCP_SYN, nil, nil)
+	syn2 := goldenPacket("203.0.113.2", goldenISN, TCP_SYN, nil, nil)
+	p1, _ := syn1.Layers()
+	p2, _ := syn2.Layers()
+	key1, key2 := connKey(p1), connKey(p2)
+
+	//the same source port to two servers is two connections
+	if key1 == key2 {
+		t.Fatal("same key for different servers")
+	}
+	table.Add(key1, &ConnInfo{OPT_TTL, goldenISN, 5, 0})
+	table.Add(key2, &ConnInfo{OPT_WMD5, goldenISN, 5, 0})
+	if info, state := table.Lookup(key1); info == nil || info.Option != OPT_TTL || state != CONN_SYN_SENT {
+		t.Errorf("key1: %+v %d", info, state)
+	}
+	if info, _ := table.Lookup(key2); info == nil || info.Option != OPT_WMD5 {
+		t.Errorf("key2: %+v", info)
+	}
+
+	//the answers of a server find its connection
+	reply := goldenPacket("203.0.113.2", 5000, TCP_SYN|TCP_ACK, nil, nil)
+	r, _ := reply.Layers()
+	r.Reverse()
+	if replyConnKey(r) != key2 {
+		t.Error("the reply key differs")
+	}
+
+	//states only move forward
+	for _, test := range []struct {
+		set  int
+		want int
+	}{
+		{CONN_ESTABLISHED, CONN_ESTABLISHED},
+		{CONN_SYN_SENT, CONN_ESTABLISHED},
+		{CONN_CH_SENT, CONN_CH_SENT},
+		{CONN_ESTABLISHED, CONN_CH_SENT},
+		{CONN_CLOSED, CONN_CLOSED},
+		{CONN_ESTABLISHED, CONN_CLOSED},
+	} {
+		table.SetState(key1, test.set)
+		if _, state := table.Lookup(key1); state != test.want {
+			t.Errorf("set %d: state %d, want %d", test.set, state, test.want)
+		}
+	}
+	table.SetState(ConnKey{}, CONN_CLOSED)
+	if info, state := table.Lookup(ConnKey{}); info != nil || state != CONN_NONE {
+		t.Error("SetState added a connection")
+	}
+	if table.Len() != 2 {
+		t.Errorf("%d connections", table.Len())
+	}
+}
+
+func TestConnTableExpire(t *testing.T) {
+	table := NewConnTable()
+	keys := make(map[int]ConnKey)
+	for _, state := range []int{CONN_SYN_SENT, CONN_ESTABLISHED, CONN_CH_SENT, CONN_CLOSED} {
+		var key ConnKey
+		key.SrcPort = uint16(state)
+		table.Add(key, &ConnInfo{})
+		table.SetState(key, state)
+		keys[state] = key
+	}
+
+	tests := []struct {
+		after time.Duration
+		left  []int
+	}{
+		{0, []int{CONN_SYN_SENT, CONN_ESTABLISHED, CONN_CH_SENT, CONN_CLOSED}},
+		{ConnCloseTimeout + time.Second, []int{CONN_SYN_SENT, CONN_ESTABLISHED, CONN_CH_SENT}},
+		{ConnSynTimeout + time.Second, []int{CONN_ESTABLISHED, CONN_CH_SENT}},
+		{ConnIdleTimeout + time.Second, nil},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		table.Expire(start.Add(test.after))
+		if table.Len() != len(test.left) {
+			t.Errorf("after %v: %d connections, want %d", test.after, table.Len(), len(test.left))
+		}
+		for _, state := range test.left {
+			table.mutex.Lock()
+			_, ok := table.conns[keys[state]]
+			table.mutex.Unlock()
+			if !ok {
+				t.Errorf("after %v: state %d expired", test.after, state)
+			}
+		}
+	}
+
+	//a packet keeps a connection alive
+	var key ConnKey
+	table.Add(key, &ConnInfo{})
+	table.SetState(key, CONN_ESTABLISHED)
+	table.mutex.Lock()
+	table.conns[key].lastSeen = start.Add(-ConnIdleTimeout)
+	table.mutex.Unlock()
+	table.Lookup(key)
+	if n := table.Expire(time.Now()); n != 0 {
+		t.Errorf("expired %d live connections", n)
+	}
+}
+
+// TestConnStates runs two connections from the same port through
+// TCPDaemon and checks the state it tracks for each.
+func TestConnStates(t *testing.T) {
+	testConfig(t)
+	replay := NewPacketReplay()
+	defer replay.Close()
+	OpenDiverter = replay.Open
+	defer func() { OpenDiverter = nil }()
+
+	divert := tcpDaemon(":443", false)
+	if divert == nil {
+		t.Fatal("TCPDaemon not started")
+	}
+	defer divert.Close()
+
+	hello := clientHello("www.example.com")
+	dsts := map[string]uint32{"203.0.113.1": OPT_TTL, "203.0.113.2": OPT_WMD5}
+	for dst, option := range dsts {
+		Rules.SetIP(dst, IPConfig{option, 5, 0, 0})
+	}
+	state := func(dst string) (*ConnInfo, int) {
+		p, _ := goldenPacket(dst, goldenISN, TCP_SYN, nil, nil).Layers()
+		return Conns.Lookup(connKey(p))
+	}
+	defer func() {
+		for dst := range dsts {
+			p, _ := goldenPacket(dst, goldenISN, TCP_SYN, nil, nil).Layers()
+			Conns.Remove(connKey(p))
+		}
+	}()
+
+	stages := []struct {
+		name   string
+		packet func(dst string) *Packet
+		state  int
+	}{
+		{"syn", func(dst string) *Packet { return goldenPacket(dst, goldenISN, TCP_SYN, goldenSynOptions, nil) }, CONN_SYN_SENT},
+		{"ack", func(dst string) *Packet { return goldenPacket(dst, goldenISN+1, TCP_ACK, nil, nil) }, CONN_ESTABLISHED},
+		{"hello", func(dst string) *Packet { return goldenPacket(dst, goldenISN+1, TCP_PSH|TCP_ACK, nil, hello) }, CONN_ESTABLISHED},
+		//the segment after the ClientHello
+		{"data", func(dst string) *Packet {
+			return goldenPacket(dst, goldenISN+1+uint32(len(hello)), TCP_PSH|TCP_ACK, nil, make([]byte, 100))
+		}, CONN_CH_SENT},
+		{"fin", func(dst string) *Packet {
+			return goldenPacket(dst, goldenISN+101+uint32(len(hello)), TCP_FIN|TCP_ACK, nil, nil)
+		}, CONN_CLOSED},
+	}
+	for _, stage := range stages {
+		for _, dst := range []string{"203.0.113.1", "203.0.113.2"} {
+			replay.Reset()
+			if !replay.Inject(stage.packet(dst)) {
+				t.Fatalf("%s %s: not diverted", stage.name, dst)
+			}
+			info, s := state(dst)
+			if info == nil || info.Option != dsts[dst] || s != stage.state {
+				t.Errorf("%s %s: %+v state %d, want %d", stage.name, dst, info, s, stage.state)
+			}
+		}
+	}
+}
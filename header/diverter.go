@@ -0,0 +1,155 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+// Address carries the metadata a diverter attaches to every packet.
+// The layout follows WINDIVERT_ADDRESS so that backends can round-trip it.
+type Address struct {
+	Timestamp int64
+	IfIdx     uint32
+	SubIfIdx  uint32
+	Data      uint8
+}
+
+const (
+	ADDR_INBOUND         = 0x1 << 0
+	ADDR_LOOPBACK        = 0x1 << 1
+	ADDR_IMPOSTOR        = 0x1 << 2
+	ADDR_PSEUDO_IPCSUM   = 0x1 << 3
+	ADDR_PSEUDO_TCPCSUM  = 0x1 << 4
+	ADDR_PSEUDO_UDPCSUM  = 0x1 << 5
+	DIVERT_LAYER_NETWORK = 0
+	DIVERT_LAYER_FORWARD = 1
+)
+
+// Inbound reports whether the packet travels towards the local host.
+func (a *Address) Inbound() bool {
+	return a.Data&ADDR_INBOUND != 0
+}
+
+type Packet struct {
+	Raw       []byte
+	Addr      *Address
+	PacketLen uint
+}
+
+// PacketDiverter intercepts packets matching a filter and re-injects them.
+type PacketDiverter interface {
+	Recv() (*Packet, error)
+	Send(packet *Packet) (uint, error)
+	CalcChecksum(packet *Packet)
+	Close() error
+}
+
+// OpenDiverter opens a diverter for a WinDivert filter string on the given
+// layer. It is provided by the platform backend.
+var OpenDiverter func(filter string, layer uint8, priority uint16, flags uint8) (PacketDiverter, error) = openNoDiverter
+
+var ErrNoDiverter = errors.New("no packet diverter available on this platform")
+var ErrDiverterClosed = errors.New("packet diverter closed")
+
+func openNoDiverter(filter string, layer uint8, priority uint16, flags uint8) (PacketDiverter, error) {
+	return nil, ErrNoDiverter
+}
+
+func (p *Packet) ipHeadLen() int {
+	if p.Raw[0]>>4 == 6 {
+		return 40
+	}
+	return int(p.Raw[0]&0xF) * 4
+}
+
+func (p *Packet) SrcIP() net.IP {
+	if p.Raw[0]>>4 == 6 {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, p.Raw[8:24])
+		return ip
+	}
+	return net.IPv4(p.Raw[12], p.Raw[13], p.Raw[14], p.Raw[15])
+}
+
+func (p *Packet) DstIP() net.IP {
+	if p.Raw[0]>>4 == 6 {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, p.Raw[24:40])
+		return ip
+	}
+	return net.IPv4(p.Raw[16], p.Raw[17], p.Raw[18], p.Raw[19])
+}
+
+func (p *Packet) SetSrcIP(ip net.IP) {
+	if p.Raw[0]>>4 == 6 {
+		copy(p.Raw[8:24], ip.To16())
+	} else {
+		copy(p.Raw[12:16], ip.To4())
+	}
+}
+
+func (p *Packet) SetDstIP(ip net.IP) {
+	if p.Raw[0]>>4 == 6 {
+		copy(p.Raw[24:40], ip.To16())
+	} else {
+		copy(p.Raw[16:20], ip.To4())
+	}
+}
+
+func (p *Packet) SrcPort() (uint16, error) {
+	ipheadlen := p.ipHeadLen()
+	if len(p.Raw) < ipheadlen+4 {
+		return 0, errors.New("packet too short")
+	}
+	return binary.BigEndian.Uint16(p.Raw[ipheadlen:]), nil
+}
+
+func (p *Packet) DstPort() (uint16, error) {
+	ipheadlen := p.ipHeadLen()
+	if len(p.Raw) < ipheadlen+4 {
+		return 0, errors.New("packet too short")
+	}
+	return binary.BigEndian.Uint16(p.Raw[ipheadlen+2:]), nil
+}
+
+func (p *Packet) SetSrcPort(port uint16) error {
+	ipheadlen := p.ipHeadLen()
+	if len(p.Raw) < ipheadlen+4 {
+		return errors.New("packet too short")
+	}
+	binary.BigEndian.PutUint16(p.Raw[ipheadlen:], port)
+	return nil
+}
+
+func (p *Packet) SetDstPort(port uint16) error {
+	ipheadlen := p.ipHeadLen()
+	if len(p.Raw) < ipheadlen+4 {
+		return errors.New("packet too short")
+	}
+	binary.BigEndian.PutUint16(p.Raw[ipheadlen+2:], port)
+	return nil
+}
+
+func (p *Packet) CalcNewChecksum(divert PacketDiverter) {
+	divert.CalcChecksum(p)
+}
+
+// Layers decodes the headers of the packet. The result aliases Raw.
+func (p *Packet) Layers() (*layers.Packet, error) {
+	size := int(p.PacketLen)
+	if size > len(p.Raw) {
+		size = len(p.Raw)
+	}
+	return layers.Parse(p.Raw[:size])
+}
+
+// sendLayers serializes l into buf and injects it with the metadata of addr.
+// Without checksum the Checksum fields of l are written as they are.
+func sendLayers(divert PacketDiverter, addr *Address, l *layers.Packet, buf []byte, checksum bool) error {
+	raw := l.Serialize(buf, checksum)
+	_, err := divert.Send(&Packet{Raw: raw, Addr: addr, PacketLen: uint(len(raw))})
+	return err
+}
@@ -0,0 +1,472 @@
+//go:build linux
+// +build linux
+
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+// The Linux backend queues packets with nftables rules generated from the
+// WinDivert filter and reads them over NFQUEUE. The packet handed to Recv is
+// held until the daemon sends something: the first packet sent in the same
+// direction replaces it in place through the verdict, everything else is
+// injected with raw sockets marked with DivertMark. A packet that is never
+// sent back is dropped.
+
+var QueueBase uint16 = 6300
+
+// nativeEndian is the byte order of the host, which netlink headers and
+// attributes use. The payloads of the nfqueue attributes are big endian.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+const (
+	NETLINK_NETFILTER = 12
+	NFNL_SUBSYS_QUEUE = 3
+
+	NFQNL_MSG_PACKET  = 0
+	NFQNL_MSG_VERDICT = 1
+	NFQNL_MSG_CONFIG  = 2
+
+	NFQA_PACKET_HDR     = 1
+	NFQA_VERDICT_HDR    = 2
+	NFQA_TIMESTAMP      = 4
+	NFQA_IFINDEX_INDEV  = 5
+	NFQA_IFINDEX_OUTDEV = 6
+	NFQA_PAYLOAD        = 10
+
+	NFQA_CFG_CMD    = 1
+	NFQA_CFG_PARAMS = 2
+
+	NFQNL_CFG_CMD_BIND   = 1
+	NFQNL_CFG_CMD_UNBIND = 2
+	NFQNL_COPY_PACKET    = 2
+
+	NF_DROP   = 0
+	NF_ACCEPT = 1
+
+	NF_INET_PRE_ROUTING = 0
+	NF_INET_LOCAL_IN    = 1
+	NF_INET_LOCAL_OUT   = 3
+)
+
+type nfqueueHandle struct {
+	mutex   sync.Mutex
+	fd      int
+	raw4    int
+	raw6    int
+	queue   uint16
+	flags   uint8
+	seq     uint32
+	closed  bool
+	reading bool
+	pending *Packet
+	id      uint32
+	buf     []byte
+}
+
+var queueMutex sync.Mutex
+var queueNext uint16 = 0
+
+func init() {
+	OpenDiverter = openNFQueue
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft: %v %s", err, out)
+	}
+	return nil
+}
+
+func openNFQueue(filter string, layer uint8, priority uint16, flags uint8) (PacketDiverter, error) {
+	queueMutex.Lock()
+	queue := QueueBase + queueNext
+	queueNext++
+	queueMutex.Unlock()
+
+	ruleset, err := NFTablesRuleset(filter, layer, priority, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &nfqueueHandle{fd: -1, raw4: -1, raw6: -1, queue: queue, flags: flags}
+	h.buf = make([]byte, 0x10000+256)
+
+	h.fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, NETLINK_NETFILTER)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Bind(h.fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err == nil {
+		//closing the socket does not wake Recv, the timeout does
+		tv := syscall.NsecToTimeval(int64(time.Second))
+		err = syscall.SetsockoptTimeval(h.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	}
+	if err == nil {
+		err = h.config(NFQA_CFG_CMD, []byte{NFQNL_CFG_CMD_BIND, 0, 0, 0})
+	}
+	if err == nil {
+		params := make([]byte, 5)
+		binary.BigEndian.PutUint32(params, 0xFFFF)
+		params[4] = NFQNL_COPY_PACKET
+		err = h.config(NFQA_CFG_PARAMS, params)
+	}
+	if err == nil {
+		h.raw4, err = rawSocket(syscall.AF_INET)
+	}
+	if err == nil {
+		h.raw6, err = rawSocket(syscall.AF_INET6)
+	}
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+
+	table := nftTableName(queue)
+	nft(fmt.Sprintf("delete table inet %s\n", table))
+	if flags&DIVERT_FLAG_DROP != 0 {
+		ruleset = strings.ReplaceAll(ruleset, fmt.Sprintf("queue num %d bypass", queue), "drop")
+	}
+	err = nft(ruleset)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func rawSocket(family int) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return -1, err
+	}
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(DivertMark))
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func nlAttr(buf []byte, attrType uint16, data []byte) []byte {
+	var head [4]byte
+	nativeEndian.PutUint16(head[0:], uint16(4+len(data)))
+	nativeEndian.PutUint16(head[2:], attrType)
+	buf = append(buf, head[:]...)
+	buf = append(buf, data...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func (h *nfqueueHandle) request(msgType uint16, flags uint16, attrs []byte) []byte {
+	h.seq++
+	msg := make([]byte, 20, 20+len(attrs))
+	nativeEndian.PutUint32(msg[0:], uint32(20+len(attrs)))
+	nativeEndian.PutUint16(msg[4:], NFNL_SUBSYS_QUEUE<<8|msgType)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|flags)
+	nativeEndian.PutUint32(msg[8:], h.seq)
+	msg[16] = syscall.AF_UNSPEC
+	msg[17] = 0
+	binary.BigEndian.PutUint16(msg[18:], h.queue)
+	return append(msg, attrs...)
+}
+
+func (h *nfqueueHandle) config(attrType uint16, data []byte) error {
+	msg := h.request(NFQNL_MSG_CONFIG, syscall.NLM_F_ACK, nlAttr(nil, attrType, data))
+	err := syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	for {
+		n, _, err := syscall.Recvfrom(h.fd, h.buf, 0)
+		if err != nil {
+			return err
+		}
+		for b := h.buf[:n]; len(b) >= 16; {
+			length := int(nativeEndian.Uint32(b[0:]))
+			if length < 16 || length > len(b) {
+				break
+			}
+			msgType := nativeEndian.Uint16(b[4:])
+			seq := nativeEndian.Uint32(b[8:])
+			if msgType == syscall.NLMSG_ERROR && seq == h.seq && length >= 20 {
+				errno := int32(nativeEndian.Uint32(b[16:]))
+				if errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			}
+			b = b[(length+3)&^3:]
+		}
+	}
+}
+
+func (h *nfqueueHandle) verdict(id uint32, verdict uint32, payload []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:], verdict)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	attrs := nlAttr(nil, NFQA_VERDICT_HDR, hdr[:])
+	if payload != nil {
+		attrs = nlAttr(attrs, NFQA_PAYLOAD, payload)
+	}
+	msg := h.request(NFQNL_MSG_VERDICT, 0, attrs)
+	return syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+func (h *nfqueueHandle) settle() {
+	if h.pending != nil {
+		h.verdict(h.id, NF_DROP, nil)
+		h.pending = nil
+	}
+}
+
+func (h *nfqueueHandle) Recv() (*Packet, error) {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return nil, ErrDiverterClosed
+	}
+	h.settle()
+	h.reading = true
+	fd := h.fd
+	h.mutex.Unlock()
+	defer h.leave()
+
+	for {
+		n, _, err := syscall.Recvfrom(fd, h.buf, 0)
+		if err != nil {
+			if err == syscall.EBADF {
+				return nil, ErrDiverterClosed
+			}
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				h.mutex.Lock()
+				closed := h.closed
+				h.mutex.Unlock()
+				if closed {
+					return nil, ErrDiverterClosed
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		for b := h.buf[:n]; len(b) >= 20; {
+			length := int(nativeEndian.Uint32(b[0:]))
+			if length < 20 || length > len(b) {
+				break
+			}
+			msgType := nativeEndian.Uint16(b[4:])
+			msg := b[:length]
+			b = b[(length+3)&^3:]
+			if msgType != NFNL_SUBSYS_QUEUE<<8|NFQNL_MSG_PACKET {
+				continue
+			}
+
+			packet, id, hook := parseQueuedPacket(msg[20:])
+			if packet == nil {
+				continue
+			}
+			if hook == NF_INET_LOCAL_OUT {
+				//locally generated packets may carry partial checksums
+				layers.CalcChecksums(packet.Raw)
+			}
+
+			h.mutex.Lock()
+			if h.closed {
+				h.mutex.Unlock()
+				return nil, ErrDiverterClosed
+			}
+			if h.flags&DIVERT_FLAG_SNIFF != 0 {
+				h.verdict(id, NF_ACCEPT, nil)
+			} else {
+				h.settle()
+				addr := *packet.Addr
+				h.pending = &Packet{Raw: append([]byte(nil), packet.Raw...), Addr: &addr, PacketLen: packet.PacketLen}
+				h.id = id
+			}
+			h.mutex.Unlock()
+			return packet, nil
+		}
+	}
+}
+
+// leave ends a Recv, and releases the sockets if the handle was closed
+// while it was reading.
+func (h *nfqueueHandle) leave() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reading = false
+	if h.closed {
+		h.release()
+	}
+}
+
+func parseQueuedPacket(attrs []byte) (*Packet, uint32, byte) {
+	var packet *Packet
+	var id uint32
+	var hook byte
+	addr := &Address{}
+
+	for len(attrs) >= 4 {
+		length := int(nativeEndian.Uint16(attrs[0:]))
+		attrType := nativeEndian.Uint16(attrs[2:]) & 0x3FFF
+		if length < 4 || length > len(attrs) {
+			break
+		}
+		data := attrs[4:length]
+		switch attrType {
+		case NFQA_PACKET_HDR:
+			if len(data) >= 7 {
+				id = binary.BigEndian.Uint32(data[0:])
+				hook = data[6]
+			}
+		case NFQA_TIMESTAMP:
+			if len(data) >= 16 {
+				sec := int64(binary.BigEndian.Uint64(data[0:]))
+				usec := int64(binary.BigEndian.Uint64(data[8:]))
+				addr.Timestamp = sec*1000000000 + usec*1000
+			}
+		case NFQA_IFINDEX_INDEV:
+			if len(data) >= 4 {
+				addr.IfIdx = binary.BigEndian.Uint32(data)
+			}
+		case NFQA_IFINDEX_OUTDEV:
+			if len(data) >= 4 && addr.IfIdx == 0 {
+				addr.IfIdx = binary.BigEndian.Uint32(data)
+			}
+		case NFQA_PAYLOAD:
+			raw := make([]byte, len(data))
+			copy(raw, data)
+			packet = &Packet{Raw: raw, PacketLen: uint(len(raw))}
+		}
+		attrs = attrs[(length+3)&^3:]
+	}
+
+	if packet == nil || len(packet.Raw) < 20 {
+		return nil, 0, 0
+	}
+	if hook == NF_INET_LOCAL_IN || hook == NF_INET_PRE_ROUTING {
+		addr.Data |= ADDR_INBOUND
+	}
+	packet.Addr = addr
+	return packet, id, hook
+}
+
+func (h *nfqueueHandle) Send(packet *Packet) (uint, error) {
+	size := int(packet.PacketLen)
+	if size > len(packet.Raw) {
+		size = len(packet.Raw)
+	}
+	raw := packet.Raw[:size]
+	if len(raw) < 20 {
+		return 0, errors.New("packet too short")
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return 0, ErrDiverterClosed
+	}
+	if h.pending != nil && packet.Addr != nil && packet.Addr.Inbound() == h.pending.Addr.Inbound() {
+		var err error
+		if bytes.Equal(raw, h.pending.Raw) {
+			err = h.verdict(h.id, NF_ACCEPT, nil)
+		} else {
+			err = h.verdict(h.id, NF_ACCEPT, raw)
+		}
+		h.pending = nil
+		if err != nil {
+			return 0, err
+		}
+		return uint(size), nil
+	}
+
+	var err error
+	if raw[0]>>4 == 6 {
+		if len(raw) < 40 {
+			return 0, errors.New("packet too short")
+		}
+		var sa syscall.SockaddrInet6
+		copy(sa.Addr[:], raw[24:40])
+		err = syscall.Sendto(h.raw6, raw, 0, &sa)
+	} else {
+		var sa syscall.SockaddrInet4
+		copy(sa.Addr[:], raw[16:20])
+		err = syscall.Sendto(h.raw4, raw, 0, &sa)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint(size), nil
+}
+
+func (h *nfqueueHandle) CalcChecksum(packet *Packet) {
+	size := int(packet.PacketLen)
+	if size > len(packet.Raw) {
+		size = len(packet.Raw)
+	}
+	layers.CalcChecksums(packet.Raw[:size])
+}
+
+// release closes the sockets. Called with h.mutex held, or before the
+// handle is returned.
+func (h *nfqueueHandle) release() {
+	if h.fd >= 0 {
+		syscall.Close(h.fd)
+		h.fd = -1
+	}
+	if h.raw4 >= 0 {
+		syscall.Close(h.raw4)
+		h.raw4 = -1
+	}
+	if h.raw6 >= 0 {
+		syscall.Close(h.raw6)
+		h.raw6 = -1
+	}
+}
+
+// Close removes the rules and unbinds the queue. The sockets are released
+// at once, or by the Recv in progress when it returns, so that the number
+// of the netlink socket is not given to another queue while it reads.
+func (h *nfqueueHandle) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	h.settle()
+
+	err := nft(fmt.Sprintf("delete table inet %s\n", nftTableName(h.queue)))
+	msg := h.request(NFQNL_MSG_CONFIG, 0, nlAttr(nil, NFQA_CFG_CMD, []byte{NFQNL_CFG_CMD_UNBIND, 0, 0, 0}))
+	syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if !h.reading {
+		h.release()
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestNetlinkAttrByteOrder(t *testing.T) {
+	attr := nlAttr(nil, NFQA_PAYLOAD, []byte{1, 2, 3})
+	if len(attr) != 8 {
+		t.Fatalf("attribute not padded to 4 bytes: %x", attr)
+	}
+	//the kernel reads the header as a struct nlattr in host byte order
+	length := *(*uint16)(unsafe.Pointer(&attr[0]))
+	attrType := *(*uint16)(unsafe.Pointer(&attr[2]))
+	if length != 7 || attrType != NFQA_PAYLOAD {
+		t.Errorf("nla_len %d nla_type %d, want 7 %d", length, attrType, NFQA_PAYLOAD)
+	}
+
+	h := &nfqueueHandle{queue: 0x1234}
+	msg := h.request(NFQNL_MSG_VERDICT, 0, attr)
+	if n := *(*uint32)(unsafe.Pointer(&msg[0])); n != uint32(len(msg)) {
+		t.Errorf("nlmsg_len %d, want %d", n, len(msg))
+	}
+	if seq := *(*uint32)(unsafe.Pointer(&msg[8])); seq != 1 {
+		t.Errorf("nlmsg_seq %d, want 1", seq)
+	}
+	//res_id of nfgenmsg is big endian
+	if binary.BigEndian.Uint16(msg[18:]) != 0x1234 {
+		t.Errorf("res_id %x", msg[18:20])
+	}
+}
+
+func TestParseQueuedPacket(t *testing.T) {
+	syn := testPacket(6, "1.2.3.4", 443, "10.0.0.2", 50000, TCP_SYN|TCP_ACK, nil, true)
+
+	hdr := make([]byte, 7)
+	binary.BigEndian.PutUint32(hdr, 42)
+	hdr[6] = NF_INET_LOCAL_IN
+	timestamp := make([]byte, 16)
+	binary.BigEndian.PutUint64(timestamp[0:], 3)
+	binary.BigEndian.PutUint64(timestamp[8:], 500)
+	ifindex := make([]byte, 4)
+	binary.BigEndian.PutUint32(ifindex, 7)
+
+	attrs := nlAttr(nil, NFQA_PACKET_HDR, hdr)
+	attrs = nlAttr(attrs, NFQA_TIMESTAMP, timestamp)
+	attrs = nlAttr(attrs, NFQA_IFINDEX_INDEV, ifindex)
+	attrs = nlAttr(attrs, NFQA_PAYLOAD, syn.Raw)
+
+	packet, id, hook := parseQueuedPacket(attrs)
+	if packet == nil {
+		t.Fatal("no packet")
+	}
+	if id != 42 || hook != NF_INET_LOCAL_IN {
+		t.Errorf("id %d hook %d", id, hook)
+	}
+	if !bytes.Equal(packet.Raw, syn.Raw) {
+		t.Error("payload differs")
+	}
+	if !packet.Addr.Inbound() || packet.Addr.IfIdx != 7 || packet.Addr.Timestamp != 3000500000 {
+		t.Errorf("addr %+v", *packet.Addr)
+	}
+
+	hdr[6] = NF_INET_LOCAL_OUT
+	packet, _, _ = parseQueuedPacket(nlAttr(nlAttr(nil, NFQA_PACKET_HDR, hdr), NFQA_PAYLOAD, syn.Raw))
+	if packet == nil || packet.Addr.Inbound() {
+		t.Error("LOCAL_OUT packet not outbound")
+	}
+
+	//truncated attributes and short payloads are dropped
+	if packet, _, _ := parseQueuedPacket(attrs[:len(attrs)-8]); packet != nil {
+		t.Error("parsed a truncated payload attribute")
+	}
+	if packet, _, _ := parseQueuedPacket(nlAttr(nil, NFQA_PAYLOAD, syn.Raw[:10])); packet != nil {
+		t.Error("parsed a 10-byte packet")
+	}
+}
+
+// TestNFQueueClose closes a handle while Recv waits on its socket: Recv
+// returns ErrDiverterClosed, and the socket is released only then.
+func TestNFQueueClose(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, NETLINK_NETFILTER)
+	if err != nil {
+		t.Skip("no netlink socket:", err)
+	}
+	tv := syscall.NsecToTimeval(int64(50 * time.Millisecond))
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	h := &nfqueueHandle{fd: fd, raw4: -1, raw6: -1, queue: 0xFFFF, buf: make([]byte, 0x10000)}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Recv()
+		done <- err
+	}()
+	for {
+		h.mutex.Lock()
+		reading := h.reading
+		h.mutex.Unlock()
+		if reading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Close()
+	h.mutex.Lock()
+	if h.fd != fd {
+		t.Error("the socket was released with Recv reading it")
+	}
+	h.mutex.Unlock()
+
+	select {
+	case err := <-done:
+		if err != ErrDiverterClosed {
+			t.Errorf("Recv: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recv did not return")
+	}
+	if h.fd != -1 {
+		t.Error("the socket was not released")
+	}
+	if _, err := h.Recv(); err != ErrDiverterClosed {
+		t.Errorf("Recv after Close: %v", err)
+	}
+	if _, err := h.Send(&Packet{Raw: make([]byte, 20), PacketLen: 20}); err != ErrDiverterClosed {
+		t.Errorf("Send after Close: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+//go:build windows
+// +build windows
+
+package ghostcp
+
+import (
+	"sync"
+
+	"github.com/macronut/godivert"
+)
+
+type winDivertHandle struct {
+	handle *godivert.WinDivertHandle
+	mutex  sync.Mutex
+	closed bool
+}
+
+func init() {
+	OpenDiverter = openWinDivert
+}
+
+func openWinDivert(filter string, layer uint8, priority uint16, flags uint8) (PacketDiverter, error) {
+	handle, err := godivert.WinDivertOpen(filter, layer, priority, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &winDivertHandle{handle: handle}, nil
+}
+
+func toWinDivertPacket(packet *Packet) *godivert.Packet {
+	var addr godivert.WinDivertAddress
+	if packet.Addr != nil {
+		addr = godivert.WinDivertAddress{
+			Timestamp: packet.Addr.Timestamp,
+			IfIdx:     packet.Addr.IfIdx,
+			SubIfIdx:  packet.Addr.SubIfIdx,
+			Data:      packet.Addr.Data,
+		}
+	}
+	return &godivert.Packet{
+		Raw:       packet.Raw,
+		Addr:      &addr,
+		PacketLen: packet.PacketLen,
+	}
+}
+
+func (d *winDivertHandle) Recv() (*Packet, error) {
+	packet, err := d.handle.Recv()
+	if err != nil {
+		if d.isClosed() {
+			return nil, ErrDiverterClosed
+		}
+		return nil, err
+	}
+
+	return &Packet{
+		Raw: packet.Raw,
+		Addr: &Address{
+			Timestamp: packet.Addr.Timestamp,
+			IfIdx:     packet.Addr.IfIdx,
+			SubIfIdx:  packet.Addr.SubIfIdx,
+			Data:      packet.Addr.Data,
+		},
+		PacketLen: packet.PacketLen,
+	}, nil
+}
+
+func (d *winDivertHandle) Send(packet *Packet) (uint, error) {
+	return d.handle.Send(toWinDivertPacket(packet))
+}
+
+func (d *winDivertHandle) CalcChecksum(packet *Packet) {
+	d.handle.HelperCalcChecksum(toWinDivertPacket(packet))
+}
+
+func (d *winDivertHandle) isClosed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.closed
+}
+
+func (d *winDivertHandle) Close() error {
+	d.mutex.Lock()
+	d.closed = true
+	d.mutex.Unlock()
+	return d.handle.Close()
+}
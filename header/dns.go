@@ -2,97 +2,117 @@ package ghostcp
 
 import (
 	"encoding/binary"
-	"log"
 	"net"
-	"time"
+	"sync"
 )
 
 var DNS string = ""
+var DNSAddrs []string
 var DNSOption uint32 = 0
-var TFOPayload []byte = nil
 
-func TCPlookup(request []byte, address string) ([]byte, error) {
-	var conn net.Conn
-	var err error
-	data := make([]byte, 1024)
-	if DNSOption&OPT_TFO != 0 {
-		binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-		copy(data[2:], request)
-		TFOPayload = data[:len(request)+2]
-
-		conn, err = net.DialTimeout("tcp", address, time.Second*5)
-		if err != nil {
-			return nil, err
-		}
+// tfoPayloads are the first queries of the connections being dialed to the
+// DNS servers with TFO, by address. TCPDaemon puts them in the SYN.
+var tfoMutex sync.Mutex
+var tfoPayloads = make(map[string][]byte)
+
+// setTFOPayload sets the payload of the SYN to addr, or drops it if payload
+// is nil.
+func setTFOPayload(addr string, payload []byte) {
+	tfoMutex.Lock()
+	defer tfoMutex.Unlock()
+	if payload == nil {
+		delete(tfoPayloads, addr)
 	} else {
-		conn, err = net.DialTimeout("tcp", address, time.Second*5)
-		if err != nil {
-			return nil, err
-		}
-		data := make([]byte, 1024)
-		binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-		copy(data[2:], request)
-
-		_, err = conn.Write(data[:len(request)+2])
-		if err != nil {
-			return nil, err
-		}
+		tfoPayloads[addr] = payload
 	}
-	defer conn.Close()
+}
 
-	length := 0
-	recvlen := 0
-	for {
-		if recvlen >= 1024 {
-			return nil, nil
-		}
-		n, err := conn.Read(data[recvlen:])
-		if err != nil {
-			return nil, err
-		}
-		if length == 0 {
-			length = int(binary.BigEndian.Uint16(data[:2]) + 2)
-		}
-		recvlen += n
-		if recvlen >= length {
-			return data[2:recvlen], nil
+func tfoPayload(addr string) []byte {
+	tfoMutex.Lock()
+	defer tfoMutex.Unlock()
+	return tfoPayloads[addr]
+}
+
+// DNS_SYSTEM is the upstream of the domains dns=system leaves to the
+// system resolver.
+const DNS_SYSTEM = "system"
+
+// DNSUpstreams are the upstreams dns= lines of the config name.
+var DNSUpstreams []string
+
+// DNSModes tells which DNS daemons a config needs: DNSDaemon if a domain is
+// resolved over TCP, by server or by a dns= upstream, and DNSRecvDaemon if a
+// domain is left to the system resolver.
+func DNSModes(server string, upstreams []string) (daemon bool, recv bool) {
+	daemon = server != ""
+	recv = server == ""
+	for _, upstream := range upstreams {
+		if upstream == DNS_SYSTEM {
+			recv = true
+		} else {
+			daemon = true
 		}
 	}
+	return daemon, recv
+}
 
-	return nil, nil
+// TCPlookup sends a DNS request over TCP to address, on the connection
+// kept open to it.
+func TCPlookup(request []byte, address string) ([]byte, error) {
+	tcpMutex.Lock()
+	c, ok := tcpClients[address]
+	if !ok {
+		c = &pipeClient{addr: address}
+		tcpClients[address] = c
+	}
+	tcpMutex.Unlock()
+	return c.query(request)
 }
 
 func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) ([]byte, error) {
-	response6 := make([]byte, 1024)
-	offset6 := offset
-	offset4 := offset
-
 	binary.BigEndian.PutUint16(request[offset-4:offset-2], 1)
-	response, err := TCPlookup(request, address)
+	response, err := lookup(request, address)
 	if err != nil {
 		return nil, err
 	}
+	response6 := dns64Response(response, offset, prefix)
+	if response6 == nil {
+		logPrintln(2, "DNS64:", address, "sent a malformed answer")
+	}
+	return response6, nil
+}
 
-	copy(response6, response[:offset])
-	binary.BigEndian.PutUint16(response6[offset-4:offset-2], 28)
+// dns64Response turns the A records of response into AAAA records of prefix,
+// offset being the end of its question. It returns nil if response is
+// malformed.
+func dns64Response(response []byte, offset int, prefix []byte) []byte {
+	offset6 := offset
+	offset4 := offset
+
+	if len(response) < offset || offset < 12 || len(prefix) < 12 {
+		return nil
+	}
 
 	count := int(binary.BigEndian.Uint16(response[6:8]))
+	//every A record grows by 12 bytes when it becomes an AAAA record
+	response6 := make([]byte, len(response)+count*12)
+
+	copy(response6, response[:offset])
+	binary.BigEndian.PutUint16(response6[offset-4:offset-2], 28)
 	for i := 0; i < count; i++ {
 		for {
 			if offset >= len(response) {
-				log.Println(offset)
-				return nil, nil
+				return nil
 			}
 			length := response[offset]
 			offset++
 			if length == 0 {
 				break
 			}
-			if length < 63 {
+			if length < 64 {
 				offset += int(length)
 				if offset+2 > len(response) {
-					log.Println(offset)
-					return nil, nil
+					return nil
 				}
 			} else {
 				offset++
@@ -100,8 +120,7 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 			}
 		}
 		if offset+2 > len(response) {
-			log.Println(offset)
-			return nil, nil
+			return nil
 		}
 
 		copy(response6[offset6:], response[offset4:offset])
@@ -111,18 +130,16 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 		AType := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 8
 		if offset+2 > len(response) {
-			log.Println(offset)
-			return nil, nil
+			return nil
 		}
 		DataLength := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 2
 
 		offset += int(DataLength)
+		if offset > len(response) {
+			return nil
+		}
 		if AType == 1 {
-			if offset > len(response) {
-				log.Println(offset)
-				return nil, nil
-			}
 			binary.BigEndian.PutUint16(response6[offset6:], 28)
 			offset6 += 2
 			offset4 += 2
@@ -150,7 +167,7 @@ func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) (
 	//copy(response6[offset6:], response[offset4:])
 	//offset6 += len(response) - offset4
 
-	return response6[:offset6], nil
+	return response6[:offset6]
 }
 
 func getQName(buf []byte) (string, int, int) {
@@ -161,6 +178,9 @@ func getQName(buf []byte) (string, int, int) {
 	length := buf[12]
 	off := 13
 	end := off + int(length)
+	if end > bufflen {
+		return "", 0, 0
+	}
 	qname := string(buf[off:end])
 	off = end
 
@@ -190,24 +210,27 @@ func getQName(buf []byte) (string, int, int) {
 	return qname, qtype, end
 }
 
-func getAnswers(answers []byte, count int) []string {
+// getAnswers returns the A and AAAA addresses of the answer section and the
+// smallest TTL among them.
+func getAnswers(answers []byte, count int) ([]string, uint32) {
 	ips := make([]string, 0)
 	offset := 0
+	var ttl uint32 = 0
 
 	for i := 0; i < count; i++ {
 		for {
 			if offset >= len(answers) {
-				return nil
+				return nil, 0
 			}
 			length := answers[offset]
 			offset++
 			if length == 0 {
 				break
 			}
-			if length < 63 {
+			if length < 64 {
 				offset += int(length)
 				if offset+2 > len(answers) {
-					return nil
+					return nil, 0
 				}
 			} else {
 				offset++
@@ -215,19 +238,25 @@ func getAnswers(answers []byte, count int) []string {
 			}
 		}
 		if offset+2 > len(answers) {
-			return nil
+			return nil, 0
 		}
 		AType := binary.BigEndian.Uint16(answers[offset : offset+2])
 		offset += 8
 		if offset+2 > len(answers) {
-			return nil
+			return nil, 0
+		}
+		if AType == 1 || AType == 28 {
+			recordTTL := binary.BigEndian.Uint32(answers[offset-4 : offset])
+			if ttl == 0 || recordTTL < ttl {
+				ttl = recordTTL
+			}
 		}
 		DataLength := binary.BigEndian.Uint16(answers[offset : offset+2])
 		offset += 2
 
 		if AType == 1 {
 			if offset+4 > len(answers) {
-				return nil
+				return nil, 0
 			}
 			data := answers[offset : offset+4]
 			ip := net.IPv4(data[0], data[1], data[2], data[3]).String()
@@ -235,7 +264,7 @@ func getAnswers(answers []byte, count int) []string {
 		} else if AType == 28 {
 			var data [16]byte
 			if offset+16 > len(answers) {
-				return nil
+				return nil, 0
 			}
 			copy(data[:], answers[offset:offset+16])
 			ip := net.IP(answers[offset : offset+16]).String()
@@ -245,7 +274,7 @@ func getAnswers(answers []byte, count int) []string {
 		offset += int(DataLength)
 	}
 
-	return ips
+	return ips, ttl
 }
 
 func packAnswers(ips []string, qtype int) (int, []byte) {
@@ -300,7 +329,7 @@ func AddECS(request []byte, ecs net.IP) []byte {
 	if binary.BigEndian.Uint16(request[10:12]) > 0 {
 		return request
 	}
-	request_ecs := make([]byte, 512)
+	request_ecs := make([]byte, len(request)+31)
 	length := len(request)
 	copy(request_ecs, request)
 	binary.BigEndian.PutUint16(request_ecs[10:], 1) //ARCount
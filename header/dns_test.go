@@ -0,0 +1,168 @@
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dnsMessage returns a query for name, or a response to it when ips are
+// given, with the A or AAAA records of ips that match qtype.
+func dnsMessage(id uint16, name string, qtype int, ips ...string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	if ips == nil {
+		return msg
+	}
+
+	msg[2] = 0x81
+	msg[3] = 0x80
+	count, answers := packAnswers(ips, qtype)
+	binary.BigEndian.PutUint16(msg[6:], uint16(count))
+	return append(msg, answers...)
+}
+
+func TestGetQName(t *testing.T) {
+	query := dnsMessage(1, "www.example.com", 28)
+	qname, qtype, end := getQName(query)
+	if qname != "www.example.com" || qtype != 28 || end != len(query) {
+		t.Errorf("got %q %d %d", qname, qtype, end)
+	}
+	for n := 0; n < len(query); n++ {
+		if qname, _, end := getQName(query[:n]); qname != "" || end != 0 {
+			t.Errorf("%d bytes: got %q %d", n, qname, end)
+		}
+	}
+}
+
+func TestGetAnswers(t *testing.T) {
+	response := dnsMessage(1, "www.example.com", 1, "1.2.3.4", "5.6.7.8")
+	_, _, off := getQName(response)
+	ips, ttl := getAnswers(response[off:], 2)
+	if !reflect.DeepEqual(ips, []string{"1.2.3.4", "5.6.7.8"}) || ttl != 3600 {
+		t.Errorf("got %v %d", ips, ttl)
+	}
+	if ips, _ := getAnswers(response[off:len(response)-1], 2); ips != nil {
+		t.Errorf("truncated: got %v", ips)
+	}
+
+	response = dnsMessage(1, "www.example.com", 28, "2001:db8::1")
+	ips, _ = getAnswers(response[off:], 1)
+	if !reflect.DeepEqual(ips, []string{"2001:db8::1"}) {
+		t.Errorf("got %v", ips)
+	}
+}
+
+func TestDNS64Response(t *testing.T) {
+	prefix := net.ParseIP("64:ff9b::")
+	response := dnsMessage(1, "www.example.com", 1, "1.2.3.4")
+	_, _, offset := getQName(response)
+
+	response6 := dns64Response(response, offset, prefix)
+	if response6 == nil {
+		t.Fatal("no response")
+	}
+	qname, qtype, off := getQName(response6)
+	if qname != "www.example.com" || qtype != 28 {
+		t.Errorf("question %q %d", qname, qtype)
+	}
+	ips, _ := getAnswers(response6[off:], 1)
+	if !reflect.DeepEqual(ips, []string{"64:ff9b::102:304"}) {
+		t.Errorf("got %v", ips)
+	}
+
+	//a CNAME whose data runs past the end of the message
+	cname := append([]byte{}, response[:offset]...)
+	cname = append(cname, 0xC0, 0x0C, 0, 5, 0, 1, 0, 0, 0, 60, 0, 200, 3, 'w', 'w', 'w')
+	if response6 := dns64Response(cname, offset, prefix); response6 != nil {
+		t.Errorf("got %x", response6)
+	}
+	if response6 := dns64Response(response[:offset+10], offset, prefix); response6 != nil {
+		t.Errorf("truncated: got %x", response6)
+	}
+}
+
+func FuzzGetQName(f *testing.F) {
+	f.Add(dnsMessage(1, "www.example.com", 1))
+	f.Add(dnsMessage(1, "a", 28))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, _, end := getQName(b)
+		if end < 0 || end > len(b) {
+			t.Errorf("end %d of %d bytes", end, len(b))
+		}
+	})
+}
+
+func FuzzGetAnswers(f *testing.F) {
+	response := dnsMessage(1, "www.example.com", 1, "1.2.3.4", "5.6.7.8")
+	_, _, off := getQName(response)
+	f.Add(response[off:], 2)
+	response = dnsMessage(1, "www.example.com", 28, "2001:db8::1")
+	f.Add(response[off:], 1)
+	f.Fuzz(func(t *testing.T, b []byte, count int) {
+		if count > 1024 {
+			count = 1024
+		}
+		getAnswers(b, count)
+	})
+}
+
+// FuzzTCPlookupDNS64 fuzzes the upstream answers TCPlookupDNS64 rewrites.
+func FuzzTCPlookupDNS64(f *testing.F) {
+	prefix := net.ParseIP("64:ff9b::")
+	for _, response := range [][]byte{
+		dnsMessage(1, "www.example.com", 1, "1.2.3.4", "5.6.7.8"),
+		dnsMessage(1, "www.example.com", 1, "1.2.3.4"),
+	} {
+		_, _, offset := getQName(response)
+		f.Add(response, offset)
+	}
+	f.Fuzz(func(t *testing.T, response []byte, offset int) {
+		response6 := dns64Response(response, offset, prefix)
+		if response6 != nil && !bytes.Equal(response6[:2], response[:2]) {
+			t.Errorf("ID changed: %x", response6[:2])
+		}
+	})
+}
+
+func TestDNSUpstreamRules(t *testing.T) {
+	write := testConfig(t)
+	write("method=ttl\nttl=5\nserver=8.8.8.8:53\nmethod=w-md5\ndns=1.1.1.1:53,[2001:db8::1]:853\nexample.com\ndns=1.1.1.1:53\n")
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the upstreams of dns= get the method they are set with, like server=
+	for addr, want := range map[string]IPConfig{
+		"8.8.8.8":     {OPT_TTL, 5, 0, 0},
+		"1.1.1.1":     {OPT_WMD5, 5, 0, 0},
+		"2001:db8::1": {OPT_WMD5, 5, 0, 0},
+	} {
+		if config, ok := cfg.rules.IP(addr); !ok || config != want {
+			t.Errorf("%s: %+v %v", addr, config, ok)
+		}
+	}
+	if addrs := cfg.divertedAddrs(); !reflect.DeepEqual(addrs, []string{"8.8.8.8:53", "1.1.1.1:53", "[2001:db8::1]:853"}) {
+		t.Errorf("diverted %v", addrs)
+	}
+
+	write("ipv6=false\ndns=[2001:db8::1]:53\n")
+	if _, err := loadConfigFile(ConfigFile); err == nil {
+		t.Error("an IPv6 dns= with ipv6=false")
+	}
+	write("ipv4=false\ndns=1.1.1.1:53\n")
+	if _, err := loadConfigFile(ConfigFile); err == nil {
+		t.Error("an IPv4 dns= with ipv4=false")
+	}
+}
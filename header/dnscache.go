@@ -0,0 +1,274 @@
+package ghostcp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DNSCache keeps the answers of the upstreams of DNSDaemon, by qname, qtype,
+// upstream and ECS. An answer is served with its TTLs counting down until
+// the smallest of them runs out. It is served stale, with DNSCacheStaleTTL,
+// for DNSCacheStale after that while it is fetched again in the background.
+// Concurrent queries for the same key share one upstream lookup.
+var DNSCache = newDNSCache()
+
+var DNSCacheSize = 4096
+var DNSCacheMaxTTL uint32 = 86400
+var DNSCacheNegativeTTL uint32 = 60
+var DNSCacheStale = time.Hour
+var DNSCacheStaleTTL uint32 = 30
+
+type dnsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*dnsCall
+
+	hits, stale, misses, shared uint64
+}
+
+type dnsCacheEntry struct {
+	key      string
+	response []byte
+	ttl      uint32
+	stored   time.Time
+}
+
+type dnsCall struct {
+	wg       sync.WaitGroup
+	response []byte
+	err      error
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[string]*dnsCall),
+	}
+}
+
+// dnsCacheKey is the key of the answer to qname and qtype from server. The
+// ECS and the DNS64 prefix change the answer, so they are part of it.
+func dnsCacheKey(qname string, qtype int, server string, ecs []byte, prefix []byte) string {
+	return qname + "/" + strconv.Itoa(qtype) + "/" + server + "/" + string(ecs) + "/" + string(prefix)
+}
+
+// Lookup answers request from the cache, or with fetch. The answer is a
+// copy with the ID of request.
+func (c *dnsCache) Lookup(key string, request []byte, fetch func() ([]byte, error)) ([]byte, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		entry := e.Value.(*dnsCacheEntry)
+		age := now.Sub(entry.stored)
+		if age < time.Duration(entry.ttl)*time.Second {
+			c.hits++
+			c.lru.MoveToFront(e)
+			c.mutex.Unlock()
+			return answerFromCache(entry.response, request, uint32(age/time.Second), 0), nil
+		}
+		if age < time.Duration(entry.ttl)*time.Second+DNSCacheStale {
+			c.stale++
+			c.lru.MoveToFront(e)
+			if _, ok := c.calls[key]; !ok {
+				go c.fetch(key, fetch)
+			}
+			c.mutex.Unlock()
+			logPrintln(4, "stale", key)
+			return answerFromCache(entry.response, request, 0, DNSCacheStaleTTL), nil
+		}
+	}
+	c.mutex.Unlock()
+
+	response, err := c.fetch(key, fetch)
+	if err != nil || response == nil {
+		return nil, err
+	}
+	return answerFromCache(response, request, 0, 0), nil
+}
+
+// fetch runs fetch for key, or waits for the one running, and caches the
+// answer.
+func (c *dnsCache) fetch(key string, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mutex.Lock()
+	call, ok := c.calls[key]
+	if ok {
+		c.shared++
+		c.mutex.Unlock()
+		call.wg.Wait()
+		return call.response, call.err
+	}
+	c.misses++
+	call = &dnsCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	call.response, call.err = fetch()
+
+	c.mutex.Lock()
+	delete(c.calls, key)
+	if call.err == nil && call.response != nil {
+		ttl, ok := cacheTTL(call.response)
+		if ok {
+			c.store(key, call.response, ttl)
+		}
+	}
+	c.mutex.Unlock()
+	call.wg.Done()
+
+	return call.response, call.err
+}
+
+// store adds an answer, dropping the least recently used ones past
+// DNSCacheSize. Called with c.mutex held.
+func (c *dnsCache) store(key string, response []byte, ttl uint32) {
+	entry := &dnsCacheEntry{key, response, ttl, time.Now()}
+	e, ok := c.entries[key]
+	if ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for DNSCacheSize > 0 && c.lru.Len() > DNSCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// Expire drops the answers too old to be served even stale and returns how
+// many were dropped.
+func (c *dnsCache) Expire(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		entry := e.Value.(*dnsCacheEntry)
+		if now.Sub(entry.stored) >= time.Duration(entry.ttl)*time.Second+DNSCacheStale {
+			c.lru.Remove(e)
+			delete(c.entries, entry.key)
+			count++
+		}
+		e = prev
+	}
+	return count
+}
+
+// Stats returns the number of answers served from the cache, served stale,
+// fetched and shared with a concurrent query.
+func (c *dnsCache) Stats() (hits uint64, stale uint64, misses uint64, shared uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.stale, c.misses, c.shared
+}
+
+// answerFromCache copies response with the ID of request. Its TTLs are
+// lowered by age, or all set to ttl if it is not 0.
+func answerFromCache(response []byte, request []byte, age uint32, ttl uint32) []byte {
+	message := make([]byte, len(response))
+	copy(message, response)
+	message[0], message[1] = request[0], request[1]
+	if age > 0 || ttl > 0 {
+		walkRecords(message, func(record []byte) {
+			recordTTL := binary.BigEndian.Uint32(record)
+			if ttl > 0 {
+				recordTTL = ttl
+			} else if recordTTL > age {
+				recordTTL -= age
+			} else {
+				recordTTL = 0
+			}
+			binary.BigEndian.PutUint32(record, recordTTL)
+		})
+	}
+	return message
+}
+
+// cacheTTL returns how long response can be cached: the smallest TTL of its
+// records, or DNSCacheNegativeTTL if it has none. Failures and truncated
+// answers are not cached.
+func cacheTTL(response []byte) (uint32, bool) {
+	if len(response) < 12 || response[2]&0x02 != 0 {
+		return 0, false
+	}
+	rcode := response[3] & 0x0F
+	if rcode != 0 && rcode != 3 {
+		return 0, false
+	}
+
+	ttl := DNSCacheMaxTTL
+	records := 0
+	ok := walkRecords(response, func(record []byte) {
+		recordTTL := binary.BigEndian.Uint32(record)
+		if recordTTL < ttl {
+			ttl = recordTTL
+		}
+		records++
+	})
+	if !ok {
+		return 0, false
+	}
+	if records == 0 && DNSCacheNegativeTTL < ttl {
+		ttl = DNSCacheNegativeTTL
+	}
+	return ttl, ttl > 0
+}
+
+// walkRecords calls f with the TTL field of every record of message but the
+// OPT record, which has no TTL. It reports whether message parsed.
+func walkRecords(message []byte, f func(ttl []byte)) bool {
+	if len(message) < 12 {
+		return false
+	}
+	qdCount := int(binary.BigEndian.Uint16(message[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(message[6:8])) +
+		int(binary.BigEndian.Uint16(message[8:10])) +
+		int(binary.BigEndian.Uint16(message[10:12]))
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		offset = skipName(message, offset) + 4
+		if offset < 4 || offset > len(message) {
+			return false
+		}
+	}
+	for i := 0; i < rrCount; i++ {
+		offset = skipName(message, offset)
+		if offset < 0 || offset+10 > len(message) {
+			return false
+		}
+		rrType := binary.BigEndian.Uint16(message[offset : offset+2])
+		if rrType != 41 {
+			f(message[offset+4 : offset+8])
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(message[offset+8:offset+10]))
+		if offset > len(message) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipName returns the offset past the name at offset, or -1.
+func skipName(message []byte, offset int) int {
+	for offset < len(message) {
+		length := message[offset]
+		if length == 0 {
+			return offset + 1
+		}
+		if length >= 0xC0 {
+			return offset + 2
+		}
+		offset += 1 + int(length)
+	}
+	return -1
+}
@@ -0,0 +1,202 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordTTLs returns the TTLs of the records of message.
+func recordTTLs(message []byte) []uint32 {
+	var ttls []uint32
+	walkRecords(message, func(ttl []byte) {
+		ttls = append(ttls, binary.BigEndian.Uint32(ttl))
+	})
+	return ttls
+}
+
+// backdate makes the answer of key in c stored d ago.
+func backdate(c *dnsCache, key string, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.entries[key].Value.(*dnsCacheEntry)
+	entry.stored = time.Now().Add(-d)
+}
+
+func TestDNSCache(t *testing.T) {
+	c := newDNSCache()
+	key := dnsCacheKey("www.example.com", 1, "1.1.1.1:53", nil, nil)
+	fetched := make(chan bool, 10)
+	fetch := func() ([]byte, error) {
+		fetched <- true
+		return dnsMessage(0, "www.example.com", 1, "1.2.3.4", "5.6.7.8"), nil
+	}
+	lookup := func(id uint16) []byte {
+		response, err := c.Lookup(key, dnsMessage(id, "www.example.com", 1), fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(response) != id {
+			t.Errorf("ID %x, want %x", response[:2], id)
+		}
+		return response
+	}
+
+	lookup(1)
+	if len(fetched) != 1 {
+		t.Fatal(len(fetched), "fetches")
+	}
+	<-fetched
+
+	//the TTLs count down, the answer is not fetched again
+	backdate(c, key, 100*time.Second)
+	if ttls := recordTTLs(lookup(2)); !reflect.DeepEqual(ttls, []uint32{3500, 3500}) {
+		t.Errorf("TTLs %v", ttls)
+	}
+	if len(fetched) != 0 {
+		t.Error("fetched a cached answer")
+	}
+
+	//expired, it is served stale while it is fetched again
+	backdate(c, key, 3610*time.Second)
+	if ttls := recordTTLs(lookup(3)); !reflect.DeepEqual(ttls, []uint32{DNSCacheStaleTTL, DNSCacheStaleTTL}) {
+		t.Errorf("stale TTLs %v", ttls)
+	}
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no refresh")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ttls := recordTTLs(lookup(4)); reflect.DeepEqual(ttls, []uint32{3600, 3600}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//too old to be served stale, it is fetched before the answer
+	backdate(c, key, 3600*time.Second+DNSCacheStale)
+	lookup(5)
+	if len(fetched) != 1 {
+		t.Errorf("%d fetches", len(fetched))
+	}
+	<-fetched
+
+	if hits, stale, misses, _ := c.Stats(); stale < 1 || misses != 3 || hits < 2 {
+		t.Errorf("hits %d stale %d misses %d", hits, stale, misses)
+	}
+
+	backdate(c, key, 3600*time.Second+DNSCacheStale)
+	if n := c.Expire(time.Now()); n != 1 || len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("expired %d, %d left", n, len(c.entries))
+	}
+}
+
+func TestDNSCacheShared(t *testing.T) {
+	c := newDNSCache()
+	key := dnsCacheKey("www.example.com", 1, "1.1.1.1:53", nil, nil)
+	release := make(chan bool)
+	var fetches int32
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return dnsMessage(0, "www.example.com", 1, "1.2.3.4"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			response, err := c.Lookup(key, dnsMessage(id, "www.example.com", 1), fetch)
+			if err != nil || binary.BigEndian.Uint16(response) != id {
+				t.Errorf("%d: got %x %v", id, response, err)
+			}
+		}(uint16(i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, misses, shared := c.Stats(); misses+shared == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the lookups did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d fetches", n)
+	}
+	if _, _, misses, shared := c.Stats(); misses != 1 || shared != 9 {
+		t.Errorf("misses %d shared %d", misses, shared)
+	}
+
+	//a failure is fetched again on the next query
+	key = dnsCacheKey("fail.example.com", 1, "1.1.1.1:53", nil, nil)
+	for i := 0; i < 2; i++ {
+		_, err := c.Lookup(key, dnsMessage(1, "fail.example.com", 1), func() ([]byte, error) {
+			return nil, errors.New("down")
+		})
+		if err == nil {
+			t.Error("no error")
+		}
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("a failure was cached")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	response := dnsMessage(1, "www.example.com", 1, "1.2.3.4")
+	nxdomain := dnsMessage(1, "www.example.com", 1)
+	nxdomain[2], nxdomain[3] = 0x81, 0x83
+	servfail := append([]byte{}, nxdomain...)
+	servfail[3] = 0x82
+	truncated := append([]byte{}, response...)
+	truncated[2] |= 0x02
+
+	tests := []struct {
+		name     string
+		response []byte
+		ttl      uint32
+		ok       bool
+	}{
+		{"answer", response, 3600, true},
+		{"NXDOMAIN", nxdomain, DNSCacheNegativeTTL, true},
+		{"SERVFAIL", servfail, 0, false},
+		{"truncated", truncated, 0, false},
+		{"short", response[:len(response)-1], 0, false},
+	}
+	for _, test := range tests {
+		ttl, ok := cacheTTL(test.response)
+		if ttl != test.ttl || ok != test.ok {
+			t.Errorf("%s: got %d %v", test.name, ttl, ok)
+		}
+	}
+
+	//the keys differ by ECS and DNS64 prefix
+	keys := map[string]bool{}
+	for _, key := range []string{
+		dnsCacheKey("www.example.com", 1, "1.1.1.1:53", nil, nil),
+		dnsCacheKey("www.example.com", 28, "1.1.1.1:53", nil, nil),
+		dnsCacheKey("www.example.com", 1, "8.8.8.8:53", nil, nil),
+		dnsCacheKey("www.example.com", 1, "1.1.1.1:53", []byte{1, 2}, nil),
+		dnsCacheKey("www.example.com", 1, "1.1.1.1:53", nil, []byte{1, 2}),
+	} {
+		keys[key] = true
+	}
+	if len(keys) != 5 {
+		t.Errorf("%d keys", len(keys))
+	}
+}
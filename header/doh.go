@@ -0,0 +1,173 @@
+package ghostcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DoH servers are given by URL, https://host/dns-query. The queries are
+// POSTed, or sent with GET if the URL ends with the {?dns} template of
+// RFC 8484, https://host/dns-query{?dns}.
+//
+// A DoH client dials the address its host was resolved to when the config
+// was loaded: the connection gets the rule of that IP like any other, and
+// it never needs the DNS it serves.
+var DoHTimeout = 5 * time.Second
+
+type dohClient struct {
+	addr   string
+	client *http.Client
+}
+
+var dohMutex sync.Mutex
+var dohClients = make(map[string]*dohClient)
+
+func isDoH(server string) bool {
+	return strings.HasPrefix(server, "https://")
+}
+
+// resolveUpstream resolves the value of server= or dns=, an ip:port or
+// the URL of a DoH or DoT server. It returns the server as the DNS daemon
+// uses it and the address its connections go to.
+func resolveUpstream(value string, network string) (string, *net.TCPAddr, error) {
+	if isDoT(value) {
+		host, port, _, err := parseDoT(value)
+		if err != nil {
+			return "", nil, err
+		}
+		addr, err := net.ResolveTCPAddr(network, net.JoinHostPort(host, port))
+		if err != nil {
+			return "", nil, err
+		}
+		return value, addr, nil
+	}
+	if !isDoH(value) {
+		addr, err := net.ResolveTCPAddr(network, value)
+		if err != nil {
+			return "", nil, err
+		}
+		return addr.String(), addr, nil
+	}
+
+	u, err := url.Parse(strings.Replace(value, "{?dns}", "", 1))
+	if err != nil {
+		return "", nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr, err := net.ResolveTCPAddr(network, net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", nil, err
+	}
+	return value, addr, nil
+}
+
+// setDoHServers makes the clients of servers, a map of URL to address.
+// The connections of a client whose address did not change are kept.
+func setDoHServers(servers map[string]string) {
+	dohMutex.Lock()
+	defer dohMutex.Unlock()
+
+	clients := make(map[string]*dohClient)
+	for server, addr := range servers {
+		c, ok := dohClients[server]
+		if !ok || c.addr != addr {
+			c = newDoHClient(server, addr)
+		}
+		clients[server] = c
+	}
+	for server, c := range dohClients {
+		if clients[server] != c {
+			c.client.CloseIdleConnections()
+		}
+	}
+	dohClients = clients
+}
+
+func newDoHClient(server string, addr string) *dohClient {
+	u, _ := url.Parse(strings.Replace(server, "{?dns}", "", 1))
+	dialer := &net.Dialer{Timeout: DoHTimeout}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+		TLSClientConfig:     &tls.Config{ServerName: u.Hostname()},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: DoHTimeout,
+	}
+	return &dohClient{addr, &http.Client{Transport: transport, Timeout: DoHTimeout}}
+}
+
+// DoHlookup sends a DNS request to a DoH server. The request goes with ID 0,
+// as RFC 8484 asks, and the answer gets the ID of the request back.
+func DoHlookup(request []byte, server string) ([]byte, error) {
+	dohMutex.Lock()
+	c, ok := dohClients[server]
+	dohMutex.Unlock()
+	if !ok {
+		return nil, errors.New("unknown DoH server " + server)
+	}
+	if len(request) < 12 {
+		return nil, errors.New("DNS request too short")
+	}
+
+	message := make([]byte, len(request))
+	copy(message, request)
+	message[0], message[1] = 0, 0
+
+	var req *http.Request
+	var err error
+	if strings.HasSuffix(server, "{?dns}") {
+		u := strings.TrimSuffix(server, "{?dns}")
+		if strings.Contains(u, "?") {
+			u += "&dns="
+		} else {
+			u += "?dns="
+		}
+		u += base64.RawURLEncoding.EncodeToString(message)
+		req, err = http.NewRequest("GET", u, nil)
+	} else {
+		req, err = http.NewRequest("POST", server, bytes.NewReader(message))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(server + ": " + resp.Status)
+	}
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, errors.New(server + ": short DNS answer")
+	}
+	response[0], response[1] = request[0], request[1]
+
+	return response, nil
+}
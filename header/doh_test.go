@@ -0,0 +1,126 @@
+package ghostcp
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// answerQuery returns the answer to query, with its ID, of the ips that
+// match its type.
+func answerQuery(query []byte, ips ...string) []byte {
+	qname, qtype, _ := getQName(query)
+	return dnsMessage(binary.BigEndian.Uint16(query), qname, qtype, ips...)
+}
+
+// testDoH starts a DoH server for https://example.com/dns-query and makes
+// the clients of its GET and POST URLs. It returns the URLs and the number
+// of connections the server accepted.
+func testDoH(t *testing.T) (string, string, *int32) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case "GET":
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case "POST":
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil || len(query) < 12 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerQuery(query, "1.2.3.4", "2001:db8::1"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	post := "https://example.com/dns-query"
+	get := "https://example.com/dns-query{?dns}"
+	addr := server.Listener.Addr().String()
+	setDoHServers(map[string]string{post: addr, get: addr})
+	t.Cleanup(func() { setDoHServers(nil) })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	for _, c := range dohClients {
+		c.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	}
+	return post, get, &conns
+}
+
+func TestDoHlookup(t *testing.T) {
+	post, get, conns := testDoH(t)
+
+	for _, server := range []string{post, get} {
+		for i, qtype := range []int{1, 28} {
+			id := uint16(0x1234 + i)
+			response, err := DoHlookup(dnsMessage(id, "www.example.com", qtype), server)
+			if err != nil {
+				t.Fatal(server, err)
+			}
+			if binary.BigEndian.Uint16(response) != id {
+				t.Errorf("%s: ID %x, want %x", server, response[:2], id)
+			}
+			_, _, off := getQName(response)
+			ips, _ := getAnswers(response[off:], 1)
+			want := map[int]string{1: "1.2.3.4", 28: "2001:db8::1"}[qtype]
+			if !reflect.DeepEqual(ips, []string{want}) {
+				t.Errorf("%s %d: got %v", server, qtype, ips)
+			}
+		}
+	}
+	//one connection for each client, reused by its queries
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("%d connections", n)
+	}
+
+	if _, err := DoHlookup(dnsMessage(1, "www.example.com", 1), "https://example.com/other"); err == nil {
+		t.Error("no error for an unknown server")
+	}
+	if _, err := DoHlookup(make([]byte, 11), post); err == nil {
+		t.Error("no error for a short request")
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	write := testConfig(t)
+	write("method=ttl\nttl=5\nserver=https://127.0.0.1:8443/dns-query\n")
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the TLS connection gets the method of server= like a plain upstream
+	if config, ok := cfg.rules.IP("127.0.0.1"); !ok || config != (IPConfig{OPT_TTL, 5, 0, 0}) {
+		t.Errorf("got %+v %v", config, ok)
+	}
+	if cfg.dns != "https://127.0.0.1:8443/dns-query" || !reflect.DeepEqual(cfg.dnsAddrs, []string{"127.0.0.1:8443"}) {
+		t.Errorf("server %s %v", cfg.dns, cfg.dnsAddrs)
+	}
+	if cfg.doh["https://127.0.0.1:8443/dns-query"] != "127.0.0.1:8443" {
+		t.Errorf("doh %v", cfg.doh)
+	}
+}
@@ -0,0 +1,117 @@
+package ghostcp
+
+import (
+	"strings"
+)
+
+// domainTree matches names against domain rules by longest suffix. It is a
+// trie over the labels of the rules, the last label at the root. A rule is
+// one of:
+//
+//	example.com     the domain only
+//	*.example.com   its subdomains, at any depth (.example.com too)
+//	+example.com    the domain and its subdomains
+//	!example.com    neither: the domain and its subdomains get no rule
+//
+// The rule of the longest matching suffix applies, so !ads.example.com
+// takes ads.example.com out of +example.com.
+type domainTree struct {
+	root domainNode
+}
+
+type domainNode struct {
+	child   map[string]*domainNode
+	exact   *domainRule
+	sub     *domainRule
+	exclude string
+}
+
+type domainRule struct {
+	name   string
+	config Config
+}
+
+// domainPattern splits a rule into its domain and its form: the first byte
+// of the rule if it is one of *, +, ! or a dot, else 0.
+func domainPattern(name string) (string, byte) {
+	if strings.HasPrefix(name, "*.") {
+		return name[2:], '*'
+	}
+	if len(name) > 1 {
+		switch name[0] {
+		case '.':
+			return name[1:], '*'
+		case '+', '!':
+			return name[1:], name[0]
+		}
+	}
+	return name, 0
+}
+
+func (t *domainTree) insert(name string, config Config) {
+	domain, form := domainPattern(name)
+
+	node := &t.root
+	end := len(domain)
+	for end > 0 {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		label := domain[start:end]
+		next := node.child[label]
+		if next == nil {
+			if node.child == nil {
+				node.child = make(map[string]*domainNode)
+			}
+			next = &domainNode{}
+			node.child[label] = next
+		}
+		node = next
+		end = start - 1
+	}
+
+	rule := &domainRule{name, config}
+	switch form {
+	case '!':
+		node.exact, node.sub, node.exclude = nil, nil, name
+		return
+	case '*':
+		node.sub = rule
+	case '+':
+		node.exact, node.sub = rule, rule
+	default:
+		node.exact = rule
+	}
+	node.exclude = ""
+}
+
+// match returns the rule of the longest suffix of name that has one. For
+// an exclusion it returns its name and false.
+func (t *domainTree) match(name string) (Config, string, bool) {
+	var best *domainRule
+	exclude := ""
+
+	node := &t.root
+	end := len(name)
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		node = node.child[name[start:end]]
+		if node == nil {
+			break
+		}
+		if node.exclude != "" {
+			best, exclude = nil, node.exclude
+		}
+		if start == 0 {
+			if node.exact != nil {
+				best, exclude = node.exact, ""
+			}
+		} else if node.sub != nil {
+			best, exclude = node.sub, ""
+		}
+		end = start - 1
+	}
+
+	if best == nil {
+		return Config{}, exclude, false
+	}
+	return best.config, best.name, true
+}
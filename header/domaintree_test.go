@@ -0,0 +1,129 @@
+package ghostcp
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDomainTree(t *testing.T) {
+	var tree domainTree
+	for i, name := range []string{
+		"example.com",
+		"*.wild.com",
+		".dot.com",
+		"+both.com",
+		"!ads.both.com",
+		"+ok.ads.both.com",
+		"!gone.com",
+		"+gone.com",
+		"+back.com",
+		"!back.com",
+		"+com.cn",
+		"!www.com.cn",
+	} {
+		tree.insert(name, Config{Option: uint32(i)})
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "", false},
+		{"wild.com", "", false},
+		{"a.wild.com", "*.wild.com", true},
+		{"a.b.c.wild.com", "*.wild.com", true},
+		{"dot.com", "", false},
+		{"a.dot.com", ".dot.com", true},
+		{"both.com", "+both.com", true},
+		{"www.both.com", "+both.com", true},
+		{"ads.both.com", "!ads.both.com", false},
+		{"x.ads.both.com", "!ads.both.com", false},
+		{"ok.ads.both.com", "+ok.ads.both.com", true},
+		{"www.ok.ads.both.com", "+ok.ads.both.com", true},
+		{"gone.com", "+gone.com", true},
+		{"back.com", "!back.com", false},
+		{"www.back.com", "!back.com", false},
+		{"a.com.cn", "+com.cn", true},
+		{"www.com.cn", "!www.com.cn", false},
+		{"com", "", false},
+		{"", "", false},
+		{"example.org", "", false},
+	}
+	for _, test := range tests {
+		_, rule, ok := tree.match(test.name)
+		if rule != test.rule || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v", test.name, rule, ok, test.rule, test.ok)
+		}
+	}
+}
+
+// mapMatchDomain is MatchDomain before domainTree: the name, then its
+// .parent rules within SubdomainDepth labels, looked up in the name map.
+func mapMatchDomain(s *RuleStore, name string, depth int) (Config, string, bool) {
+	config, ok := s.Domain(name)
+	if ok {
+		return config, name, true
+	}
+
+	offset := 0
+	for i := 0; i < depth; i++ {
+		off := strings.Index(name[offset:], ".")
+		if off == -1 {
+			break
+		}
+		offset += off
+		config, ok = s.Domain(name[offset:])
+		if ok {
+			return config, name[offset:], true
+		}
+		offset++
+	}
+	return config, "", false
+}
+
+func BenchmarkMatchDomain(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	label := func() string {
+		return fmt.Sprintf("%x", r.Intn(1<<20))
+	}
+
+	//the old lists added a name and its .name, the trie takes +name
+	tree, names := NewRuleStore(), NewRuleStore()
+	var domains []string
+	for i := 0; i < 50000; i++ {
+		domain := label() + ".com"
+		domains = append(domains, domain)
+		tree.SetDomain("+"+domain, Config{})
+		names.domains[domain] = Config{}
+		names.domains["."+domain] = Config{}
+	}
+
+	queries := make([]string, 1024)
+	for i := range queries {
+		switch i % 3 {
+		case 0:
+			queries[i] = domains[r.Intn(len(domains))]
+		case 1:
+			queries[i] = "www." + domains[r.Intn(len(domains))]
+		default:
+			queries[i] = "www." + label() + ".org"
+		}
+	}
+
+	b.Run("tree", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tree.MatchDomain(queries[i%len(queries)])
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mapMatchDomain(names, queries[i%len(queries)], 2)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package ghostcp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DoT servers are given by URL, tls://host:853. The host is the SNI and the
+// name the certificate is verified for, unless the URL sets them:
+//
+//	tls://1.1.1.1:853?sni=cloudflare-dns.com
+//	tls://1.1.1.1:853?pin=sha256/<base64 of the SHA-256 of the public key>
+//
+// With pins the certificate chain is not verified: the key of the server's
+// own certificate, the one the handshake proves, must match a pin instead.
+//
+// Each server has one connection, opened on the first query and kept open.
+// The queries are pipelined on it, with IDs of their own.
+var dotMutex sync.Mutex
+var dotClients = make(map[string]*pipeClient)
+
+func isDoT(server string) bool {
+	return strings.HasPrefix(server, "tls://")
+}
+
+// parseDoT returns the host, port and TLS config of a DoT URL.
+func parseDoT(server string) (string, string, *tls.Config, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if u.Hostname() == "" {
+		return "", "", nil, errors.New("DoT needs a host: " + server)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	config := &tls.Config{ServerName: u.Hostname()}
+	var pins [][]byte
+	//not u.Query(), which reads the + of base64 as a space
+	for _, option := range strings.Split(u.RawQuery, "&") {
+		if option == "" {
+			continue
+		}
+		keys := strings.SplitN(option, "=", 2)
+		if len(keys) < 2 {
+			return "", "", nil, errors.New("unknown DoT option " + option)
+		}
+		value, err := url.PathUnescape(keys[1])
+		if err != nil {
+			return "", "", nil, err
+		}
+		switch keys[0] {
+		case "sni":
+			config.ServerName = value
+		case "pin":
+			if !strings.HasPrefix(value, "sha256/") {
+				return "", "", nil, errors.New("DoT pin must be sha256/<base64>: " + value)
+			}
+			pin, err := base64.StdEncoding.DecodeString(value[7:])
+			if err != nil || len(pin) != sha256.Size {
+				return "", "", nil, errors.New("bad DoT pin " + value)
+			}
+			pins = append(pins, pin)
+		default:
+			return "", "", nil, errors.New("unknown DoT option " + keys[0])
+		}
+	}
+	if pins != nil {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			//the handshake proves only the key of certs[0], the rest of the
+			//chain is whatever the server sent
+			if len(certs) == 0 {
+				return errors.New(server + " sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(certs[0])
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(sum[:]) == string(pin) {
+					return nil
+				}
+			}
+			return errors.New("the certificate of " + server + " does not match its pins")
+		}
+	}
+	return u.Hostname(), port, config, nil
+}
+
+// setDoTServers makes the clients of servers, a map of URL to address.
+// The connection of a client whose address did not change is kept.
+func setDoTServers(servers map[string]string) {
+	dotMutex.Lock()
+	defer dotMutex.Unlock()
+
+	clients := make(map[string]*pipeClient)
+	for server, addr := range servers {
+		c, ok := dotClients[server]
+		if !ok || c.addr != addr {
+			_, _, config, err := parseDoT(server)
+			if err != nil {
+				if LogLevel > 0 {
+					log.Println(server, err)
+				}
+				continue
+			}
+			c = &pipeClient{addr: addr, config: config}
+		}
+		clients[server] = c
+	}
+	for server, c := range dotClients {
+		if clients[server] != c {
+			c.close(nil)
+		}
+	}
+	dotClients = clients
+}
+
+// DoTlookup sends a DNS request to a DoT server and waits for its answer.
+func DoTlookup(request []byte, server string) ([]byte, error) {
+	dotMutex.Lock()
+	c, ok := dotClients[server]
+	dotMutex.Unlock()
+	if !ok {
+		return nil, errors.New("unknown DoT server " + server)
+	}
+	return c.query(request)
+}
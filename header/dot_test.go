@@ -0,0 +1,235 @@
+package ghostcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for host.
+func testCert(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: cert}
+}
+
+// certPin returns the pin= of the key of cert.
+func certPin(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// serveDNS runs handle on each connection accepted by ln until the test ends.
+func serveDNS(t *testing.T, ln net.Listener, handle func(conn net.Conn)) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// readQuery reads a DNS message of a TCP stream.
+func readQuery(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	query := make([]byte, binary.BigEndian.Uint16(header))
+	_, err := io.ReadFull(conn, query)
+	return query, err
+}
+
+// writeAnswer writes a DNS message on a TCP stream.
+func writeAnswer(conn net.Conn, answer []byte) error {
+	data := make([]byte, len(answer)+2)
+	binary.BigEndian.PutUint16(data, uint16(len(answer)))
+	copy(data[2:], answer)
+	_, err := conn.Write(data)
+	return err
+}
+
+// answerQueries answers the queries of conn with ips.
+func answerQueries(conn net.Conn, ips ...string) {
+	for {
+		query, err := readQuery(conn)
+		if err != nil {
+			return
+		}
+		if writeAnswer(conn, answerQuery(query, ips...)) != nil {
+			return
+		}
+	}
+}
+
+// testDoT starts a DoT server presenting chain that runs handle on its
+// connections, or answers their queries if handle is nil, and makes the
+// client of server, a URL without its host, for it.
+func testDoT(t *testing.T, chain [][]byte, key interface{}, server string, handle func(conn net.Conn)) string {
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: chain, PrivateKey: key}}}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle == nil {
+		handle = func(conn net.Conn) {
+			answerQueries(conn, "1.2.3.4")
+		}
+	}
+	serveDNS(t, ln, handle)
+
+	server = "tls://" + ln.Addr().String() + server
+	setDoTServers(map[string]string{server: ln.Addr().String()})
+	t.Cleanup(func() { setDoTServers(nil) })
+	return server
+}
+
+func TestDoTPin(t *testing.T) {
+	good, bad := testCert(t, "dot.example"), testCert(t, "dot.example")
+	pin := "?sni=dot.example&pin=" + certPin(good)
+
+	server := testDoT(t, good.Certificate, good.PrivateKey, pin, nil)
+	response, err := DoTlookup(dnsMessage(7, "www.example.com", 1), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, off := getQName(response); off == 0 || binary.BigEndian.Uint16(response) != 7 {
+		t.Errorf("got %x", response)
+	}
+
+	//a certificate of its own followed by the pinned one
+	chain := [][]byte{bad.Certificate[0], good.Certificate[0]}
+	server = testDoT(t, chain, bad.PrivateKey, pin, nil)
+	if _, err := DoTlookup(dnsMessage(7, "www.example.com", 1), server); err == nil {
+		t.Error("a chain with the pinned key after the leaf was accepted")
+	}
+
+	//without pins the chain is verified
+	server = testDoT(t, good.Certificate, good.PrivateKey, "?sni=dot.example", nil)
+	if _, err := DoTlookup(dnsMessage(7, "www.example.com", 1), server); err == nil {
+		t.Error("a self-signed certificate was accepted")
+	}
+}
+
+func TestDoTPipelining(t *testing.T) {
+	cert := testCert(t, "dot.example")
+	var conns int32
+	handle := func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		//three queries on the connection, answered in the reverse order
+		var queries [][]byte
+		for len(queries) < 3 {
+			query, err := readQuery(conn)
+			if err != nil {
+				return
+			}
+			queries = append(queries, query)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			writeAnswer(conn, answerQuery(queries[i], "1.2.3.4"))
+		}
+		answerQueries(conn, "1.2.3.4")
+	}
+	server := testDoT(t, cert.Certificate, cert.PrivateKey, "?pin="+certPin(cert), handle)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%d.example.com", i)
+			response, err := DoTlookup(dnsMessage(7, name, 1), server)
+			if err != nil {
+				t.Error(name, err)
+				return
+			}
+			if qname, _, _ := getQName(response); qname != name || binary.BigEndian.Uint16(response) != 7 {
+				t.Errorf("%s: got %s %x", name, qname, response[:2])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//the connection is kept for the next query
+	if _, err := DoTlookup(dnsMessage(8, "www.example.com", 1), server); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections", n)
+	}
+
+	//DNS64 goes through lookup like the other queries
+	query := dnsMessage(9, "www.example.com", 28)
+	_, _, offset := getQName(query)
+	response, err := TCPlookupDNS64(query, server, offset, net.ParseIP("64:ff9b::"))
+	if err != nil || response == nil {
+		t.Fatal(response, err)
+	}
+	_, _, off := getQName(response)
+	if ips, _ := getAnswers(response[off:], 1); len(ips) != 1 || ips[0] != "64:ff9b::102:304" {
+		t.Errorf("DNS64: got %v", ips)
+	}
+}
+
+func TestParseDoT(t *testing.T) {
+	for _, server := range []string{
+		"tls://1.1.1.1:853?pin=sha256/abc",
+		"tls://1.1.1.1:853?pin=md5/" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"tls://1.1.1.1:853?foo=bar",
+		"tls://:853",
+	} {
+		if _, _, _, err := parseDoT(server); err == nil {
+			t.Error(server, "no error")
+		}
+	}
+
+	host, port, config, err := parseDoT("tls://1.1.1.1?sni=cloudflare-dns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "1.1.1.1" || port != "853" || config.ServerName != "cloudflare-dns.com" || config.InsecureSkipVerify {
+		t.Errorf("got %s %s %+v", host, port, config)
+	}
+}
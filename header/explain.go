@@ -0,0 +1,261 @@
+package ghostcp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// methodNames returns the methods of option as they are written in the
+// config.
+func methodNames(option uint32) string {
+	var methods []uint32
+	names := make(map[uint32]string)
+	for name, method := range MethodMap {
+		if method != OPT_NONE && option&method == method {
+			methods = append(methods, method)
+			names[method] = name
+		}
+	}
+	if len(methods) == 0 {
+		return "none"
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+
+	list := make([]string, len(methods))
+	for i, method := range methods {
+		list[i] = names[method]
+	}
+	return strings.Join(list, ",")
+}
+
+type explainer struct {
+	cfg       *configFile
+	hostsPath string
+	lines     []string
+}
+
+// Explain loads ConfigFile and the hosts file without putting them in use
+// and describes the rule that target, a domain, an IP or an ip:port, gets.
+func Explain(target string, hostsPath string) ([]string, error) {
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.hosts != "" {
+		hostsPath = cfg.hosts
+	}
+	if hostsPath != "" {
+		err = loadHosts(hostsPath, cfg.rules, cfg.hostsStatic)
+		if err != nil {
+			hostsPath = ""
+		}
+	}
+
+	e := &explainer{cfg: cfg, hostsPath: hostsPath}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+		port = ""
+	}
+	ip := net.ParseIP(host)
+	if ip != nil {
+		e.explainIP(ip, port)
+	} else {
+		e.explainDomain(host)
+	}
+
+	return e.lines, nil
+}
+
+func (e *explainer) printf(format string, v ...interface{}) {
+	e.lines = append(e.lines, fmt.Sprintf(format, v...))
+}
+
+// source returns where rule is set: the config lines, or the hosts file if
+// the config does not set it.
+func (e *explainer) source(rule string) string {
+	lines := e.cfg.sources[rule]
+	if len(lines) == 0 {
+		if e.hostsPath != "" {
+			return e.hostsPath
+		}
+		return "?"
+	}
+
+	source := lines[len(lines)-1]
+	if len(lines) > 1 {
+		source += ", also " + strings.Join(lines[:len(lines)-1], ", ")
+	}
+	return source
+}
+
+func (e *explainer) printIPConfig(config IPConfig) {
+	e.printf("method:  %s", methodNames(config.Option))
+	e.printf("ttl:     %d", config.TTL)
+	e.printf("max-ttl: %d", config.MAXTTL)
+	e.printf("mss:     %d", config.MSS)
+}
+
+func (e *explainer) explainDomain(name string) {
+	rules := e.cfg.rules
+	e.printf("domain %s", name)
+
+	config, rule, ok := rules.MatchDomain(name)
+	excluded := !ok && rule != ""
+	if !ok && !excluded {
+		if rules.settings.subdomainDepth == 0 {
+			config = Config{0, 0, 0, 0, nil, 0, 0, nil, nil, ""}
+			ok = true
+			e.printf("rule:    none, subdomain=0 answers every other domain with no record")
+		} else if rules.settings.defaultConfig != nil {
+			config = *rules.settings.defaultConfig
+			ok = true
+			rule = "*"
+		}
+	}
+
+	if !ok {
+		if excluded {
+			e.printf("rule:    excluded by %s (%s)", rule, e.source("domain "+rule))
+		} else {
+			e.printf("rule:    none")
+		}
+		e.printf("DNS:     passed through to the system DNS")
+		e.printf("The IPs it resolves to get no rule unless they have one of their own.")
+		return
+	}
+	if rule != "" {
+		e.printf("rule:    %s (%s)", rule, e.source("domain "+rule))
+	}
+
+	e.printIPConfig(IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS})
+	if config.ECS != nil {
+		e.printf("ecs:     %s", config.ECS)
+	}
+	e.printf("A:       %s", e.answers(config, 1))
+	e.printf("AAAA:    %s", e.answers(config, 28))
+
+	learned := config.ANCount4 < 0 || config.ANCount6 < 0
+	if (e.cfg.dns == "" && config.Server == "" || config.Server == DNS_SYSTEM) && config.Option <= 1 {
+		learned = false
+	}
+	if learned {
+		e.printf("The IPs it resolves to get its method, unless they have a rule of their own.")
+		if e.cfg.rules.settings.ipBlock {
+			e.printf("IPs in a CIDR rule get the rule of the CIDR instead.")
+		}
+	}
+}
+
+// answers describes how a query of qtype for a domain with config is
+// answered.
+func (e *explainer) answers(config Config, qtype int) string {
+	count := config.ANCount4
+	answers := config.Answers4
+	if qtype == 28 {
+		count = config.ANCount6
+		answers = config.Answers6
+	}
+
+	if count == 0 {
+		return "no record"
+	}
+	if count > 0 {
+		ips, _ := getAnswers(answers, int(count))
+		return "static " + strings.Join(ips, ",")
+	}
+
+	server := e.cfg.dns
+	if config.Server != "" {
+		server = config.Server
+	}
+	if server == "" || server == DNS_SYSTEM {
+		return "system DNS"
+	}
+	if qtype == 28 && answers != nil {
+		return fmt.Sprintf("A records from %s, mapped into %s/96", upstreamName(server), net.IP(answers))
+	}
+	return upstreamName(server)
+}
+
+func upstreamName(server string) string {
+	if strings.Contains(server, ",") {
+		var names []string
+		for _, s := range strings.Split(server, ",") {
+			names = append(names, upstreamName(s))
+		}
+		if Rules.Settings().dnsRace {
+			return "the first answer of " + strings.Join(names, ", ")
+		}
+		return strings.Join(names, ", then ")
+	}
+	if isDoH(server) {
+		return server + " over HTTPS"
+	}
+	if isDoT(server) {
+		return server + " over TLS"
+	}
+	return server + " over TCP"
+}
+
+func (e *explainer) explainIP(ip net.IP, port string) {
+	rules := e.cfg.rules
+	addr := ip.String()
+	if port != "" {
+		e.printf("ip %s", net.JoinHostPort(addr, port))
+	} else {
+		e.printf("ip %s", addr)
+	}
+
+	config, ok := rules.IP(addr)
+	if ok {
+		e.printf("rule:    %s (%s)", addr, e.source("ip "+addr))
+		e.printIPConfig(config)
+	} else {
+		node := rules.cidrs.match(ip)
+		cidr := ""
+		if node != nil {
+			cidr = node.ipnet.String()
+			config = node.config
+		} else {
+			config, ok = rules.IP("0.0.0.0/0")
+			if ok {
+				cidr = "0.0.0.0/0"
+			}
+		}
+
+		if cidr == "" {
+			e.printf("rule:    none")
+			e.printf("Connections are passed through unless a domain with a rule resolves to it.")
+		} else {
+			e.printf("rule:    none of its own; %s (%s) applies once a domain with a rule resolves to it", cidr, e.source("ip "+cidr))
+			e.printIPConfig(config)
+		}
+	}
+
+	if port == "" {
+		return
+	}
+
+	daemons := []string{":443", ":80"}
+	if e.cfg.dns != "" {
+		daemons = append(daemons, e.cfg.dns)
+	}
+	for _, key := range e.cfg.daemons {
+		daemons = append(daemons, key.address)
+	}
+	for _, daemon := range daemons {
+		host, p, err := net.SplitHostPort(daemon)
+		if err != nil || p != port {
+			continue
+		}
+		daemonIP := net.ParseIP(host)
+		if host == "" || daemonIP != nil && daemonIP.Equal(ip) {
+			e.printf("daemon:  %s", daemon)
+			return
+		}
+	}
+	e.printf("daemon:  none, port %s of %s is not diverted", port, addr)
+}
@@ -0,0 +1,122 @@
+package ghostcp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	write := testConfig(t)
+	dir := filepath.Dir(ConfigFile)
+	for name, data := range map[string]string{
+		"more.conf": "static.example=5.6.7.8 @slow\nwww.example.com\n5.6.7.8 @slow\n",
+		"hosts":     "9.8.7.6 hosted.example\n5.5.5.5 www.example.com\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("[profile slow] method=w-md5 ttl=8\nmethod=ttl\nttl=5\nwww.example.com\ninclude=more.conf\n1.2.3.4\n10.0.0.0/8\n!ads.example.com\nhosts-static=true\n")
+
+	tests := []struct {
+		target string
+		lines  []string
+	}{
+		//the last line that sets a rule is where it comes from, the
+		//hosts file adds its IPs
+		{"www.example.com", []string{
+			"domain www.example.com",
+			"rule:    www.example.com (dir/more.conf:2, also dir/default.conf:4)",
+			"method:  ttl",
+			"ttl:     5",
+			"max-ttl: 0",
+			"mss:     0",
+			"A:       static 5.5.5.5",
+			"AAAA:    system DNS",
+		}},
+		{"static.example", []string{
+			"domain static.example",
+			"rule:    static.example (dir/more.conf:1 @slow)",
+			"method:  w-md5",
+			"ttl:     8",
+			"max-ttl: 0",
+			"mss:     0",
+			"A:       static 5.6.7.8",
+			"AAAA:    system DNS",
+			"The IPs it resolves to get its method, unless they have a rule of their own.",
+			"IPs in a CIDR rule get the rule of the CIDR instead.",
+		}},
+		{"ads.example.com", []string{
+			"domain ads.example.com",
+			"rule:    excluded by !ads.example.com (dir/default.conf:8)",
+			"DNS:     passed through to the system DNS",
+			"The IPs it resolves to get no rule unless they have one of their own.",
+		}},
+		{"hosted.example", []string{
+			"domain hosted.example",
+			"rule:    hosted.example (dir/hosts)",
+			"method:  none",
+			"ttl:     0",
+			"max-ttl: 0",
+			"mss:     0",
+			"A:       static 9.8.7.6",
+			"AAAA:    system DNS",
+		}},
+		{"other.example", []string{
+			"domain other.example",
+			"rule:    none",
+			"DNS:     passed through to the system DNS",
+			"The IPs it resolves to get no rule unless they have one of their own.",
+		}},
+		{"1.2.3.4", []string{
+			"ip 1.2.3.4",
+			"rule:    1.2.3.4 (dir/default.conf:6)",
+			"method:  ttl",
+			"ttl:     5",
+			"max-ttl: 0",
+			"mss:     0",
+		}},
+		//the hosts file gives the IPs of a domain its method
+		{"5.5.5.5", []string{
+			"ip 5.5.5.5",
+			"rule:    5.5.5.5 (dir/hosts)",
+			"method:  ttl",
+			"ttl:     5",
+			"max-ttl: 0",
+			"mss:     0",
+		}},
+		{"5.6.7.8:443", []string{
+			"ip 5.6.7.8:443",
+			"rule:    5.6.7.8 (dir/more.conf:3 @slow, also dir/more.conf:1 @slow)",
+			"method:  w-md5",
+			"ttl:     8",
+			"max-ttl: 0",
+			"mss:     0",
+			"daemon:  :443",
+		}},
+		{"10.1.2.3:8080", []string{
+			"ip 10.1.2.3:8080",
+			"rule:    none of its own; 10.0.0.0/8 (dir/default.conf:7) applies once a domain with a rule resolves to it",
+			"method:  ttl",
+			"ttl:     5",
+			"max-ttl: 0",
+			"mss:     0",
+			"daemon:  none, port 8080 of 10.1.2.3 is not diverted",
+		}},
+	}
+	for _, test := range tests {
+		lines, err := Explain(test.target, filepath.Join(dir, "hosts"))
+		if err != nil {
+			t.Fatal(test.target, err)
+		}
+		for i := range lines {
+			lines[i] = strings.ReplaceAll(lines[i], dir, "dir")
+		}
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s:\n%s\nwant\n%s", test.target, strings.Join(lines, "\n"), strings.Join(test.lines, "\n"))
+		}
+	}
+}
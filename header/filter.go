@@ -0,0 +1,348 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// divertFilter is a parsed WinDivert filter expression. Only the subset of
+// the language built by the daemons is supported, which is enough for
+// backends that cannot hand the string to WinDivert itself.
+type divertFilter struct {
+	op    string
+	left  *divertFilter
+	right *divertFilter
+	field string
+	cmp   string
+	value uint32
+	ip    net.IP
+}
+
+var filterFlags = map[string]byte{
+	"tcp.Fin": TCP_FIN,
+	"tcp.Syn": TCP_SYN,
+	"tcp.Rst": TCP_RST,
+	"tcp.Psh": TCP_PSH,
+	"tcp.Ack": TCP_ACK,
+	"tcp.Urg": TCP_URG,
+}
+
+var filterBoolFields = map[string]bool{
+	"true": true, "false": true,
+	"inbound": true, "outbound": true,
+	"ip": true, "ipv6": true, "tcp": true, "udp": true,
+	"tcp.Fin": true, "tcp.Syn": true, "tcp.Rst": true,
+	"tcp.Psh": true, "tcp.Ack": true, "tcp.Urg": true,
+}
+
+var filterValueFields = map[string]bool{
+	"ip.SrcAddr": true, "ip.DstAddr": true,
+	"ipv6.SrcAddr": true, "ipv6.DstAddr": true,
+	"ip.TTL": true, "ipv6.HopLimit": true, "ip.Protocol": true,
+	"tcp.SrcPort": true, "tcp.DstPort": true,
+	"udp.SrcPort": true, "udp.DstPort": true,
+	"tcp.PayloadLength": true, "udp.PayloadLength": true,
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, s[i:i+1])
+				i++
+			}
+		case c == '&' || c == '|':
+			if i+1 >= len(s) || s[i+1] != c {
+				return nil, fmt.Errorf("bad operator at %d", i)
+			}
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t()=!<>&|", s[j]) == -1 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseDivertFilter(s string) (*divertFilter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) parseOr() (*divertFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &divertFilter{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (*divertFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &divertFilter{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (*divertFilter, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.next()
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &divertFilter{op: "not", left: f}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (*divertFilter, error) {
+	t := p.next()
+	if t == "" {
+		return nil, errors.New("unexpected end of filter")
+	}
+	if t == "(" {
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ) in filter")
+		}
+		return f, nil
+	}
+
+	switch p.peek() {
+	case "==", "=", "!=", "<", "<=", ">", ">=":
+	default:
+		if !filterBoolFields[t] {
+			return nil, fmt.Errorf("unknown filter field %q", t)
+		}
+		return &divertFilter{op: "field", field: t}, nil
+	}
+
+	if !filterValueFields[t] {
+		return nil, fmt.Errorf("unknown filter field %q", t)
+	}
+	cmp := p.next()
+	if cmp == "=" {
+		cmp = "=="
+	}
+	v := p.next()
+	f := &divertFilter{op: "cmp", field: t, cmp: cmp}
+	if strings.HasSuffix(t, "Addr") {
+		f.ip = net.ParseIP(v)
+		if f.ip == nil {
+			return nil, fmt.Errorf("bad address %q in filter", v)
+		}
+		if cmp != "==" && cmp != "!=" {
+			return nil, fmt.Errorf("bad operator %q for %s", cmp, t)
+		}
+	} else {
+		n, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad value %q in filter", v)
+		}
+		f.value = uint32(n)
+	}
+	return f, nil
+}
+
+// Match evaluates the filter against a packet. Fields of a protocol the
+// packet does not carry evaluate to false, as in WinDivert.
+func (f *divertFilter) Match(packet *Packet) bool {
+	switch f.op {
+	case "and":
+		return f.left.Match(packet) && f.right.Match(packet)
+	case "or":
+		return f.left.Match(packet) || f.right.Match(packet)
+	case "not":
+		return !f.left.Match(packet)
+	}
+
+	raw := packet.Raw
+	if len(raw) < 20 {
+		return false
+	}
+	ipv6 := raw[0]>>4 == 6
+	var ipheadlen int
+	var proto byte
+	if ipv6 {
+		if len(raw) < 40 {
+			return false
+		}
+		ipheadlen = 40
+		proto = raw[6]
+	} else {
+		ipheadlen = int(raw[0]&0xF) * 4
+		proto = raw[9]
+	}
+	l4 := []byte(nil)
+	if ipheadlen <= len(raw) {
+		l4 = raw[ipheadlen:]
+	}
+	isTCP := proto == 6 && len(l4) >= 20
+	isUDP := proto == 17 && len(l4) >= 8
+
+	if f.op == "field" {
+		switch f.field {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "inbound":
+			return packet.Addr != nil && packet.Addr.Inbound()
+		case "outbound":
+			return packet.Addr == nil || !packet.Addr.Inbound()
+		case "ip":
+			return !ipv6
+		case "ipv6":
+			return ipv6
+		case "tcp":
+			return isTCP
+		case "udp":
+			return isUDP
+		default:
+			return isTCP && l4[13]&filterFlags[f.field] != 0
+		}
+	}
+
+	var value uint32
+	switch f.field {
+	case "ip.SrcAddr", "ip.DstAddr", "ipv6.SrcAddr", "ipv6.DstAddr":
+		if strings.HasPrefix(f.field, "ipv6.") != ipv6 {
+			return false
+		}
+		var addr net.IP
+		if strings.HasSuffix(f.field, "SrcAddr") {
+			addr = packet.SrcIP()
+		} else {
+			addr = packet.DstIP()
+		}
+		if f.cmp == "==" {
+			return addr.Equal(f.ip)
+		}
+		return !addr.Equal(f.ip)
+	case "ip.TTL":
+		if ipv6 {
+			return false
+		}
+		value = uint32(raw[8])
+	case "ipv6.HopLimit":
+		if !ipv6 {
+			return false
+		}
+		value = uint32(raw[7])
+	case "ip.Protocol":
+		if ipv6 {
+			return false
+		}
+		value = uint32(proto)
+	case "tcp.SrcPort", "tcp.DstPort", "tcp.PayloadLength":
+		if !isTCP {
+			return false
+		}
+		switch f.field {
+		case "tcp.SrcPort":
+			value = uint32(binary.BigEndian.Uint16(l4[0:]))
+		case "tcp.DstPort":
+			value = uint32(binary.BigEndian.Uint16(l4[2:]))
+		default:
+			value = uint32(len(l4) - int(l4[12]>>4)*4)
+		}
+	case "udp.SrcPort", "udp.DstPort", "udp.PayloadLength":
+		if !isUDP {
+			return false
+		}
+		switch f.field {
+		case "udp.SrcPort":
+			value = uint32(binary.BigEndian.Uint16(l4[0:]))
+		case "udp.DstPort":
+			value = uint32(binary.BigEndian.Uint16(l4[2:]))
+		default:
+			value = uint32(len(l4) - 8)
+		}
+	}
+
+	switch f.cmp {
+	case "==":
+		return value == f.value
+	case "!=":
+		return value != f.value
+	case "<":
+		return value < f.value
+	case "<=":
+		return value <= f.value
+	case ">":
+		return value > f.value
+	case ">=":
+		return value >= f.value
+	}
+	return false
+}
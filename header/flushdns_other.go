@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package ghostcp
+
+import (
+	"os/exec"
+)
+
+// flushDNS drops the cache of systemd-resolved when it is running. Systems
+// without a local cache have nothing to flush.
+func flushDNS() error {
+	cmd := exec.Command("resolvectl", "flush-caches")
+	d, err := cmd.CombinedOutput()
+	if err != nil {
+		logPrintln(2, string(d), err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package ghostcp
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func flushDNS() error {
+	arg := []string{"/flushdns"}
+	cmd := exec.Command("ipconfig", arg...)
+	d, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v", d, err)
+	}
+	return nil
+}
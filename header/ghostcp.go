@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +26,7 @@ type Config struct {
 	ANCount6 int16
 	Answers4 []byte
 	Answers6 []byte
+	Server   string
 }
 
 type IPConfig struct {
@@ -33,17 +36,16 @@ type IPConfig struct {
 	MSS    uint16
 }
 
-var DefaultConfig *Config = nil
-var DomainMap map[string]Config
-var IPMap map[string]IPConfig
-var BadIPMap map[string]bool
+var ConfigFile = "default.conf"
 var wg sync.WaitGroup
 var mutex sync.Mutex
 
-var SubdomainDepth = 2
+// tasks counts the goroutines the daemons start to finish with a packet,
+// like the DNS lookups of DNSDaemon.
+var tasks sync.WaitGroup
+
 var LogLevel = 0
 var Forward bool = false
-var IPBlock = false
 var IPMode = false
 var TFOEnable = false
 var RSTFilterEnable = false
@@ -110,110 +112,60 @@ var Logger *log.Logger
 
 func logPrintln(level int, v ...interface{}) {
 	if LogLevel >= level {
-		fmt.Println(v)
+		fmt.Println(v...)
 	}
 }
 
 func domainLookup(qname string) (Config, bool) {
-	config, ok := DomainMap[qname]
+	config, rule, ok, settings := Rules.matchDomain(qname)
 	if ok {
 		return config, true
 	}
-
-	if SubdomainDepth == 0 {
-		return Config{0, 0, 0, 0, nil, 0, 0, nil, nil}, true
+	//excluded by a !domain rule
+	if rule != "" {
+		return Config{0, 0, 0, 0, nil, -1, -1, nil, nil, ""}, false
 	}
 
-	offset := 0
-	for i := 0; i < SubdomainDepth; i++ {
-		off := strings.Index(qname[offset:], ".")
-		if off == -1 {
-			break
-		}
-		offset += off
-		config, ok = DomainMap[qname[offset:]]
-		if ok {
-			return config, true
-		}
-		offset++
+	if settings.subdomainDepth == 0 {
+		return Config{0, 0, 0, 0, nil, 0, 0, nil, nil, ""}, true
 	}
-
-	if DefaultConfig != nil {
-		return *DefaultConfig, true
+	if settings.defaultConfig != nil {
+		return *settings.defaultConfig, true
 	} else {
-		return Config{0, 0, 0, 0, nil, -1, -1, nil, nil}, false
+		return Config{0, 0, 0, 0, nil, -1, -1, nil, nil, ""}, false
 	}
 }
 
 func IPLookup(addr string) (IPConfig, bool) {
-	config, ok := IPMap[addr]
+	config, ok := Rules.IP(addr)
 	if ok {
 		return config, true
 	}
 
 	if IPMode {
-		ip := net.ParseIP(addr)
-		ip4 := ip.To4()
-		if ip4 != nil {
-			for i := 31; i >= 8; i-- {
-				mask := net.CIDRMask(i, 32)
-				addr := fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i)
-				config, ok = IPMap[addr]
-				if ok {
-					return config, true
-				}
-			}
-		} else {
-			for i := 64; i >= 16; i -= 16 {
-				mask := net.CIDRMask(i, 128)
-				addr := fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i)
-				config, ok = IPMap[addr]
-				if ok {
-					return config, true
-				}
-			}
-		}
-
-		config, ok := IPMap["0.0.0.0/0"]
-		return config, ok
+		return IPBlockLookup(addr)
 	}
 
 	return config, false
 }
 
 func IPBlockLookup(addr string) (IPConfig, bool) {
-	var config IPConfig
-	ok := false
-
 	ip := net.ParseIP(addr)
-	ip4 := ip.To4()
-	if ip4 != nil {
-		for i := 31; i >= 8; i-- {
-			mask := net.CIDRMask(i, 32)
-			addr := fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i)
-			config, ok = IPMap[addr]
-			if ok {
-				return config, true
-			}
-		}
-	} else {
-		for i := 64; i >= 16; i -= 16 {
-			mask := net.CIDRMask(i, 128)
-			addr := fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i)
-			config, ok = IPMap[addr]
-			if ok {
-				return config, true
-			}
+	if ip != nil {
+		config, ok := Rules.CIDR(ip)
+		if ok {
+			return config, true
 		}
 	}
 
-	config, ok = IPMap["0.0.0.0/0"]
+	//0.0.0.0/0 also covers IPv6
+	config, ok := Rules.IP("0.0.0.0/0")
 	return config, ok
 }
 
 func getSNI(b []byte) (offset int, length int) {
 	payloadLen := len(b)
-	if payloadLen < 11+32 {
+	if payloadLen < 11+32+1 {
 		return 0, 0
 	}
 	if b[0] != 0x16 {
@@ -282,7 +234,7 @@ func getHost(b []byte) (offset int, length int) {
 	}
 	offset += 6
 	length = bytes.Index(b[offset:], []byte("\r\n"))
-	if offset == -1 {
+	if length == -1 {
 		return 0, 0
 	}
 
@@ -290,6 +242,9 @@ func getHost(b []byte) (offset int, length int) {
 }
 
 func getSNIFromQUIC(payload []byte) string {
+	if len(payload) < 6 {
+		return ""
+	}
 	flags := payload[0]
 	longHead := flags&0x80 != 0
 	if !longHead {
@@ -322,20 +277,33 @@ func getSNIFromQUIC(payload []byte) string {
 	}
 
 	headlen := 6 + dstIDLen + srcIDLen
+	if headlen > len(payload) {
+		return ""
+	}
 	hs := payload[headlen:]
 
 	offset := bytes.Index(hs, []byte("CHLO"))
 	if offset > 0 {
 		hs = hs[offset:]
+		if len(hs) < 8 {
+			return ""
+		}
 		tagNum := int(binary.LittleEndian.Uint16(hs[4:8]))
 		hs = hs[8:]
+		if tagNum*8 > len(hs) {
+			return ""
+		}
+		values := hs[tagNum*8:]
 		tagsOffset := 0
 		for i := 0; i < tagNum; i++ {
+			tagsOffsetEnd := int(binary.LittleEndian.Uint16(hs[i*8+4 : i*8+8]))
+			if tagsOffsetEnd < tagsOffset || tagsOffsetEnd > len(values) {
+				return ""
+			}
 			if string(hs[i*8:i*8+4]) == "SNI\x00" {
-				tagsOffsetEnd := int(binary.LittleEndian.Uint16(hs[i*8+4 : i*8+8]))
-				return string(hs[tagNum*8+tagsOffset : tagNum*8+tagsOffsetEnd])
+				return string(values[tagsOffset:tagsOffsetEnd])
 			}
-			tagsOffset = int(binary.LittleEndian.Uint16(hs[i*8+4 : i*8+8]))
+			tagsOffset = tagsOffsetEnd
 		}
 	}
 
@@ -392,17 +360,150 @@ func getMyIPv6() net.IP {
 }
 
 func LoadConfig() error {
-	DomainMap = make(map[string]Config)
-	IPMap = make(map[string]IPConfig)
-	BadIPMap = make(map[string]bool)
-
-	conf, err := os.Open("default.conf")
+	cfg, err := loadConfigFile(ConfigFile)
 	if err != nil {
 		return err
 	}
-	defer conf.Close()
 
-	br := bufio.NewReader(conf)
+	DNS = cfg.dns
+	DNSAddrs = cfg.divertedAddrs()
+	DNSOption = cfg.dnsOption
+	DNSUpstreams = cfg.upstreams
+	if cfg.logLevel >= 0 {
+		LogLevel = cfg.logLevel
+	}
+	TFOEnable = TFOEnable || cfg.tfoEnable
+	DetectEnable = DetectEnable || cfg.detectEnable
+	RSTFilterEnable = RSTFilterEnable || cfg.rstFilterEnable
+	reloadMutex.Lock()
+	startConfig = cfg
+	applyConfig(cfg)
+	reloadMutex.Unlock()
+	startExpiry()
+
+	return nil
+}
+
+// configFile is what loadConfigFile reads from a config file. Nothing in
+// it is in use until applyConfig.
+type configFile struct {
+	rules         *RuleStore
+	dns           string
+	dnsAddrs      []string
+	upstreamAddrs []string
+	doh           map[string]string
+	dot           map[string]string
+	dnsOption     uint32
+	daemons       []daemonKey
+	nat64         []nat64Rule
+	subscriptions []subscription
+	upstreams     []string
+	hosts         string
+	hostsStatic   bool
+	forward       bool
+	sources       map[string][]string
+	files         []string
+
+	//read when the daemons start, a reload does not change them
+	logLevel        int
+	tfoEnable       bool
+	detectEnable    bool
+	rstFilterEnable bool
+}
+
+// divertedAddrs returns the addresses of the server= and dns= upstreams,
+// whose TCP connections are diverted.
+func (cfg *configFile) divertedAddrs() []string {
+	addrs := append([]string{}, cfg.dnsAddrs...)
+	for _, addr := range cfg.upstreamAddrs {
+		if !containsString(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// source records that a line of the config sets rule.
+func (cfg *configFile) source(rule string, line ConfigLine) {
+	source := fmt.Sprintf("%s:%d", line.File, line.Num)
+	if line.Profile != "" {
+		source += " @" + line.Profile
+	}
+	cfg.sources[rule] = append(cfg.sources[rule], source)
+}
+
+// configScope is the positional state of the loader that an included file
+// does not pass back.
+type configScope struct {
+	option     uint32
+	minTTL     byte
+	maxTTL     byte
+	syncMSS    uint16
+	ipv6Enable bool
+	ipv4Enable bool
+	ecs        net.IP
+	upstream   string
+}
+
+type nat64Rule struct {
+	ipv4   net.IP
+	prefix net.IP
+}
+
+// ConfigLine is a line of a config file that is not empty or a comment.
+// Keys holds the line without its comment and its @profile, split at the
+// first "=".
+type ConfigLine struct {
+	File    string
+	Num     int
+	Text    string
+	Keys    []string
+	Profile string
+}
+
+func readConfigLines(r io.Reader) ([]ConfigLine, error) {
+	br := bufio.NewReader(r)
+	var lines []ConfigLine
+
+	num := 0
+	for {
+		line, _, err := br.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		num++
+		if len(line) > 0 && line[0] != '#' {
+			lines = append(lines, newConfigLine(string(line), num))
+		}
+	}
+
+	return lines, nil
+}
+
+func newConfigLine(text string, num int) ConfigLine {
+	l := strings.SplitN(text, "#", 2)[0]
+	profile := ""
+	fields := strings.Fields(l)
+	if len(fields) > 1 && l[0] != '[' && strings.HasPrefix(fields[len(fields)-1], "@") {
+		profile = fields[len(fields)-1][1:]
+		l = strings.TrimSpace(l[:strings.LastIndex(l, "@")])
+	}
+	return ConfigLine{"", num, text, strings.SplitN(l, "=", 2), profile}
+}
+
+func loadConfigFile(name string) (*configFile, error) {
+	rules := NewRuleStore()
+	cfg := &configFile{rules: rules, sources: make(map[string][]string), doh: make(map[string]string), dot: make(map[string]string)}
+	cfg.logLevel = -1
+
+	lines, files, err := readConfigFile(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.files = files
 
 	var option uint32 = 0
 	var minTTL byte = 0
@@ -411,215 +512,319 @@ func LoadConfig() error {
 	ipv6Enable := true
 	ipv4Enable := true
 	var ecs net.IP = nil
-
-	for {
-		line, _, err := br.ReadLine()
-		if err == io.EOF {
-			break
+	upstream := ""
+	var scopes []configScope
+	var restore *configScope
+	profiles := make(map[string]configScope)
+	profileName := ""
+
+	scope := func() configScope {
+		return configScope{option, minTTL, maxTTL, syncMSS, ipv6Enable, ipv4Enable, ecs, upstream}
+	}
+	setScope := func(scope configScope) {
+		option, minTTL, maxTTL, syncMSS = scope.option, scope.minTTL, scope.maxTTL, scope.syncMSS
+		ipv6Enable, ipv4Enable, ecs, upstream = scope.ipv6Enable, scope.ipv4Enable, scope.ecs, scope.upstream
+	}
+
+	for _, l := range lines {
+		line := l.Text
+		keys := l.Keys
+		if restore != nil {
+			setScope(*restore)
+			restore = nil
 		}
-		if len(line) > 0 {
-			if line[0] != '#' {
-				l := strings.SplitN(string(line), "#", 2)[0]
-				keys := strings.SplitN(l, "=", 2)
-				if len(keys) > 1 {
-					if keys[0] == "server" {
-						var tcpAddr *net.TCPAddr
-						var err error
-						if ipv6Enable {
-							if ipv4Enable {
-								tcpAddr, err = net.ResolveTCPAddr("tcp", keys[1])
-							} else {
-								tcpAddr, err = net.ResolveTCPAddr("tcp6", keys[1])
-							}
-						} else {
-							tcpAddr, err = net.ResolveTCPAddr("tcp4", keys[1])
-						}
-						if err != nil {
-							log.Println(string(line), err)
-							return err
+		if keys[0] == "include" {
+			if len(keys) > 1 {
+				scopes = append(scopes, scope())
+				logPrintln(2, string(line), keys[1])
+			} else if len(scopes) > 0 {
+				setScope(scopes[len(scopes)-1])
+				scopes = scopes[:len(scopes)-1]
+			}
+			continue
+		}
+		if keys[0] == "profile" {
+			//the settings of a profile start from the defaults
+			if len(keys) > 1 {
+				scopes = append(scopes, scope())
+				setScope(configScope{OPT_NONE, 0, 0, 0, true, true, nil, ""})
+				profileName = keys[1]
+			} else if len(scopes) > 0 {
+				profiles[profileName] = scope()
+				setScope(scopes[len(scopes)-1])
+				scopes = scopes[:len(scopes)-1]
+				logPrintln(2, string(line))
+			}
+			continue
+		}
+		if l.Profile != "" {
+			profile, ok := profiles[l.Profile]
+			if !ok {
+				log.Println(string(line), "unknown profile")
+				return nil, errors.New("unknown profile " + l.Profile)
+			}
+			saved := scope()
+			restore = &saved
+			setScope(profile)
+		}
+		if len(keys) > 1 {
+			if keys[0] == "server" {
+				network := "tcp"
+				if !ipv4Enable {
+					network = "tcp6"
+				} else if !ipv6Enable {
+					network = "tcp4"
+				}
+				server, tcpAddrs, err := cfg.addUpstream(keys[1], network)
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				cfg.dns = server
+				cfg.dnsAddrs = nil
+				cfg.dnsOption = option
+				for _, tcpAddr := range tcpAddrs {
+					cfg.dnsAddrs = append(cfg.dnsAddrs, tcpAddr.String())
+					cfg.source("ip "+tcpAddr.IP.String(), l)
+					rules.SetIP(tcpAddr.IP.String(), IPConfig{option, minTTL, maxTTL, syncMSS})
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "hosts" {
+				cfg.hosts = keys[1]
+				if !filepath.IsAbs(cfg.hosts) {
+					cfg.hosts = filepath.Join(filepath.Dir(l.File), cfg.hosts)
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "hosts-static" {
+				cfg.hostsStatic = keys[1] == "true"
+				logPrintln(2, string(line))
+			} else if keys[0] == "dns-race" {
+				rules.settings.dnsRace = keys[1] == "true"
+				logPrintln(2, string(line))
+			} else if keys[0] == "subscribe" {
+				s, err := parseSubscription(keys[1], l.File)
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				cfg.subscriptions = append(cfg.subscriptions, s)
+				logPrintln(2, string(line))
+			} else if keys[0] == "dns" {
+				upstream = keys[1]
+				if upstream != "" && upstream != DNS_SYSTEM {
+					network := "tcp"
+					if !ipv4Enable {
+						network = "tcp6"
+					} else if !ipv6Enable {
+						network = "tcp4"
+					}
+					server, tcpAddrs, err := cfg.addUpstream(upstream, network)
+					if err != nil {
+						log.Println(string(line), err)
+						return nil, err
+					}
+					upstream = server
+					for _, tcpAddr := range tcpAddrs {
+						if !containsString(cfg.upstreamAddrs, tcpAddr.String()) {
+							cfg.upstreamAddrs = append(cfg.upstreamAddrs, tcpAddr.String())
 						}
-						DNS = tcpAddr.String()
-						DNSOption = option
-						IPMap[tcpAddr.IP.String()] = IPConfig{option, minTTL, maxTTL, syncMSS}
-						logPrintln(2, string(line))
-					} else if keys[0] == "ecs" {
-						ecs = net.ParseIP(keys[1])
-						logPrintln(2, string(line))
-					} else if keys[0] == "ipv6" {
-						if keys[1] == "true" {
-							ipv6Enable = true
-						} else {
-							ipv6Enable = false
+						cfg.source("ip "+tcpAddr.IP.String(), l)
+						rules.SetIP(tcpAddr.IP.String(), IPConfig{option, minTTL, maxTTL, syncMSS})
+					}
+				}
+				if upstream != "" && !containsString(cfg.upstreams, upstream) {
+					cfg.upstreams = append(cfg.upstreams, upstream)
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "ecs" {
+				ecs = net.ParseIP(keys[1])
+				logPrintln(2, string(line))
+			} else if keys[0] == "ipv6" {
+				if keys[1] == "true" {
+					ipv6Enable = true
+				} else {
+					ipv6Enable = false
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "ipv4" {
+				if keys[1] == "true" {
+					ipv4Enable = true
+				} else {
+					ipv4Enable = false
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "method" {
+				option = OPT_NONE
+				methods := strings.Split(keys[1], ",")
+				for _, m := range methods {
+					method, ok := MethodMap[m]
+					if ok {
+						option |= method
+						switch method {
+						case OPT_TFO:
+							cfg.tfoEnable = true
+						case OPT_FILTER:
+							cfg.detectEnable = true
+						case OPT_NORST:
+							cfg.rstFilterEnable = true
 						}
-						logPrintln(2, string(line))
-					} else if keys[0] == "ipv4" {
-						if keys[1] == "true" {
-							ipv4Enable = true
-						} else {
-							ipv4Enable = false
+					} else {
+						logPrintln(1, "Unsupported method: "+m)
+					}
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "ttl" {
+				ttl, err := strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				minTTL = byte(ttl)
+				logPrintln(2, string(line))
+			} else if keys[0] == "mss" {
+				mss, err := strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				syncMSS = uint16(mss)
+				logPrintln(2, string(line))
+			} else if keys[0] == "max-ttl" {
+				ttl, err := strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				maxTTL = byte(ttl)
+				logPrintln(2, string(line))
+			} else if keys[0] == "ip-limit" {
+				rules.settings.learnLimit, err = strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+				logPrintln(2, string(line))
+			} else if keys[0] == "subdomain" {
+				rules.settings.subdomainDepth, err = strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				}
+			} else if keys[0] == "log" {
+				cfg.logLevel, err = strconv.Atoi(keys[1])
+				if err != nil {
+					log.Println(string(line), err)
+					return nil, err
+				} else {
+					logPrintln(1, string(line))
+				}
+			} else {
+				ip := net.ParseIP(keys[0])
+				if ip == nil {
+					if strings.HasSuffix(keys[1], ":") {
+						prefix := net.ParseIP(keys[1])
+						if prefix != nil {
+							cfg.source("domain "+keys[0], l)
+							rules.SetDomain(keys[0], Config{option, minTTL, maxTTL, syncMSS, ecs, 0, -1, nil, prefix, upstream})
 						}
-						logPrintln(2, string(line))
-					} else if keys[0] == "method" {
-						option = OPT_NONE
-						methods := strings.Split(keys[1], ",")
-						for _, m := range methods {
-							method, ok := MethodMap[m]
-							if ok {
-								option |= method
-								switch method {
-								case OPT_TFO:
-									TFOEnable = true
-								case OPT_FILTER:
-									DetectEnable = true
-								case OPT_NORST:
-									RSTFilterEnable = true
-								}
-							} else {
-								logPrintln(1, "Unsupported method: "+m)
+					} else {
+						if strings.HasPrefix(keys[1], "[") {
+							config, ok := rules.Domain(keys[1][1 : len(keys[1])-1])
+							if !ok {
+								log.Println(string(line), "bad domain")
+								continue
 							}
-						}
-						logPrintln(2, string(line))
-					} else if keys[0] == "ttl" {
-						ttl, err := strconv.Atoi(keys[1])
-						if err != nil {
-							log.Println(string(line), err)
-							return err
-						}
-						minTTL = byte(ttl)
-						logPrintln(2, string(line))
-					} else if keys[0] == "mss" {
-						mss, err := strconv.Atoi(keys[1])
-						if err != nil {
-							log.Println(string(line), err)
-							return err
-						}
-						syncMSS = uint16(mss)
-						logPrintln(2, string(line))
-					} else if keys[0] == "max-ttl" {
-						ttl, err := strconv.Atoi(keys[1])
-						if err != nil {
-							log.Println(string(line), err)
-							return err
-						}
-						maxTTL = byte(ttl)
-						logPrintln(2, string(line))
-					} else if keys[0] == "subdomain" {
-						SubdomainDepth, err = strconv.Atoi(keys[1])
-						if err != nil {
-							log.Println(string(line), err)
-							return err
-						}
-					} else if keys[0] == "log" {
-						LogLevel, err = strconv.Atoi(keys[1])
-						if err != nil {
-							log.Println(string(line), err)
-							return err
+							cfg.source("domain "+keys[0], l)
+							rules.SetDomain(keys[0], config)
 						} else {
-							logPrintln(1, string(line))
-						}
-					} else {
-						ip := net.ParseIP(keys[0])
-						if ip == nil {
-							if strings.HasSuffix(keys[1], ":") {
-								prefix := net.ParseIP(keys[1])
-								if prefix != nil {
-									DomainMap[keys[0]] = Config{option, minTTL, maxTTL, syncMSS, ecs, 0, -1, nil, prefix}
-								}
-							} else {
-								if strings.HasPrefix(keys[1], "[") {
-									var ok bool
-									config, ok := DomainMap[keys[1][1:len(keys[1])-1]]
-									if !ok {
-										log.Println(string(line), "bad domain")
+							ips := strings.Split(keys[1], ",")
+							for _, ip := range ips {
+								config, ok := rules.IP(ip)
+								if ok {
+									option |= config.Option
+									if syncMSS == 0 {
+										syncMSS = config.MSS
 									}
-									DomainMap[keys[0]] = config
-								} else {
-									ips := strings.Split(keys[1], ",")
-									for _, ip := range ips {
-										config, ok := IPMap[ip]
-										if ok {
-											option |= config.Option
-											if syncMSS == 0 {
-												syncMSS = config.MSS
-											}
-										}
-										IPMap[ip] = IPConfig{option, minTTL, maxTTL, syncMSS}
-									}
-									count4, answer4 := packAnswers(ips, 1)
-									count6, answer6 := packAnswers(ips, 28)
-
-									if ipv4Enable && count4 == 0 {
-										count4 = -1
-									}
-									if ipv6Enable && count6 == 0 {
-										count6 = -1
-									}
-
-									DomainMap[keys[0]] = Config{option,
-										minTTL, maxTTL, syncMSS, ecs,
-										int16(count4), int16(count6),
-										answer4, answer6}
 								}
+								cfg.source("ip "+ip, l)
+								rules.SetIP(ip, IPConfig{option, minTTL, maxTTL, syncMSS})
 							}
-						} else {
-							prefix := net.ParseIP(keys[1])
-							ip4 := ip.To4()
-							if ip4 != nil {
-								if Forward {
-									go NAT64(ip4, prefix, true)
-								}
-								go NAT64(ip4, prefix, false)
+							count4, answer4 := packAnswers(ips, 1)
+							count6, answer6 := packAnswers(ips, 28)
+
+							if ipv4Enable && count4 == 0 {
+								count4 = -1
+							}
+							if ipv6Enable && count6 == 0 {
+								count6 = -1
 							}
+
+							cfg.source("domain "+keys[0], l)
+							rules.SetDomain(keys[0], Config{option,
+								minTTL, maxTTL, syncMSS, ecs,
+								int16(count4), int16(count6),
+								answer4, answer6, upstream})
 						}
 					}
 				} else {
-					if keys[0] == "ipv6" {
-						ipv6Enable = true
-						logPrintln(2, string(line))
-					} else if keys[0] == "ipv4" {
-						ipv4Enable = true
-						logPrintln(2, string(line))
-					} else if keys[0] == "forward" {
-						Forward = true
-						logPrintln(2, string(line))
-					} else {
-						addr, err := net.ResolveTCPAddr("tcp", keys[0])
+					prefix := net.ParseIP(keys[1])
+					ip4 := ip.To4()
+					if ip4 != nil {
+						cfg.nat64 = append(cfg.nat64, nat64Rule{ip4, prefix})
+					}
+				}
+			}
+		} else {
+			if keys[0] == "ipv6" {
+				ipv6Enable = true
+				logPrintln(2, string(line))
+			} else if keys[0] == "ipv4" {
+				ipv4Enable = true
+				logPrintln(2, string(line))
+			} else if keys[0] == "forward" {
+				cfg.forward = true
+				logPrintln(2, string(line))
+			} else {
+				addr, err := net.ResolveTCPAddr("tcp", keys[0])
+				if err == nil {
+					cfg.source("ip "+addr.IP.String(), l)
+					rules.SetIP(addr.IP.String(), IPConfig{option, minTTL, maxTTL, syncMSS})
+					if cfg.forward {
+						cfg.daemons = append(cfg.daemons, daemonKey{keys[0], true})
+					}
+					cfg.daemons = append(cfg.daemons, daemonKey{keys[0], false})
+				} else {
+					if strings.Index(keys[0], "/") > 0 {
+						_, ipnet, err := net.ParseCIDR(keys[0])
 						if err == nil {
-							IPMap[addr.IP.String()] = IPConfig{option, minTTL, maxTTL, syncMSS}
-							if Forward {
-								go TCPDaemon(keys[0], true)
-							}
-							go TCPDaemon(keys[0], false)
+							cfg.source("ip "+ipnet.String(), l)
+							rules.SetCIDR(ipnet, IPConfig{option, minTTL, maxTTL, syncMSS})
+							rules.settings.ipBlock = true
+						}
+					} else {
+						ip := net.ParseIP(keys[0])
+						if ip != nil {
+							cfg.source("ip "+keys[0], l)
+							rules.SetIP(keys[0], IPConfig{option, minTTL, maxTTL, syncMSS})
 						} else {
-							if strings.Index(keys[0], "/") > 0 {
-								_, ipnet, err := net.ParseCIDR(keys[0])
-								if err == nil {
-									IPMap[ipnet.String()] = IPConfig{option, minTTL, maxTTL, syncMSS}
-									IPBlock = true
-								}
+							var count4 int16 = 0
+							var count6 int16 = 0
+							if ipv4Enable {
+								count4 = -1
+							}
+							if ipv6Enable {
+								count6 = -1
+							}
+							if keys[0] == "*" {
+								cfg.source("domain *", l)
+								rules.settings.defaultConfig = &Config{
+									option, minTTL, maxTTL, syncMSS, ecs,
+									count4, count6, nil, nil, upstream}
 							} else {
-								ip := net.ParseIP(keys[0])
-								if ip != nil {
-									IPMap[keys[0]] = IPConfig{option, minTTL, maxTTL, syncMSS}
-								} else {
-									var count4 int16 = 0
-									var count6 int16 = 0
-									if ipv4Enable {
-										count4 = -1
-									}
-									if ipv6Enable {
-										count6 = -1
-									}
-									if keys[0] == "*" {
-										DefaultConfig = &Config{
-											option, minTTL, maxTTL, syncMSS, ecs,
-											count4, count6, nil, nil}
-									} else {
-										DomainMap[keys[0]] = Config{
-											option, minTTL, maxTTL, syncMSS, ecs,
-											count4, count6, nil, nil}
-									}
-								}
+								cfg.source("domain "+keys[0], l)
+								rules.SetDomain(keys[0], Config{
+									option, minTTL, maxTTL, syncMSS, ecs,
+									count4, count6, nil, nil, upstream})
 							}
 						}
 					}
@@ -628,14 +833,33 @@ func LoadConfig() error {
 		}
 	}
 
-	if TFOEnable {
-		CookiesMap = make(map[string][]byte)
-	}
+	return cfg, nil
+}
 
+// LoadHosts loads the hosts file set by hosts= in the config, or name if
+// there is none.
+func LoadHosts(name string) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	systemHostsFile = name
+	if configHostsFile != "" {
+		name = configHostsFile
+	}
+	err := loadHosts(name, Rules, hostsStatic)
+	if err != nil {
+		return err
+	}
+	hostsFile = name
+	loadedStamp = configStamp()
 	return nil
 }
 
-func LoadHosts(name string) error {
+// loadHosts reads a hosts file: an IP, its names and an optional comment
+// on each line. The IPs of a name with a rule get the method of the rule.
+// If static is set the names are answered with their IPs too, the way a
+// domain=ip line is, unless the config answers them already.
+func loadHosts(name string, rules *RuleStore, static bool) error {
 	hosts, err := os.Open(name)
 	if err != nil {
 		return err
@@ -644,32 +868,83 @@ func LoadHosts(name string) error {
 
 	br := bufio.NewReader(hosts)
 
+	var names []string
+	hostIPs := make(map[string][]string)
 	for {
 		line, _, err := br.ReadLine()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			logPrintln(1, err)
+			return err
 		}
 
-		if len(line) == 0 || line[0] == '#' {
+		keys := strings.Fields(strings.SplitN(string(line), "#", 2)[0])
+		if len(keys) < 2 {
+			continue
+		}
+		ip := net.ParseIP(keys[0])
+		if ip == nil {
 			continue
 		}
+		for _, name := range keys[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			ips, ok := hostIPs[name]
+			if !ok {
+				names = append(names, name)
+			}
+			if !containsString(ips, ip.String()) {
+				hostIPs[name] = append(ips, ip.String())
+			}
+		}
+	}
 
-		keys := strings.Fields(string(line))
-		if len(keys) == 2 {
-			ip := keys[0]
-			config, ok := DomainMap[keys[1]]
-			if ok {
-				IPMap[ip] = IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}
+	for _, name := range names {
+		ips := hostIPs[name]
+		config, _, ok := rules.MatchDomain(name)
+		if ok {
+			for _, ip := range ips {
+				rules.SetIP(ip, IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS})
 			}
 		}
+		if !static || config.ANCount4 > 0 || config.ANCount6 > 0 {
+			continue
+		}
+
+		if !ok {
+			config = Config{0, 0, 0, 0, nil, -1, -1, nil, nil, ""}
+		}
+		count4, answer4 := packAnswers(ips, 1)
+		count6, answer6 := packAnswers(ips, 28)
+		if count4 == 0 {
+			count4 = int(config.ANCount4)
+		}
+		if count6 == 0 {
+			count6 = int(config.ANCount6)
+		}
+		config.ANCount4, config.Answers4 = int16(count4), answer4
+		config.ANCount6, config.Answers6 = int16(count6), answer6
+		rules.SetDomain(name, config)
 	}
 
 	return nil
 }
 
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func Wait() {
 	wg.Wait()
 }
+
+// WaitTasks waits until the goroutines started for the packets received so
+// far are done.
+func WaitTasks() {
+	tasks.Wait()
+}
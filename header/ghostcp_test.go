@@ -0,0 +1,127 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// quicCHLO returns a gQUIC Q046 Initial packet whose CHLO carries sni.
+func quicCHLO(sni string) []byte {
+	b := []byte{0xC3, 'Q', '0', '4', '6', 0x50, 1, 2, 3, 4, 5, 6, 7, 8}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, "CHLO"...)
+	b = append(b, 2, 0, 0, 0)
+	tag := make([]byte, 8)
+	copy(tag, "PAD\x00")
+	binary.LittleEndian.PutUint32(tag[4:], 4)
+	b = append(b, tag...)
+	copy(tag, "SNI\x00")
+	binary.LittleEndian.PutUint32(tag[4:], uint32(4+len(sni)))
+	b = append(b, tag...)
+	b = append(b, "----"...)
+	return append(b, sni...)
+}
+
+func TestGetSNI(t *testing.T) {
+	hello := clientHello("www.example.com")
+	offset, length := getSNI(hello)
+	if string(hello[offset:offset+length]) != "www.example.com" {
+		t.Errorf("got %d %d", offset, length)
+	}
+
+	//a ClientHello cut right before the session ID length
+	if offset, length := getSNI(hello[:11+32]); offset != 0 || length != 0 {
+		t.Errorf("43 bytes: got %d %d", offset, length)
+	}
+	for n := 0; n < len(hello); n++ {
+		offset, length := getSNI(hello[:n])
+		if offset+length > n {
+			t.Errorf("%d bytes: got %d %d", n, offset, length)
+		}
+	}
+
+	if offset, length := getSNI(append([]byte{0x17}, hello[1:]...)); length != 0 {
+		t.Errorf("application data: got %d %d", offset, length)
+	}
+}
+
+func TestGetHost(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n")
+	offset, length := getHost(request)
+	if string(request[offset:offset+length]) != "www.example.com" {
+		t.Errorf("got %d %d", offset, length)
+	}
+	if _, length := getHost([]byte("GET / HTTP/1.1\r\nHost: www.exa")); length != 0 {
+		t.Error("host without line end")
+	}
+}
+
+func TestGetSNIFromQUIC(t *testing.T) {
+	chlo := quicCHLO("www.example.com")
+	if sni := getSNIFromQUIC(chlo); sni != "www.example.com" {
+		t.Errorf("got %q", sni)
+	}
+	if sni := getSNIFromQUIC(chlo[:len(chlo)-1]); sni != "" {
+		t.Errorf("truncated: got %q", sni)
+	}
+	chlo[1] = 'X'
+	if sni := getSNIFromQUIC(chlo); sni != "" {
+		t.Errorf("other version: got %q", sni)
+	}
+}
+
+func FuzzGetSNI(f *testing.F) {
+	hello := clientHello("www.example.com")
+	f.Add(hello)
+	f.Add(hello[:11+32])
+	f.Add(hello[:11+32+1])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		offset, length := getSNI(b)
+		if offset < 0 || length < 0 || offset+length > len(b) {
+			t.Errorf("got %d %d for %d bytes", offset, length, len(b))
+		}
+	})
+}
+
+func FuzzGetHost(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	f.Add([]byte("Host: \r\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		offset, length := getHost(b)
+		if offset < 0 || length < 0 || offset+length > len(b) {
+			t.Errorf("got %d %d for %d bytes", offset, length, len(b))
+		}
+	})
+}
+
+func FuzzGetSNIFromQUIC(f *testing.F) {
+	f.Add(quicCHLO("www.example.com"))
+	f.Add(quicCHLO(""))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		getSNIFromQUIC(b)
+	})
+}
+
+func TestLogPrintln(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, logLevel := os.Stdout, LogLevel
+	os.Stdout, LogLevel = w, 1
+	logPrintln(1, "www.example.com", 443, "ttl")
+	logPrintln(2, "not printed")
+	os.Stdout, LogLevel = stdout, logLevel
+	w.Close()
+
+	//the arguments are printed one by one, not as a slice
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "www.example.com 443 ttl\n" {
+		t.Errorf("got %q", out)
+	}
+}
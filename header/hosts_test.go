@@ -0,0 +1,82 @@
+package ghostcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testHosts = `# comment
+1.2.3.4 multi.example second.example # trailing comment
+1.2.3.5 multi.example
+2001:db8::1 multi.example six.example
+#9.9.9.9 commented.example
+not-an-ip bad.example
+5.6.7.8 Proxied.Example.
+1.2.3.9
+`
+
+func TestLoadHosts(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(name, []byte(testHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		ips4   []string
+		ips6   []string
+	}{
+		{"multi.example", []string{"1.2.3.4", "1.2.3.5"}, []string{"2001:db8::1"}},
+		{"second.example", []string{"1.2.3.4"}, nil},
+		{"six.example", nil, []string{"2001:db8::1"}},
+	}
+	for _, static := range []bool{false, true} {
+		rules := NewRuleStore()
+		rules.SetDomain("+proxied.example", Config{Option: OPT_TTL, TTL: 5, ANCount4: -1, ANCount6: -1})
+		if err := loadHosts(name, rules, static); err != nil {
+			t.Fatal(err)
+		}
+
+		//the IPs of a name with a rule get its method in both modes
+		if config, ok := rules.IP("5.6.7.8"); !ok || config != (IPConfig{OPT_TTL, 5, 0, 0}) {
+			t.Errorf("static=%v: 5.6.7.8 got %+v %v", static, config, ok)
+		}
+		if _, ok := rules.IP("1.2.3.4"); ok {
+			t.Errorf("static=%v: 1.2.3.4 has a rule", static)
+		}
+
+		for _, test := range tests {
+			config, ok := rules.Domain(test.domain)
+			if !static {
+				if ok {
+					t.Errorf("%s: a rule without hosts-static", test.domain)
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("%s: no rule", test.domain)
+				continue
+			}
+			ips4, _ := getAnswers(config.Answers4, int(config.ANCount4))
+			ips6, _ := getAnswers(config.Answers6, int(config.ANCount6))
+			if fmt.Sprint(ips4) != fmt.Sprint(test.ips4) || fmt.Sprint(ips6) != fmt.Sprint(test.ips6) {
+				t.Errorf("%s: got %v %v", test.domain, ips4, ips6)
+			}
+			if config.Option != 0 {
+				t.Errorf("%s: method %d", test.domain, config.Option)
+			}
+		}
+		for _, domain := range []string{"commented.example", "bad.example", "not-an-ip"} {
+			if _, ok := rules.Domain(domain); ok {
+				t.Errorf("static=%v: %s has a rule", static, domain)
+			}
+		}
+	}
+
+	//a read error ends the load
+	if err := loadHosts(t.TempDir(), NewRuleStore(), true); err == nil {
+		t.Error("no error reading a directory")
+	}
+}
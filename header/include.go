@@ -0,0 +1,224 @@
+package ghostcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readConfigFile reads a config file and the files it includes with
+// include=path or include=dir/*.conf, relative to the including file.
+//
+// The lines of an included file come right after its include line, which
+// is repeated for each file a pattern matches, and are closed by a bare
+// "include" line. The loader keeps method=, ttl= and the other positional
+// settings of the including file across the included one.
+//
+// A profile line, [profile name] method=... ttl=..., becomes a "profile"
+// line with the name, one line per setting and a bare "profile" line.
+// Profiles are moved ahead of all other lines, so a rule can use one
+// defined further down or in another file.
+//
+// A list=format:path line is replaced by the domains of the rule list, the
+// way an included file is. A subscribe= line is followed by the domains of
+// the last download of its list.
+//
+// Errors are passed to report, if given, and the line is skipped;
+// otherwise they are returned. files lists what was read, for watching.
+func readConfigFile(name string, report func(ConfigLine, error)) (lines []ConfigLine, files []string, err error) {
+	r := &includeReader{report: report}
+	lines, err = r.read(name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(r.profiles, lines...), r.files, nil
+}
+
+// profileKeys are the settings a profile can have.
+var profileKeys = map[string]bool{
+	"method":  true,
+	"ttl":     true,
+	"max-ttl": true,
+	"mss":     true,
+	"ecs":     true,
+	"ipv6":    true,
+	"ipv4":    true,
+	"dns":     true,
+}
+
+type includeReader struct {
+	report   func(ConfigLine, error)
+	files    []string
+	profiles []ConfigLine
+}
+
+func (r *includeReader) fail(line ConfigLine, err error) error {
+	if r.report == nil {
+		return fmt.Errorf("%s:%d: %v", line.File, line.Num, err)
+	}
+	r.report(line, err)
+	return nil
+}
+
+func (r *includeReader) read(name string, stack []string) ([]ConfigLine, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, open := range stack {
+		if open == abs {
+			return nil, errors.New("include cycle: " + strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
+	var fileLines []ConfigLine
+	if filepath.Ext(name) == ".json" {
+		fileLines, err = readJSONConfigLines(name)
+	} else {
+		var conf *os.File
+		conf, err = os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		fileLines, err = readConfigLines(conf)
+		conf.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.files = append(r.files, name)
+
+	var lines []ConfigLine
+	for _, line := range fileLines {
+		line.File = name
+		keys := line.Keys
+		if strings.HasPrefix(keys[0], "[profile") {
+			profile, err := readProfile(line)
+			if err != nil {
+				err = r.fail(line, err)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			r.profiles = append(r.profiles, profile...)
+			continue
+		}
+		if keys[0] == "profile" {
+			err = r.fail(line, errors.New("a profile is defined with [profile name]"))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if keys[0] == "list" || keys[0] == "subscribe" {
+			var listed []ConfigLine
+			if keys[0] == "list" {
+				listed, err = r.list(line)
+			} else {
+				listed, err = r.subscribe(line)
+			}
+			if err != nil {
+				err = r.fail(line, err)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			lines = append(lines, listed...)
+			continue
+		}
+		if keys[0] != "include" {
+			lines = append(lines, line)
+			continue
+		}
+
+		included, err := r.include(line, stack)
+		if err != nil {
+			err = r.fail(line, err)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		lines = append(lines, included...)
+	}
+
+	return lines, nil
+}
+
+func (r *includeReader) include(line ConfigLine, stack []string) ([]ConfigLine, error) {
+	if len(line.Keys) < 2 || line.Keys[1] == "" {
+		return nil, errors.New("include needs a path")
+	}
+	if line.Profile != "" {
+		return nil, errors.New("an include cannot use a profile")
+	}
+
+	pattern := line.Keys[1]
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(line.File), pattern)
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		//files added to the directory change its time
+		r.files = append(r.files, filepath.Dir(pattern))
+	} else if len(names) == 0 {
+		return nil, errors.New(pattern + " not found")
+	}
+
+	var lines []ConfigLine
+	for _, name := range names {
+		included, err := r.read(name, stack)
+		if err != nil {
+			return nil, err
+		}
+		begin := line
+		begin.Keys = []string{"include", name}
+		end := line
+		end.Keys = []string{"include"}
+
+		lines = append(lines, begin)
+		lines = append(lines, included...)
+		lines = append(lines, end)
+	}
+
+	return lines, nil
+}
+
+// readProfile turns [profile name] key=value ... into the lines the loader
+// reads a profile from.
+func readProfile(line ConfigLine) ([]ConfigLine, error) {
+	text := strings.Join(line.Keys, "=")
+	end := strings.Index(text, "]")
+	if end == -1 {
+		return nil, errors.New("missing ] in profile")
+	}
+	header := strings.Fields(text[1:end])
+	if len(header) != 2 || header[0] != "profile" {
+		return nil, errors.New("a profile is defined with [profile name]")
+	}
+
+	begin := line
+	begin.Keys = []string{"profile", header[1]}
+	lines := []ConfigLine{begin}
+	for _, setting := range strings.Fields(text[end+1:]) {
+		keys := strings.SplitN(setting, "=", 2)
+		if len(keys) < 2 || !profileKeys[keys[0]] {
+			return nil, errors.New(setting + " cannot be set in a profile")
+		}
+		l := line
+		l.Keys = keys
+		lines = append(lines, l)
+	}
+	endLine := line
+	endLine.Keys = []string{"profile"}
+
+	return append(lines, endLine), nil
+}
@@ -0,0 +1,183 @@
+package ghostcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, named relative to dir, creating their
+// directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLines reads the config dir/name and returns its lines as
+// file:num keys, with dir cut from the paths.
+func readLines(dir string, name string) ([]string, []string, error) {
+	lines, files, err := readConfigFile(filepath.Join(dir, name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var got []string
+	for _, line := range lines {
+		text := fmt.Sprintf("%s:%d %s", line.File, line.Num, strings.Join(line.Keys, "="))
+		got = append(got, strings.ReplaceAll(text, dir+string(filepath.Separator), ""))
+	}
+	for i, file := range files {
+		files[i] = strings.TrimPrefix(strings.TrimPrefix(file, dir), string(filepath.Separator))
+	}
+	return got, files, nil
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.conf":         "method=ttl\ninclude=sites/*.conf\nwww.example.com\ninclude=sub/inner.conf\n",
+		"sites/a.conf":      "a.example\n",
+		"sites/b.conf":      "b.example\n",
+		"sites/c.txt":       "c.example\n",
+		"sub/inner.conf":    "include=../shared.conf\n",
+		"shared.conf":       "shared.example\n",
+		"empty.conf":        "include=none/*.conf\n",
+		"cycle/a.conf":      "include=b.conf\n",
+		"cycle/b.conf":      "include=a.conf\n",
+		"missing.conf":      "include=nope.conf\n",
+		"profile.conf":      "include=shared.conf @slow\n",
+		"nopath.conf":       "include=\n",
+		"sub/relative.conf": "include=sub/inner.conf\n",
+	})
+
+	//the matches of a pattern come in order, each between include lines
+	lines, files, err := readLines(dir, "main.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"main.conf:1 method=ttl",
+		"main.conf:2 include=" + filepath.Join(dir, "sites", "a.conf"),
+		"sites/a.conf:1 a.example",
+		"main.conf:2 include",
+		"main.conf:2 include=" + filepath.Join(dir, "sites", "b.conf"),
+		"sites/b.conf:1 b.example",
+		"main.conf:2 include",
+		"main.conf:3 www.example.com",
+		"main.conf:4 include=" + filepath.Join(dir, "sub", "inner.conf"),
+		"sub/inner.conf:1 include=" + filepath.Join(dir, "shared.conf"),
+		"shared.conf:1 shared.example",
+		"sub/inner.conf:1 include",
+		"main.conf:4 include",
+	}
+	for i := range want {
+		want[i] = strings.ReplaceAll(want[i], dir+string(filepath.Separator), "")
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	//the directory of a pattern is watched for new files
+	wantFiles := []string{"main.conf", "sites", "sites/a.conf", "sites/b.conf", "sub/inner.conf", "shared.conf"}
+	for i := range wantFiles {
+		wantFiles[i] = filepath.FromSlash(wantFiles[i])
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("files %v", files)
+	}
+
+	//a pattern may match nothing
+	if lines, _, err := readLines(dir, "empty.conf"); err != nil || len(lines) != 0 {
+		t.Errorf("empty: %v %v", lines, err)
+	}
+
+	failures := map[string]string{
+		"cycle/a.conf": "include cycle: " + strings.Join([]string{
+			filepath.Join(dir, "cycle", "a.conf"),
+			filepath.Join(dir, "cycle", "b.conf"),
+			filepath.Join(dir, "cycle", "a.conf"),
+		}, " -> "),
+		"missing.conf": filepath.Join(dir, "nope.conf") + " not found",
+		"profile.conf": "an include cannot use a profile",
+		"nopath.conf":  "include needs a path",
+		//relative to the including file, not to the first one
+		"sub/relative.conf": filepath.Join(dir, "sub", "sub", "inner.conf") + " not found",
+	}
+	for name, want := range failures {
+		_, _, err := readLines(dir, name)
+		if err == nil || !strings.HasSuffix(err.Error(), ": "+want) {
+			t.Errorf("%s: got %v, want %s", name, err, want)
+		}
+	}
+
+	//with report the line is skipped and the rest is read
+	var reported []string
+	skipped, _, err := readConfigFile(filepath.Join(dir, "missing.conf"), func(line ConfigLine, err error) {
+		reported = append(reported, fmt.Sprintf("%d %v", line.Num, err))
+	})
+	if err != nil || len(skipped) != 0 || len(reported) != 1 {
+		t.Errorf("report: %v %v %v", skipped, reported, err)
+	}
+}
+
+func TestReadProfile(t *testing.T) {
+	lines, err := readProfile(newConfigLine("[profile slow] method=w-md5 ttl=8 dns=1.1.1.1:53", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range lines {
+		got = append(got, fmt.Sprintf("%d %s", line.Num, strings.Join(line.Keys, "=")))
+	}
+	want := []string{"3 profile=slow", "3 method=w-md5", "3 ttl=8", "3 dns=1.1.1.1:53", "3 profile"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+
+	for text, want := range map[string]string{
+		"[profile slow method=ttl":   "missing ] in profile",
+		"[slow] method=ttl":          "a profile is defined with [profile name]",
+		"[profile a b] method=ttl":   "a profile is defined with [profile name]",
+		"[profile slow] server=x":    "server=x cannot be set in a profile",
+		"[profile slow] method":      "method cannot be set in a profile",
+		"[profile slow] subdomain=0": "subdomain=0 cannot be set in a profile",
+	} {
+		if _, err := readProfile(newConfigLine(text, 1)); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", text, err, want)
+		}
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	write := testConfig(t)
+
+	//a profile can be used above its definition, the last definition wins
+	write("method=ttl\nttl=5\nexample.com @slow\nwww.example.org\n[profile slow] method=ttl ttl=3\n[profile slow] method=w-md5 ttl=8\n")
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]IPConfig{
+		"example.com":     {OPT_WMD5, 8, 0, 0},
+		"www.example.org": {OPT_TTL, 5, 0, 0},
+	} {
+		config, _, ok := cfg.rules.MatchDomain(name)
+		if got := (IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}); !ok || got != want {
+			t.Errorf("%s: got %+v %v", name, got, ok)
+		}
+	}
+
+	write("example.com @nope\n")
+	if _, err := loadConfigFile(ConfigFile); err == nil || err.Error() != "unknown profile nope" {
+		t.Errorf("unknown profile: %v", err)
+	}
+}
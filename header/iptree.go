@@ -0,0 +1,136 @@
+package ghostcp
+
+import (
+	"bytes"
+	"net"
+)
+
+// ipTree matches addresses against CIDR rules by longest prefix. It is a
+// path-compressed binary trie (a PATRICIA trie) over 128-bit addresses: a
+// node holds the whole prefix up to its branch, so a lookup visits only the
+// nodes where the rules differ. IPv4 prefixes are kept in their IPv4-mapped
+// IPv6 form, so a /n IPv4 rule is a /96+n prefix.
+type ipTree struct {
+	root ipNode
+}
+
+type ipNode struct {
+	ip     net.IP
+	ones   int
+	child  [2]*ipNode
+	ipnet  *net.IPNet
+	config IPConfig
+	ok     bool
+}
+
+func ipTreeKey(ipnet *net.IPNet) (net.IP, int) {
+	ip := ipnet.IP.To16()
+	ones, bits := ipnet.Mask.Size()
+	if ip == nil || bits == 0 {
+		return nil, 0
+	}
+	if bits == 32 {
+		ones += 96
+	}
+	return ip.Mask(net.CIDRMask(ones, 128)), ones
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i>>3]>>(7-uint(i&7))) & 1
+}
+
+// commonBits returns how many of the first n bits of a and b are equal.
+func commonBits(a, b net.IP, n int) int {
+	i := 0
+	for ; i+8 <= n && a[i>>3] == b[i>>3]; i += 8 {
+	}
+	for ; i < n && ipBit(a, i) == ipBit(b, i); i++ {
+	}
+	return i
+}
+
+// hasPrefix reports whether the first n bits of ip are those of prefix.
+func hasPrefix(ip, prefix net.IP, n int) bool {
+	if !bytes.Equal(ip[:n>>3], prefix[:n>>3]) {
+		return false
+	}
+	if n&7 == 0 {
+		return true
+	}
+	mask := byte(0xFF) << (8 - uint(n&7))
+	return ip[n>>3]&mask == prefix[n>>3]&mask
+}
+
+func (t *ipTree) insert(ipnet *net.IPNet, config IPConfig) {
+	ip, ones := ipTreeKey(ipnet)
+	if ip == nil {
+		return
+	}
+	leaf := &ipNode{ip: ip, ones: ones, ipnet: ipnet, config: config, ok: true}
+
+	node := &t.root
+	for node.ones < ones {
+		bit := ipBit(ip, node.ones)
+		child := node.child[bit]
+		if child == nil {
+			node.child[bit] = leaf
+			return
+		}
+
+		n := child.ones
+		if ones < n {
+			n = ones
+		}
+		common := commonBits(ip, child.ip, n)
+		if common == child.ones {
+			node = child
+			continue
+		}
+
+		//split the path of child where ip leaves it
+		branch := leaf
+		if common < ones {
+			branch = &ipNode{ip: ip.Mask(net.CIDRMask(common, 128)), ones: common}
+			branch.child[ipBit(ip, common)] = leaf
+		}
+		branch.child[ipBit(child.ip, common)] = child
+		node.child[bit] = branch
+		return
+	}
+
+	node.ipnet = ipnet
+	node.config = config
+	node.ok = true
+}
+
+func (t *ipTree) lookup(ip net.IP) (IPConfig, bool) {
+	var config IPConfig
+	node := t.match(ip)
+	if node == nil {
+		return config, false
+	}
+	return node.config, true
+}
+
+// match returns the node of the longest prefix containing ip, or nil.
+func (t *ipTree) match(ip net.IP) *ipNode {
+	var match *ipNode
+
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	node := &t.root
+	for node != nil && hasPrefix(ip, node.ip, node.ones) {
+		if node.ok {
+			match = node
+		}
+		if node.ones == 128 {
+			break
+		}
+		node = node.child[ipBit(ip, node.ones)]
+	}
+
+	return match
+}
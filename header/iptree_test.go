@@ -0,0 +1,146 @@
+package ghostcp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// bruteLookup returns the longest of cidrs containing ip, comparing them as
+// the tree does, IPv4 as IPv4-mapped.
+func bruteLookup(cidrs []*net.IPNet, ip net.IP) *net.IPNet {
+	var match *net.IPNet
+	best := -1
+	for _, ipnet := range cidrs {
+		key, ones := ipTreeKey(ipnet)
+		if bytes.Equal(ip.To16().Mask(net.CIDRMask(ones, 128)), key) && ones > best {
+			match, best = ipnet, ones
+		}
+	}
+	return match
+}
+
+func randomIP(r *rand.Rand, v4 bool) net.IP {
+	if v4 {
+		return net.IPv4(byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+	}
+	ip := make(net.IP, 16)
+	ip[0], ip[1] = 0x20, 0x01
+	for i := 2; i < 16; i++ {
+		ip[i] = byte(r.Intn(4))
+	}
+	return ip
+}
+
+func TestIPTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var tree ipTree
+	var cidrs []*net.IPNet
+	for i := 0; i < 1000; i++ {
+		v4 := i%2 == 0
+		bits := 128
+		if v4 {
+			bits = 32
+		}
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", randomIP(r, v4), r.Intn(bits+1)))
+		tree.insert(ipnet, IPConfig{uint32(i), 0, 0, 0})
+		cidrs = append(cidrs, ipnet)
+	}
+
+	for i := 0; i < 5000; i++ {
+		ip := randomIP(r, i%2 == 0)
+		want := bruteLookup(cidrs, ip)
+		node := tree.match(ip)
+		if want == nil {
+			if node != nil {
+				t.Fatalf("%s: matched %s, want none", ip, node.ipnet)
+			}
+			continue
+		}
+		if node == nil || node.ipnet.String() != want.String() {
+			t.Fatalf("%s: matched %v, want %s", ip, node, want)
+		}
+	}
+
+	for _, test := range []struct {
+		cidrs []string
+		ip    string
+		want  string
+	}{
+		{[]string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"}, "10.1.2.3", "10.1.2.0/24"},
+		{[]string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8"}, "10.1.3.3", "10.1.0.0/16"},
+		{[]string{"10.1.2.0/24", "10.0.0.0/8"}, "10.2.0.1", "10.0.0.0/8"},
+		{[]string{"10.1.2.3/32", "10.1.2.2/32"}, "10.1.2.3", "10.1.2.3/32"},
+		{[]string{"2001:db8::/32", "2001:db8:1::/48"}, "2001:db8:1::1", "2001:db8:1::/48"},
+		{[]string{"2001:db8::/32"}, "10.0.0.1", ""},
+		{[]string{"0.0.0.0/0"}, "10.0.0.1", "0.0.0.0/0"},
+		{[]string{"::/0", "10.0.0.0/8"}, "11.0.0.1", "::/0"},
+	} {
+		var tree ipTree
+		for _, cidr := range test.cidrs {
+			_, ipnet, _ := net.ParseCIDR(cidr)
+			tree.insert(ipnet, IPConfig{})
+		}
+		node := tree.match(net.ParseIP(test.ip))
+		got := ""
+		if node != nil {
+			got = node.ipnet.String()
+		}
+		if got != test.want {
+			t.Errorf("%v %s: got %q, want %q", test.cidrs, test.ip, got, test.want)
+		}
+	}
+}
+
+// sprintfLookup is the CIDR lookup IPBlockLookup did before ipTree: every
+// /n string of the address is formatted and looked up.
+func sprintfLookup(s *RuleStore, addr string) (IPConfig, bool) {
+	ip := net.ParseIP(addr)
+	ip4 := ip.To4()
+	if ip4 != nil {
+		for i := 31; i >= 8; i-- {
+			mask := net.CIDRMask(i, 32)
+			config, ok := s.IP(fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i))
+			if ok {
+				return config, true
+			}
+		}
+	} else {
+		for i := 64; i >= 16; i -= 16 {
+			mask := net.CIDRMask(i, 128)
+			config, ok := s.IP(fmt.Sprintf("%s/%d", ip.Mask(mask).String(), i))
+			if ok {
+				return config, true
+			}
+		}
+	}
+	return s.IP("0.0.0.0/0")
+}
+
+func BenchmarkIPLookup(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	s := NewRuleStore()
+	for i := 0; i < 100000; i++ {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("%d.%d.%d.0/24", 1+r.Intn(200), r.Intn(256), r.Intn(256)))
+		s.SetCIDR(ipnet, IPConfig{OPT_TTL, 0, 0, 0})
+	}
+	addrs := make([]string, 1024)
+	for i := range addrs {
+		addrs[i] = net.IPv4(byte(1+r.Intn(200)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))).String()
+	}
+
+	b.Run("tree", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.CIDR(net.ParseIP(addrs[i%len(addrs)]))
+		}
+	})
+	b.Run("sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sprintfLookup(s, addrs[i%len(addrs)])
+		}
+	})
+}
@@ -0,0 +1,453 @@
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONConfig is a config in JSON. Each rule carries its own settings
+// instead of taking the ones of the lines above it. It is loaded by
+// turning it into the lines of a .conf file, so it gives the same rules.
+type JSONConfig struct {
+	Log         *int                    `json:"log,omitempty"`
+	Subdomain   *int                    `json:"subdomain,omitempty"`
+	IPLimit     *int                    `json:"ip-limit,omitempty"`
+	Hosts       string                  `json:"hosts,omitempty"`
+	HostsStatic bool                    `json:"hosts-static,omitempty"`
+	DNSRace     bool                    `json:"dns-race,omitempty"`
+	Profiles    map[string]JSONSettings `json:"profiles,omitempty"`
+	Rules       []JSONRule              `json:"rules"`
+}
+
+// JSONSettings are the settings of a rule or a profile. Left out, they have
+// their defaults: no method, IPv4 and IPv6 enabled.
+type JSONSettings struct {
+	Method []string `json:"method,omitempty"`
+	TTL    int      `json:"ttl,omitempty"`
+	MaxTTL int      `json:"max-ttl,omitempty"`
+	MSS    int      `json:"mss,omitempty"`
+	ECS    string   `json:"ecs,omitempty"`
+	DNS    string   `json:"dns,omitempty"`
+	IPv4   *bool    `json:"ipv4,omitempty"`
+	IPv6   *bool    `json:"ipv6,omitempty"`
+}
+
+// JSONRule is one line of the config: exactly one of include, list,
+// subscribe, server, domain, ip (an IP or a CIDR), addr (an ip:port), nat64 or
+// forward.
+type JSONRule struct {
+	Include   string   `json:"include,omitempty"`
+	List      string   `json:"list,omitempty"`
+	Subscribe string   `json:"subscribe,omitempty"`
+	Interval  string   `json:"interval,omitempty"`
+	Server    string   `json:"server,omitempty"`
+	Domain    string   `json:"domain,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Alias     string   `json:"alias,omitempty"`
+	DNS64     string   `json:"dns64,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	Addr      string   `json:"addr,omitempty"`
+	NAT64     string   `json:"nat64,omitempty"`
+	Prefix    string   `json:"prefix,omitempty"`
+	Forward   bool     `json:"forward,omitempty"`
+	Profile   string   `json:"profile,omitempty"`
+	JSONSettings
+}
+
+func ReadJSONConfig(name string) (*JSONConfig, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	c := &JSONConfig{}
+	err = dec.Decode(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return c, nil
+}
+
+func readJSONConfigLines(name string) ([]ConfigLine, error) {
+	c, err := ReadJSONConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	text, err := c.Conf()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	lines := make([]ConfigLine, len(text))
+	for i, line := range text {
+		lines[i] = newConfigLine(line, i+1)
+	}
+	return lines, nil
+}
+
+func boolSetting(enable *bool) bool {
+	return enable == nil || *enable
+}
+
+// settingLines returns the lines that change the settings from to to.
+func settingLines(from JSONSettings, to JSONSettings) []string {
+	var lines []string
+	if strings.Join(from.Method, ",") != strings.Join(to.Method, ",") {
+		if len(to.Method) == 0 {
+			lines = append(lines, "method=none")
+		} else {
+			lines = append(lines, "method="+strings.Join(to.Method, ","))
+		}
+	}
+	if from.TTL != to.TTL {
+		lines = append(lines, "ttl="+strconv.Itoa(to.TTL))
+	}
+	if from.MaxTTL != to.MaxTTL {
+		lines = append(lines, "max-ttl="+strconv.Itoa(to.MaxTTL))
+	}
+	if from.MSS != to.MSS {
+		lines = append(lines, "mss="+strconv.Itoa(to.MSS))
+	}
+	if from.ECS != to.ECS {
+		lines = append(lines, "ecs="+to.ECS)
+	}
+	if from.DNS != to.DNS {
+		lines = append(lines, "dns="+to.DNS)
+	}
+	if boolSetting(from.IPv4) != boolSetting(to.IPv4) {
+		lines = append(lines, "ipv4="+strconv.FormatBool(boolSetting(to.IPv4)))
+	}
+	if boolSetting(from.IPv6) != boolSetting(to.IPv6) {
+		lines = append(lines, "ipv6="+strconv.FormatBool(boolSetting(to.IPv6)))
+	}
+	return lines
+}
+
+func (rule *JSONRule) line() (string, error) {
+	var lines []string
+	if rule.Include != "" {
+		lines = append(lines, "include="+rule.Include)
+	}
+	if rule.List != "" {
+		lines = append(lines, "list="+rule.List)
+	}
+	if rule.Subscribe != "" {
+		if rule.Interval != "" {
+			lines = append(lines, "subscribe="+rule.Subscribe+" interval="+rule.Interval)
+		} else {
+			lines = append(lines, "subscribe="+rule.Subscribe)
+		}
+	}
+	if rule.Server != "" {
+		lines = append(lines, "server="+rule.Server)
+	}
+	if rule.Domain != "" {
+		if len(rule.IPs) > 0 {
+			lines = append(lines, rule.Domain+"="+strings.Join(rule.IPs, ","))
+		} else if rule.Alias != "" {
+			lines = append(lines, rule.Domain+"=["+rule.Alias+"]")
+		} else if rule.DNS64 != "" {
+			lines = append(lines, rule.Domain+"="+rule.DNS64)
+		} else {
+			lines = append(lines, rule.Domain)
+		}
+	}
+	if rule.IP != "" {
+		lines = append(lines, rule.IP)
+	}
+	if rule.Addr != "" {
+		lines = append(lines, rule.Addr)
+	}
+	if rule.NAT64 != "" {
+		lines = append(lines, rule.NAT64+"="+rule.Prefix)
+	}
+	if rule.Forward {
+		lines = append(lines, "forward")
+	}
+
+	if len(lines) != 1 {
+		return "", errors.New("a rule needs one of include, list, subscribe, server, domain, ip, addr, nat64 or forward")
+	}
+	return lines[0], nil
+}
+
+// Conf returns the config as the lines of a .conf file.
+func (c *JSONConfig) Conf() ([]string, error) {
+	var lines []string
+	if c.Log != nil {
+		lines = append(lines, "log="+strconv.Itoa(*c.Log))
+	}
+	if c.Subdomain != nil {
+		lines = append(lines, "subdomain="+strconv.Itoa(*c.Subdomain))
+	}
+	if c.IPLimit != nil {
+		lines = append(lines, "ip-limit="+strconv.Itoa(*c.IPLimit))
+	}
+	if c.Hosts != "" {
+		lines = append(lines, "hosts="+c.Hosts)
+	}
+	if c.HostsStatic {
+		lines = append(lines, "hosts-static=true")
+	}
+	if c.DNSRace {
+		lines = append(lines, "dns-race=true")
+	}
+
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := "[profile " + name + "]"
+		for _, setting := range settingLines(JSONSettings{}, c.Profiles[name]) {
+			profile += " " + setting
+		}
+		lines = append(lines, profile)
+	}
+
+	var settings JSONSettings
+	for i, rule := range c.Rules {
+		line, err := rule.line()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if rule.Profile != "" {
+			lines = append(lines, line+" @"+rule.Profile)
+			continue
+		}
+		//forward has no settings
+		if rule.Forward {
+			lines = append(lines, line)
+			continue
+		}
+		lines = append(lines, settingLines(settings, rule.JSONSettings)...)
+		lines = append(lines, line)
+		settings = rule.JSONSettings
+	}
+
+	return lines, nil
+}
+
+// set changes the settings the way a key=value line of a .conf file does.
+func (s *JSONSettings) set(keys []string) error {
+	value := "true"
+	if len(keys) > 1 {
+		value = keys[1]
+	}
+
+	switch keys[0] {
+	case "method":
+		s.Method = nil
+		for _, m := range strings.Split(value, ",") {
+			if m != "" && m != "none" {
+				s.Method = append(s.Method, m)
+			}
+		}
+	case "ttl", "max-ttl", "mss":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		switch keys[0] {
+		case "ttl":
+			s.TTL = n
+		case "max-ttl":
+			s.MaxTTL = n
+		default:
+			s.MSS = n
+		}
+	case "ecs":
+		s.ECS = ""
+		if net.ParseIP(value) != nil {
+			s.ECS = value
+		}
+	case "dns":
+		s.DNS = value
+	case "ipv4", "ipv6":
+		var enable *bool
+		if value != "true" {
+			enable = new(bool)
+		}
+		if keys[0] == "ipv4" {
+			s.IPv4 = enable
+		} else {
+			s.IPv6 = enable
+		}
+	}
+	return nil
+}
+
+// ReadConfAsJSON reads a .conf file into a JSONConfig. Included files are
+// kept as include rules.
+func ReadConfAsJSON(name string) (*JSONConfig, error) {
+	conf, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := readConfigLines(conf)
+	conf.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &JSONConfig{Rules: []JSONRule{}}
+	var settings JSONSettings
+	for _, l := range lines {
+		err = c.addLine(l, &settings)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, l.Num, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *JSONConfig) addLine(l ConfigLine, settings *JSONSettings) error {
+	keys := l.Keys
+	if strings.HasPrefix(keys[0], "[profile") {
+		profile, err := readProfile(l)
+		if err != nil {
+			return err
+		}
+		var s JSONSettings
+		for _, line := range profile[1 : len(profile)-1] {
+			err = s.set(line.Keys)
+			if err != nil {
+				return err
+			}
+		}
+		if c.Profiles == nil {
+			c.Profiles = make(map[string]JSONSettings)
+		}
+		c.Profiles[profile[0].Keys[1]] = s
+		return nil
+	}
+
+	rule := JSONRule{Profile: l.Profile}
+	if l.Profile == "" {
+		rule.JSONSettings = *settings
+	}
+
+	if len(keys) > 1 {
+		switch keys[0] {
+		case "method", "ttl", "max-ttl", "mss", "ecs", "dns", "ipv4", "ipv6":
+			//a profile on a setting line has no effect
+			if l.Profile == "" {
+				return settings.set(keys)
+			}
+			return nil
+		case "log", "subdomain", "ip-limit":
+			n, err := strconv.Atoi(keys[1])
+			if err != nil {
+				return err
+			}
+			switch keys[0] {
+			case "log":
+				c.Log = &n
+			case "subdomain":
+				c.Subdomain = &n
+			default:
+				c.IPLimit = &n
+			}
+			return nil
+		case "hosts":
+			c.Hosts = keys[1]
+			return nil
+		case "hosts-static":
+			c.HostsStatic = keys[1] == "true"
+			return nil
+		case "dns-race":
+			c.DNSRace = keys[1] == "true"
+			return nil
+		case "profile":
+			return errors.New("a profile is defined with [profile name]")
+		case "include":
+			rule.Include = keys[1]
+		case "list":
+			rule.List = keys[1]
+		case "subscribe":
+			fields := strings.Fields(keys[1])
+			if len(fields) > 0 {
+				rule.Subscribe = fields[0]
+			}
+			for _, option := range fields[1:] {
+				rule.Interval = strings.TrimPrefix(option, "interval=")
+			}
+		case "server":
+			rule.Server = keys[1]
+		default:
+			if net.ParseIP(keys[0]) != nil {
+				rule.NAT64 = keys[0]
+				rule.Prefix = keys[1]
+			} else {
+				rule.Domain = keys[0]
+				if strings.HasSuffix(keys[1], ":") {
+					rule.DNS64 = keys[1]
+				} else if strings.HasPrefix(keys[1], "[") {
+					rule.Alias = strings.TrimSuffix(keys[1][1:], "]")
+				} else {
+					rule.IPs = strings.Split(keys[1], ",")
+				}
+			}
+		}
+	} else {
+		key := keys[0]
+		switch key {
+		case "ipv4", "ipv6":
+			if l.Profile == "" {
+				return settings.set(keys)
+			}
+			return nil
+		case "forward":
+			rule = JSONRule{Forward: true}
+		default:
+			_, _, err := net.SplitHostPort(key)
+			if err == nil {
+				rule.Addr = key
+			} else if strings.Index(key, "/") > 0 || net.ParseIP(key) != nil {
+				rule.IP = key
+			} else {
+				rule.Domain = key
+			}
+		}
+	}
+
+	c.Rules = append(c.Rules, rule)
+	return nil
+}
+
+// ConvertConfig converts a .json config to the .conf format, and any other
+// config to JSON.
+func ConvertConfig(name string) ([]byte, error) {
+	if filepath.Ext(name) == ".json" {
+		c, err := ReadJSONConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		lines, err := c.Conf()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return []byte(strings.Join(lines, "\n") + "\n"), nil
+	}
+
+	c, err := ReadConfAsJSON(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,65 @@
+package ghostcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestConvertConfig converts release/default.conf to JSON and back twice:
+// the second round gives the same files, and all of them load the same
+// rules and settings.
+func TestConvertConfig(t *testing.T) {
+	dir := t.TempDir()
+	convert := func(from string, to string) []byte {
+		data, err := ConvertConfig(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, to)
+		if err := ioutil.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	original := filepath.Join("..", "release", "default.conf")
+	json1 := convert(original, "1.json")
+	conf1 := convert(filepath.Join(dir, "1.json"), "1.conf")
+	json2 := convert(filepath.Join(dir, "1.conf"), "2.json")
+	conf2 := convert(filepath.Join(dir, "2.json"), "2.conf")
+	if !bytes.Equal(json1, json2) {
+		t.Errorf("JSON differs after a round trip:\n%s\n%s", json1, json2)
+	}
+	if !bytes.Equal(conf1, conf2) {
+		t.Errorf(".conf differs after a round trip:\n%s\n%s", conf1, conf2)
+	}
+
+	want, err := loadConfigFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.rules.domains) == 0 || len(want.rules.ips) == 0 {
+		t.Fatal("no rules in", original)
+	}
+	for _, name := range []string{"1.json", "1.conf", "2.json"} {
+		cfg, err := loadConfigFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if diffs := diffRules(want.rules, cfg.rules); len(diffs) > 0 {
+			t.Errorf("%s: %v", name, diffs)
+		}
+		if !reflect.DeepEqual(cfg.rules.settings, want.rules.settings) {
+			t.Errorf("%s: settings %+v, want %+v", name, cfg.rules.settings, want.rules.settings)
+		}
+		if cfg.dns != want.dns || !reflect.DeepEqual(cfg.dnsAddrs, want.dnsAddrs) || cfg.dnsOption != want.dnsOption {
+			t.Errorf("%s: server %s %v %d, want %s %v %d", name, cfg.dns, cfg.dnsAddrs, cfg.dnsOption, want.dns, want.dnsAddrs, want.dnsOption)
+		}
+		if !reflect.DeepEqual(cfg.daemons, want.daemons) {
+			t.Errorf("%s: daemons %v, want %v", name, cfg.daemons, want.daemons)
+		}
+	}
+}
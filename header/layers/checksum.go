@@ -0,0 +1,75 @@
+package layers
+
+import (
+	"encoding/binary"
+)
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// CalcChecksums recomputes the IPv4, TCP and UDP checksums of a raw packet
+// the way WinDivertHelperCalcChecksums does. Truncated packets are left as
+// they are.
+func CalcChecksums(raw []byte) {
+	if len(raw) < 20 {
+		return
+	}
+
+	var ipheadlen int
+	var proto byte
+	var sum uint32
+	if raw[0]>>4 == 6 {
+		if len(raw) < 40 {
+			return
+		}
+		ipheadlen = 40
+		proto = raw[6]
+		sum = checksumAdd(0, raw[8:40])
+	} else {
+		ipheadlen = int(raw[0]&0xF) * 4
+		if ipheadlen < 20 || ipheadlen > len(raw) {
+			return
+		}
+		proto = raw[9]
+		binary.BigEndian.PutUint16(raw[10:], 0)
+		binary.BigEndian.PutUint16(raw[10:], checksumFold(checksumAdd(0, raw[:ipheadlen])))
+		sum = checksumAdd(0, raw[12:20])
+	}
+
+	segment := raw[ipheadlen:]
+	sum += uint32(proto) + uint32(len(segment))
+
+	switch proto {
+	case 6:
+		if len(segment) < 20 {
+			return
+		}
+		binary.BigEndian.PutUint16(segment[16:], 0)
+		binary.BigEndian.PutUint16(segment[16:], checksumFold(checksumAdd(sum, segment)))
+	case 17:
+		if len(segment) < 8 {
+			return
+		}
+		binary.BigEndian.PutUint16(segment[6:], 0)
+		csum := checksumFold(checksumAdd(sum, segment))
+		if csum == 0 {
+			csum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(segment[6:], csum)
+	}
+}
@@ -0,0 +1,510 @@
+// Package layers parses and builds the IPv4, IPv6, TCP and UDP headers the
+// packet engine forges, so that no caller has to know header offsets.
+//
+// Parse aliases the buffer it is given: addresses, options and payload all
+// point into it. Serialize must therefore write to a different buffer than
+// the one the packet was parsed from.
+package layers
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+
+	IPv4HeaderLen = 20
+	IPv6HeaderLen = 40
+	TCPHeaderLen  = 20
+	UDPHeaderLen  = 8
+)
+
+const (
+	IPv4DontFragment  = 0x2
+	IPv4MoreFragments = 0x1
+)
+
+const (
+	TCPOptionEnd       = 0
+	TCPOptionNop       = 1
+	TCPOptionMSS       = 2
+	TCPOptionWScale    = 3
+	TCPOptionSACKOK    = 4
+	TCPOptionTimestamp = 8
+	TCPOptionMD5       = 19
+	TCPOptionFastOpen  = 34
+)
+
+var (
+	ErrTruncated = errors.New("packet truncated")
+	ErrVersion   = errors.New("unknown IP version")
+	ErrHeaderLen = errors.New("bad header length")
+)
+
+type IPv4 struct {
+	TOS        uint8
+	ID         uint16
+	Flags      uint8
+	FragOffset uint16
+	TTL        uint8
+	Protocol   uint8
+	Checksum   uint16
+	Src        net.IP
+	Dst        net.IP
+	Options    []byte
+}
+
+type IPv6 struct {
+	TrafficClass uint8
+	FlowLabel    uint32
+	NextHeader   uint8
+	HopLimit     uint8
+	Src          net.IP
+	Dst          net.IP
+}
+
+type TCP struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Seq      uint32
+	Ack      uint32
+	Flags    uint8
+	Window   uint16
+	Checksum uint16
+	Urgent   uint16
+	Options  []byte
+	// DataOffset overrides the data offset field written by Serialize, in
+	// 32-bit words, without changing the layout. Zero means it is derived
+	// from the options.
+	DataOffset uint8
+}
+
+type UDP struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Checksum uint16
+	Length   uint16
+	// FixedLength makes Serialize write Length as it is instead of the
+	// real length of the datagram.
+	FixedLength bool
+}
+
+// Packet is an IP packet with at most one transport header.
+type Packet struct {
+	IPv4    *IPv4
+	IPv6    *IPv6
+	TCP     *TCP
+	UDP     *UDP
+	Payload []byte
+}
+
+func padLen(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (h *IPv4) HeaderLen() int {
+	return IPv4HeaderLen + padLen(len(h.Options))
+}
+
+func (h *TCP) HeaderLen() int {
+	return TCPHeaderLen + padLen(len(h.Options))
+}
+
+func ParseIPv4(b []byte) (*IPv4, int, error) {
+	if len(b) < IPv4HeaderLen {
+		return nil, 0, ErrTruncated
+	}
+	if b[0]>>4 != 4 {
+		return nil, 0, ErrVersion
+	}
+	headLen := int(b[0]&0xF) * 4
+	if headLen < IPv4HeaderLen {
+		return nil, 0, ErrHeaderLen
+	}
+	if headLen > len(b) {
+		return nil, 0, ErrTruncated
+	}
+
+	h := &IPv4{
+		TOS:        b[1],
+		ID:         binary.BigEndian.Uint16(b[4:]),
+		Flags:      b[6] >> 5,
+		FragOffset: binary.BigEndian.Uint16(b[6:]) & 0x1FFF,
+		TTL:        b[8],
+		Protocol:   b[9],
+		Checksum:   binary.BigEndian.Uint16(b[10:]),
+		Src:        net.IP(b[12:16]),
+		Dst:        net.IP(b[16:20]),
+	}
+	if headLen > IPv4HeaderLen {
+		h.Options = b[IPv4HeaderLen:headLen]
+	}
+
+	return h, headLen, nil
+}
+
+func ParseIPv6(b []byte) (*IPv6, int, error) {
+	if len(b) < IPv6HeaderLen {
+		return nil, 0, ErrTruncated
+	}
+	if b[0]>>4 != 6 {
+		return nil, 0, ErrVersion
+	}
+
+	h := &IPv6{
+		TrafficClass: b[0]<<4 | b[1]>>4,
+		FlowLabel:    binary.BigEndian.Uint32(b[0:]) & 0xFFFFF,
+		NextHeader:   b[6],
+		HopLimit:     b[7],
+		Src:          net.IP(b[8:24]),
+		Dst:          net.IP(b[24:40]),
+	}
+
+	return h, IPv6HeaderLen, nil
+}
+
+func ParseTCP(b []byte) (*TCP, int, error) {
+	if len(b) < TCPHeaderLen {
+		return nil, 0, ErrTruncated
+	}
+	headLen := int(b[12]>>4) * 4
+	if headLen < TCPHeaderLen {
+		return nil, 0, ErrHeaderLen
+	}
+	if headLen > len(b) {
+		return nil, 0, ErrTruncated
+	}
+
+	h := &TCP{
+		SrcPort:  binary.BigEndian.Uint16(b[0:]),
+		DstPort:  binary.BigEndian.Uint16(b[2:]),
+		Seq:      binary.BigEndian.Uint32(b[4:]),
+		Ack:      binary.BigEndian.Uint32(b[8:]),
+		Flags:    b[13],
+		Window:   binary.BigEndian.Uint16(b[14:]),
+		Checksum: binary.BigEndian.Uint16(b[16:]),
+		Urgent:   binary.BigEndian.Uint16(b[18:]),
+	}
+	if headLen > TCPHeaderLen {
+		h.Options = b[TCPHeaderLen:headLen]
+	}
+
+	return h, headLen, nil
+}
+
+func ParseUDP(b []byte) (*UDP, int, error) {
+	if len(b) < UDPHeaderLen {
+		return nil, 0, ErrTruncated
+	}
+
+	h := &UDP{
+		SrcPort:  binary.BigEndian.Uint16(b[0:]),
+		DstPort:  binary.BigEndian.Uint16(b[2:]),
+		Length:   binary.BigEndian.Uint16(b[4:]),
+		Checksum: binary.BigEndian.Uint16(b[6:]),
+	}
+
+	return h, UDPHeaderLen, nil
+}
+
+// Parse decodes an IP packet and its TCP or UDP header. The payload is
+// bounded by the IP length fields, not by len(b). Other protocols are
+// returned with the transport header left in Payload.
+func Parse(b []byte) (*Packet, error) {
+	if len(b) == 0 {
+		return nil, ErrTruncated
+	}
+
+	p := &Packet{}
+	var offset, end int
+	var proto uint8
+	var err error
+	switch b[0] >> 4 {
+	case 4:
+		p.IPv4, offset, err = ParseIPv4(b)
+		if err != nil {
+			return nil, err
+		}
+		proto = p.IPv4.Protocol
+		end = int(binary.BigEndian.Uint16(b[2:]))
+		if end < offset {
+			return nil, ErrHeaderLen
+		}
+	case 6:
+		p.IPv6, offset, err = ParseIPv6(b)
+		if err != nil {
+			return nil, err
+		}
+		proto = p.IPv6.NextHeader
+		end = offset + int(binary.BigEndian.Uint16(b[4:]))
+	default:
+		return nil, ErrVersion
+	}
+	if end > len(b) {
+		return nil, ErrTruncated
+	}
+	b = b[:end]
+
+	var headLen int
+	switch proto {
+	case ProtocolTCP:
+		p.TCP, headLen, err = ParseTCP(b[offset:])
+	case ProtocolUDP:
+		p.UDP, headLen, err = ParseUDP(b[offset:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Payload = b[offset+headLen:]
+
+	return p, nil
+}
+
+// Clone returns a deep copy that no longer aliases the parsed buffer.
+func (p *Packet) Clone() *Packet {
+	c := &Packet{}
+	if p.IPv4 != nil {
+		h := *p.IPv4
+		h.Src = append(net.IP(nil), h.Src...)
+		h.Dst = append(net.IP(nil), h.Dst...)
+		h.Options = append([]byte(nil), h.Options...)
+		c.IPv4 = &h
+	}
+	if p.IPv6 != nil {
+		h := *p.IPv6
+		h.Src = append(net.IP(nil), h.Src...)
+		h.Dst = append(net.IP(nil), h.Dst...)
+		c.IPv6 = &h
+	}
+	if p.TCP != nil {
+		h := *p.TCP
+		h.Options = append([]byte(nil), h.Options...)
+		c.TCP = &h
+	}
+	if p.UDP != nil {
+		h := *p.UDP
+		c.UDP = &h
+	}
+	c.Payload = append([]byte(nil), p.Payload...)
+	return c
+}
+
+func (p *Packet) IsIPv6() bool {
+	return p.IPv6 != nil
+}
+
+func (p *Packet) IPHeaderLen() int {
+	if p.IPv6 != nil {
+		return IPv6HeaderLen
+	}
+	return p.IPv4.HeaderLen()
+}
+
+func (p *Packet) TransportHeaderLen() int {
+	if p.TCP != nil {
+		return p.TCP.HeaderLen()
+	}
+	if p.UDP != nil {
+		return UDPHeaderLen
+	}
+	return 0
+}
+
+// Len is the size of the serialized packet.
+func (p *Packet) Len() int {
+	return p.IPHeaderLen() + p.TransportHeaderLen() + len(p.Payload)
+}
+
+func (p *Packet) Src() net.IP {
+	if p.IPv6 != nil {
+		return p.IPv6.Src
+	}
+	return p.IPv4.Src
+}
+
+func (p *Packet) Dst() net.IP {
+	if p.IPv6 != nil {
+		return p.IPv6.Dst
+	}
+	return p.IPv4.Dst
+}
+
+func (p *Packet) SetSrc(ip net.IP) {
+	if p.IPv6 != nil {
+		p.IPv6.Src = ip.To16()
+	} else {
+		p.IPv4.Src = ip.To4()
+	}
+}
+
+func (p *Packet) SetDst(ip net.IP) {
+	if p.IPv6 != nil {
+		p.IPv6.Dst = ip.To16()
+	} else {
+		p.IPv4.Dst = ip.To4()
+	}
+}
+
+// TTL is the IPv4 TTL or the IPv6 hop limit.
+func (p *Packet) TTL() uint8 {
+	if p.IPv6 != nil {
+		return p.IPv6.HopLimit
+	}
+	return p.IPv4.TTL
+}
+
+func (p *Packet) SetTTL(ttl uint8) {
+	if p.IPv6 != nil {
+		p.IPv6.HopLimit = ttl
+	} else {
+		p.IPv4.TTL = ttl
+	}
+}
+
+// Reverse swaps the addresses and ports, turning a packet into the header of
+// its reply.
+func (p *Packet) Reverse() {
+	if p.IPv6 != nil {
+		p.IPv6.Src, p.IPv6.Dst = p.IPv6.Dst, p.IPv6.Src
+	} else {
+		p.IPv4.Src, p.IPv4.Dst = p.IPv4.Dst, p.IPv4.Src
+	}
+	if p.TCP != nil {
+		p.TCP.SrcPort, p.TCP.DstPort = p.TCP.DstPort, p.TCP.SrcPort
+	}
+	if p.UDP != nil {
+		p.UDP.SrcPort, p.UDP.DstPort = p.UDP.DstPort, p.UDP.SrcPort
+	}
+}
+
+func (p *Packet) protocol() uint8 {
+	if p.TCP != nil {
+		return ProtocolTCP
+	}
+	if p.UDP != nil {
+		return ProtocolUDP
+	}
+	if p.IPv6 != nil {
+		return p.IPv6.NextHeader
+	}
+	return p.IPv4.Protocol
+}
+
+// Serialize writes the packet to buf, which must not be the buffer it was
+// parsed from, and returns the written slice. Length fields are always
+// computed. With checksum set the IPv4, TCP and UDP checksums are computed
+// too, otherwise the Checksum fields are written as they are.
+func (p *Packet) Serialize(buf []byte, checksum bool) []byte {
+	size := p.Len()
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	b := buf[:size]
+
+	proto := p.protocol()
+	ipheadlen := p.IPHeaderLen()
+	if p.IPv6 != nil {
+		h := p.IPv6
+		binary.BigEndian.PutUint32(b[0:], 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xFFFFF)
+		binary.BigEndian.PutUint16(b[4:], uint16(size-ipheadlen))
+		b[6] = proto
+		b[7] = h.HopLimit
+		copy(b[8:24], h.Src.To16())
+		copy(b[24:40], h.Dst.To16())
+	} else {
+		h := p.IPv4
+		b[0] = 4<<4 | byte(ipheadlen/4)
+		b[1] = h.TOS
+		binary.BigEndian.PutUint16(b[2:], uint16(size))
+		binary.BigEndian.PutUint16(b[4:], h.ID)
+		binary.BigEndian.PutUint16(b[6:], uint16(h.Flags)<<13|h.FragOffset&0x1FFF)
+		b[8] = h.TTL
+		b[9] = proto
+		binary.BigEndian.PutUint16(b[10:], h.Checksum)
+		copy(b[12:16], h.Src.To4())
+		copy(b[16:20], h.Dst.To4())
+		n := copy(b[IPv4HeaderLen:ipheadlen], h.Options)
+		for i := IPv4HeaderLen + n; i < ipheadlen; i++ {
+			b[i] = 0
+		}
+	}
+
+	l4 := b[ipheadlen:]
+	translen := p.TransportHeaderLen()
+	if p.TCP != nil {
+		h := p.TCP
+		binary.BigEndian.PutUint16(l4[0:], h.SrcPort)
+		binary.BigEndian.PutUint16(l4[2:], h.DstPort)
+		binary.BigEndian.PutUint32(l4[4:], h.Seq)
+		binary.BigEndian.PutUint32(l4[8:], h.Ack)
+		if h.DataOffset != 0 {
+			l4[12] = h.DataOffset << 4
+		} else {
+			l4[12] = byte(h.HeaderLen()/4) << 4
+		}
+		l4[13] = h.Flags
+		binary.BigEndian.PutUint16(l4[14:], h.Window)
+		binary.BigEndian.PutUint16(l4[16:], h.Checksum)
+		binary.BigEndian.PutUint16(l4[18:], h.Urgent)
+		n := copy(l4[TCPHeaderLen:translen], h.Options)
+		for i := TCPHeaderLen + n; i < translen; i++ {
+			l4[i] = 0
+		}
+	} else if p.UDP != nil {
+		h := p.UDP
+		binary.BigEndian.PutUint16(l4[0:], h.SrcPort)
+		binary.BigEndian.PutUint16(l4[2:], h.DstPort)
+		if h.FixedLength {
+			binary.BigEndian.PutUint16(l4[4:], h.Length)
+		} else {
+			binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+		}
+		binary.BigEndian.PutUint16(l4[6:], h.Checksum)
+	}
+	copy(l4[translen:], p.Payload)
+
+	if checksum {
+		CalcChecksums(b)
+	}
+
+	return b
+}
+
+// Option returns the data of the first TCP option of the given kind, or nil.
+// The returned slice aliases Options.
+func (h *TCP) Option(kind uint8) []byte {
+	options := h.Options
+	for len(options) > 0 {
+		switch options[0] {
+		case TCPOptionEnd:
+			return nil
+		case TCPOptionNop:
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 {
+			return nil
+		}
+		length := int(options[1])
+		if length < 2 || length > len(options) {
+			return nil
+		}
+		if options[0] == kind {
+			return options[2:length]
+		}
+		options = options[length:]
+	}
+	return nil
+}
+
+// AddOption appends an option after the existing ones. The header is
+// padded with zeros when it is serialized.
+func (h *TCP) AddOption(kind uint8, data []byte) {
+	options := make([]byte, len(h.Options), len(h.Options)+2+len(data))
+	copy(options, h.Options)
+	options = append(options, kind, byte(2+len(data)))
+	h.Options = append(options, data...)
+}
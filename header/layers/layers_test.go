@@ -0,0 +1,214 @@
+package layers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captures returns the packets of testdata/captures.txt by name.
+func captures(t *testing.T) map[string][]byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "captures.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(map[string][]byte)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil {
+			t.Fatal(fields[0], err)
+		}
+		packets[fields[0]] = raw
+	}
+	return packets
+}
+
+func TestParseSerialize(t *testing.T) {
+	packets := captures(t)
+	tests := []struct {
+		name    string
+		check   func(p *Packet) bool
+		payload string
+	}{
+		{"tcp4_syn", func(p *Packet) bool {
+			return p.IPv4 != nil && p.TCP != nil && p.TCP.DstPort == 443 && p.TCP.Flags == 0x02 &&
+				len(p.TCP.Options) == 20 && len(p.TCP.Option(TCPOptionMSS)) == 2 &&
+				p.IPv4.Flags == IPv4DontFragment && p.Dst().Equal(net.ParseIP("10.99.0.2"))
+		}, ""},
+		{"udp4", func(p *Packet) bool {
+			return p.IPv4 != nil && p.UDP != nil && p.UDP.DstPort == 53 && p.UDP.Length == 25
+		}, "hello ghostcp udp"},
+		{"udp4_ipopt", func(p *Packet) bool {
+			return p.IPv4 != nil && p.UDP != nil && len(p.IPv4.Options) == 12 && p.IPv4.Options[0] == 7 &&
+				p.IPHeaderLen() == 32
+		}, "options"},
+		{"tcp6_syn", func(p *Packet) bool {
+			return p.IPv6 != nil && p.TCP != nil && p.IPv6.FlowLabel == 0x40f62 && p.IPv6.HopLimit == 64 &&
+				p.Src().Equal(net.ParseIP("fd00:99::1")) && len(p.TCP.Options) == 20
+		}, ""},
+		{"udp6", func(p *Packet) bool {
+			return p.IPv6 != nil && p.UDP != nil && p.UDP.Length == 16
+		}, "hello v6"},
+	}
+
+	for _, test := range tests {
+		raw := packets[test.name]
+		p, err := Parse(raw)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.check(p) || string(p.Payload) != test.payload {
+			t.Errorf("%s: parsed %+v %+v %+v %q", test.name, p.IPv4, p.TCP, p.UDP, p.Payload)
+		}
+		if p.Len() != len(raw) {
+			t.Errorf("%s: length %d, want %d", test.name, p.Len(), len(raw))
+		}
+		//as parsed, and with the checksums computed again
+		for _, checksum := range []bool{false, true} {
+			if b := p.Serialize(nil, checksum); !bytes.Equal(b, raw) {
+				t.Errorf("%s checksum=%v:\n%x\nwant\n%x", test.name, checksum, b, raw)
+			}
+		}
+		if b := p.Clone().Serialize(nil, true); !bytes.Equal(b, raw) {
+			t.Errorf("%s: the clone serialized to %x", test.name, b)
+		}
+	}
+}
+
+func TestCalcChecksums(t *testing.T) {
+	packets := captures(t)
+	//the example header of RFC 791 checksums, as in the Wikipedia article
+	header, _ := hex.DecodeString("45000073000040004011b861c0a80001c0a800c7")
+	packets["rfc791"] = header
+
+	for name, raw := range packets {
+		b := append([]byte{}, raw...)
+		ipheadlen := int(b[0]&0xF) * 4
+		if b[0]>>4 == 4 {
+			b[10], b[11] = 0, 0
+		} else {
+			ipheadlen = IPv6HeaderLen
+		}
+		switch {
+		case name == "rfc791":
+		case strings.HasPrefix(name, "tcp"):
+			b[ipheadlen+16], b[ipheadlen+17] = 0, 0
+		default:
+			b[ipheadlen+6], b[ipheadlen+7] = 0, 0
+		}
+		CalcChecksums(b)
+		if !bytes.Equal(b, raw) {
+			t.Errorf("%s:\n%x\nwant\n%x", name, b, raw)
+		}
+	}
+
+	//truncated packets are left as they are
+	for _, raw := range [][]byte{packets["tcp4_syn"][:30], packets["tcp6_syn"][:39], {0x4F, 0}} {
+		b := append([]byte{}, raw...)
+		CalcChecksums(b)
+		if !bytes.Equal(b, raw) {
+			t.Errorf("changed a truncated packet: %x", b)
+		}
+	}
+}
+
+func TestDataOffset(t *testing.T) {
+	p, err := Parse(captures(t)["tcp4_syn"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = p.Clone()
+	p.Payload = []byte("data")
+
+	//the field lies, the options and payload stay where they are
+	p.TCP.DataOffset = 15
+	b := p.Serialize(nil, true)
+	tcp := b[p.IPHeaderLen():]
+	if tcp[12]>>4 != 15 || len(b) != p.Len() || string(tcp[40:]) != "data" {
+		t.Errorf("got %x", b)
+	}
+	if _, err := Parse(b); err != ErrTruncated {
+		t.Errorf("parsed a data offset past the end: %v", err)
+	}
+
+	//a short one moves the options into the parsed payload
+	p.TCP.DataOffset = 5
+	b = p.Serialize(nil, true)
+	q, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.TCP.Options != nil || !bytes.Equal(q.Payload[:20], p.TCP.Options) || string(q.Payload[20:]) != "data" {
+		t.Errorf("parsed %+v %x", q.TCP, q.Payload)
+	}
+	q.TCP.DataOffset = 5
+	if !bytes.Equal(q.Serialize(nil, false)[:p.IPHeaderLen()+20], b[:p.IPHeaderLen()+20]) {
+		t.Error("the headers differ after a round trip")
+	}
+}
+
+func TestUDPFixedLength(t *testing.T) {
+	p, err := Parse(captures(t)["udp4"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = p.Clone()
+	p.UDP.Length = 1000
+	p.UDP.FixedLength = true
+	b := p.Serialize(nil, true)
+	q, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.UDP.Length != 1000 || string(q.Payload) != "hello ghostcp udp" || len(b) != 45 {
+		t.Errorf("parsed %+v %q from %d bytes", q.UDP, q.Payload, len(b))
+	}
+
+	p.UDP.FixedLength = false
+	if q, _ := Parse(p.Serialize(nil, true)); q.UDP.Length != 25 {
+		t.Errorf("length %d", q.UDP.Length)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	packets := captures(t)
+	syn := packets["tcp4_syn"]
+	badIHL := append([]byte{}, syn...)
+	badIHL[0] = 0x44
+	badDoff := append([]byte{}, syn...)
+	badDoff[20+12] = 0x40
+	long := append([]byte{}, syn...)
+	long[3]++
+	short := append([]byte{}, syn[:30]...)
+	short[2], short[3] = 0, 30
+
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"version", []byte{0x50, 0, 0, 0}, ErrVersion},
+		{"short IPv4", syn[:19], ErrTruncated},
+		{"short IPv6", packets["tcp6_syn"][:39], ErrTruncated},
+		{"IHL", badIHL, ErrHeaderLen},
+		{"data offset", badDoff, ErrHeaderLen},
+		{"total length", long, ErrTruncated},
+		{"payload length", packets["tcp6_syn"][:50], ErrTruncated},
+		{"short TCP", short, ErrTruncated},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.raw); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package ghostcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// listEntry is a domain rule read from a rule list: example.com,
+// *.example.com or +example.com, as in the config.
+type listEntry struct {
+	num    int
+	text   string
+	domain string
+	ips    []string
+	except bool
+}
+
+type listReader struct {
+	entries []listEntry
+}
+
+// listFormats are the formats list=format:path can read.
+var listFormats = map[string]func(r *listReader, data []byte){
+	"gfwlist": (*listReader).readGFWList,
+	"dnsmasq": (*listReader).readDnsmasq,
+	"hosts":   (*listReader).readHosts,
+	"plain":   (*listReader).readPlain,
+}
+
+func listLines(data []byte, read func(num int, line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			read(num, line)
+		}
+	}
+}
+
+// add adds a rule for domain, and its subdomains if subdomains is set. A
+// domain given as *.example.com is a rule for the subdomains only. An
+// exception is for the domain and its subdomains.
+func (r *listReader) add(num int, text string, domain string, subdomains bool, except bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	rule := domain
+	if strings.HasPrefix(domain, "*.") {
+		domain = domain[2:]
+	} else if subdomains || except {
+		rule = "+" + domain
+	}
+	if !isListDomain(domain) {
+		return
+	}
+	if except {
+		rule = "!" + domain
+	}
+
+	r.entries = append(r.entries, listEntry{num, text, rule, nil, except})
+}
+
+func isListDomain(domain string) bool {
+	if !strings.Contains(domain, ".") || net.ParseIP(domain) != nil {
+		return false
+	}
+	for _, ch := range domain {
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '.' || ch == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// readGFWList reads an AutoProxy list, base64 encoded as gfwlist is or not.
+// ||example.com is a rule for the domain and its subdomains,
+// |http://example.com for the domain and @@ makes a rule an exception.
+// URL paths are dropped and regular expressions are skipped.
+func (r *listReader) readGFWList(data []byte) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[AutoProxy")) {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+		if err == nil {
+			data = decoded
+		}
+	}
+
+	listLines(data, func(num int, line string) {
+		if line[0] == '!' || line[0] == '[' {
+			return
+		}
+		except := strings.HasPrefix(line, "@@")
+		rule := strings.TrimPrefix(line, "@@")
+		if len(rule) > 1 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+			return
+		}
+
+		subdomains := true
+		if strings.HasPrefix(rule, "||") {
+			rule = rule[2:]
+		} else if strings.HasPrefix(rule, "|") {
+			rule = rule[1:]
+			subdomains = false
+		} else {
+			rule = strings.TrimPrefix(rule, ".")
+		}
+		if i := strings.Index(rule, "://"); i != -1 {
+			rule = rule[i+3:]
+		}
+		if i := strings.IndexAny(rule, "/:^?"); i != -1 {
+			rule = rule[:i]
+		}
+		r.add(num, line, rule, subdomains, except)
+	})
+}
+
+// readDnsmasq reads the domains of server=/a.com/b.com/8.8.8.8 lines, and
+// of address=, ipset= and nftset= lines. They are rules for the domains
+// and their subdomains.
+func (r *listReader) readDnsmasq(data []byte) {
+	listLines(data, func(num int, line string) {
+		keys := strings.SplitN(line, "=", 2)
+		if len(keys) < 2 {
+			return
+		}
+		switch keys[0] {
+		case "server", "address", "ipset", "nftset":
+		default:
+			return
+		}
+		fields := strings.Split(keys[1], "/")
+		if len(fields) < 3 || fields[0] != "" {
+			return
+		}
+		for _, domain := range fields[1 : len(fields)-1] {
+			r.add(num, line, domain, true, false)
+		}
+	})
+}
+
+// readHosts reads a hosts file: the names of each line get its IP.
+func (r *listReader) readHosts(data []byte) {
+	index := make(map[string]int)
+	listLines(data, func(num int, line string) {
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if !isListDomain(name) {
+				continue
+			}
+			i, ok := index[name]
+			if ok {
+				r.entries[i].ips = append(r.entries[i].ips, fields[0])
+				continue
+			}
+			index[name] = len(r.entries)
+			r.entries = append(r.entries, listEntry{num, line, name, []string{fields[0]}, false})
+		}
+	})
+}
+
+// readPlain reads one domain a line, a rule for the domain and its
+// subdomains. *.example.com is a rule for the subdomains only and
+// !example.com an exception.
+func (r *listReader) readPlain(data []byte) {
+	listLines(data, func(num int, line string) {
+		if line[0] == '#' {
+			return
+		}
+		domain := strings.Fields(line)[0]
+		except := strings.HasPrefix(domain, "!")
+		r.add(num, line, strings.TrimPrefix(domain, "!"), true, except)
+	})
+}
+
+// list reads the rule list of a list=format:path line into the lines of
+// its domains, which get the settings or the profile of the list line.
+// Exceptions become !domain rules and come last, so they win over a rule
+// of the list for the same domain.
+func (r *includeReader) list(line ConfigLine) ([]ConfigLine, error) {
+	if len(line.Keys) < 2 {
+		return nil, errors.New("list needs format:path")
+	}
+	keys := strings.SplitN(line.Keys[1], ":", 2)
+	read, ok := listFormats[keys[0]]
+	if len(keys) < 2 || !ok {
+		return nil, errors.New("list needs format:path, format is gfwlist, dnsmasq, hosts or plain")
+	}
+
+	name := keys[1]
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(line.File), name)
+	}
+	return r.readList(line, read, name)
+}
+
+func (r *includeReader) readList(line ConfigLine, read func(r *listReader, data []byte), name string) ([]ConfigLine, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, 64<<20))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.files = append(r.files, name)
+
+	lr := &listReader{}
+	read(lr, data)
+
+	begin := line
+	begin.Keys = []string{"include", name}
+	begin.Profile = ""
+	lines := []ConfigLine{begin}
+	seen := make(map[string]bool)
+	var exceptions []ConfigLine
+	for _, entry := range lr.entries {
+		if seen[entry.domain] {
+			continue
+		}
+		seen[entry.domain] = true
+
+		l := ConfigLine{name, entry.num, entry.text, []string{entry.domain}, line.Profile}
+		if entry.ips != nil {
+			l.Keys = append(l.Keys, strings.Join(entry.ips, ","))
+		}
+		if entry.except {
+			l.Profile = ""
+			exceptions = append(exceptions, l)
+		} else {
+			lines = append(lines, l)
+		}
+	}
+	lines = append(lines, exceptions...)
+	end := begin
+	end.Keys = []string{"include"}
+
+	logPrintln(2, line.Text, len(seen), "domains")
+	return append(lines, end), nil
+}
@@ -0,0 +1,108 @@
+package ghostcp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadList loads a config with a list= line for testdata/lists/name.
+func loadList(t *testing.T, format string, name string) *configFile {
+	path, err := filepath.Abs(filepath.Join("testdata", "lists", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(t.TempDir(), "default.conf")
+	err = ioutil.WriteFile(conf, []byte("method=ttl\nlist="+format+":"+path+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestList(t *testing.T) {
+	const (
+		match   = iota
+		none    //no rule
+		exclude //a !domain rule
+	)
+	gfwlist := map[string]int{
+		"blocked.example":             match,
+		"www.blocked.example":         match,
+		"allowed.blocked.example":     exclude,
+		"www.allowed.blocked.example": exclude,
+		"exact.example":               match,
+		"www.exact.example":           none,
+		"dot.example":                 match,
+		"www.dot.example":             match,
+		"regex.example":               none,
+		"plain.example":               match,
+		"wild.example":                none,
+		"www.wild.example":            match,
+		"example":                     none,
+	}
+	tests := []struct {
+		format string
+		name   string
+		want   map[string]int
+	}{
+		{"gfwlist", "gfwlist.txt", gfwlist},
+		{"gfwlist", "gfwlist.b64.txt", gfwlist},
+		{"dnsmasq", "dnsmasq.conf", map[string]int{
+			"dnsmasq.example":     match,
+			"www.dnsmasq.example": match,
+			"other.example":       match,
+			"addr.example":        match,
+			"ipset.example":       match,
+			"nft.example":         match,
+			"www.nft.example":     match,
+			"8.8.8.8":             none,
+		}},
+		{"hosts", "hosts", map[string]int{
+			"hosts.example":     match,
+			"www.hosts.example": match,
+			"a.hosts.example":   none,
+			"localhost":         none,
+			"bad.example":       none,
+		}},
+		{"plain", "plain.txt", map[string]int{
+			"plain-list.example":        match,
+			"www.plain-list.example":    match,
+			"no.plain-list.example":     exclude,
+			"www.no.plain-list.example": exclude,
+			"wild-plain.example":        none,
+			"www.wild-plain.example":    match,
+		}},
+	}
+
+	for _, test := range tests {
+		cfg := loadList(t, test.format, test.name)
+		for domain, want := range test.want {
+			config, rule, ok := cfg.rules.MatchDomain(domain)
+			got := none
+			if ok {
+				got = match
+				if config.Option != OPT_TTL {
+					t.Errorf("%s %s: method %d", test.name, domain, config.Option)
+				}
+			} else if rule != "" {
+				got = exclude
+			}
+			if got != want {
+				t.Errorf("%s %s: got %d (rule %q), want %d", test.name, domain, got, rule, want)
+			}
+		}
+	}
+
+	//the names of a hosts file are answered with all their IPs
+	cfg := loadList(t, "hosts", "hosts")
+	config, _ := cfg.rules.Domain("hosts.example")
+	ips, _ := getAnswers(config.Answers4, int(config.ANCount4))
+	if len(ips) != 2 || ips[0] != "1.2.3.4" || ips[1] != "1.2.3.5" {
+		t.Errorf("hosts.example: %v", ips)
+	}
+}
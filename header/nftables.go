@@ -0,0 +1,269 @@
+package ghostcp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DivertMark is set on the packets injected by the Linux backend so that the
+// generated rules let them through instead of queueing them again.
+var DivertMark uint32 = 0x6763
+
+// nftTerm is a single nft match expression. Direction terms are kept apart
+// because they choose the hook rather than becoming a match.
+type nftTerm struct {
+	expr      string
+	direction int
+}
+
+const (
+	nftAnyDirection = 0
+	nftInbound      = 1
+	nftOutbound     = 2
+)
+
+func nftNegate(op string) string {
+	switch op {
+	case "==":
+		return "!="
+	case "!=":
+		return "=="
+	case "<":
+		return ">="
+	case "<=":
+		return ">"
+	case ">":
+		return "<="
+	case ">=":
+		return "<"
+	}
+	return op
+}
+
+func nftLeaf(f *divertFilter, negate bool) ([]nftTerm, bool, error) {
+	if f.op == "field" {
+		switch f.field {
+		case "true", "false":
+			return nil, (f.field == "true") != negate, nil
+		case "inbound", "outbound":
+			inbound := (f.field == "inbound") != negate
+			if inbound {
+				return []nftTerm{{direction: nftInbound}}, true, nil
+			}
+			return []nftTerm{{direction: nftOutbound}}, true, nil
+		case "ip", "ipv6":
+			proto := map[string]string{"ip": "ipv4", "ipv6": "ipv6"}[f.field]
+			if negate {
+				return []nftTerm{{expr: "meta nfproto != " + proto}}, true, nil
+			}
+			return []nftTerm{{expr: "meta nfproto " + proto}}, true, nil
+		case "tcp", "udp":
+			if negate {
+				return []nftTerm{{expr: "meta l4proto != " + f.field}}, true, nil
+			}
+			return []nftTerm{{expr: "meta l4proto " + f.field}}, true, nil
+		default:
+			flag := strings.ToLower(strings.TrimPrefix(f.field, "tcp."))
+			if negate {
+				return []nftTerm{{expr: fmt.Sprintf("tcp flags & %s == 0", flag)}}, true, nil
+			}
+			return []nftTerm{{expr: fmt.Sprintf("tcp flags & %s == %s", flag, flag)}}, true, nil
+		}
+	}
+
+	var selector string
+	switch f.field {
+	case "ip.SrcAddr":
+		selector = "ip saddr"
+	case "ip.DstAddr":
+		selector = "ip daddr"
+	case "ipv6.SrcAddr":
+		selector = "ip6 saddr"
+	case "ipv6.DstAddr":
+		selector = "ip6 daddr"
+	case "ip.TTL":
+		selector = "ip ttl"
+	case "ipv6.HopLimit":
+		selector = "ip6 hoplimit"
+	case "ip.Protocol":
+		selector = "ip protocol"
+	case "tcp.SrcPort":
+		selector = "tcp sport"
+	case "tcp.DstPort":
+		selector = "tcp dport"
+	case "udp.SrcPort":
+		selector = "udp sport"
+	case "udp.DstPort":
+		selector = "udp dport"
+	default:
+		return nil, false, fmt.Errorf("%s has no nftables equivalent", f.field)
+	}
+
+	op := f.cmp
+	if negate {
+		op = nftNegate(op)
+	}
+	value := fmt.Sprint(f.value)
+	if f.ip != nil {
+		value = f.ip.String()
+	}
+	if op == "==" {
+		return []nftTerm{{expr: selector + " " + value}}, true, nil
+	}
+	return []nftTerm{{expr: selector + " " + op + " " + value}}, true, nil
+}
+
+// nftDNF turns a filter into a disjunction of conjunctions, pushing
+// negations down to the leaves, since an nft rule can only express "and".
+func nftDNF(f *divertFilter, negate bool) ([][]nftTerm, error) {
+	op := f.op
+	if negate {
+		switch op {
+		case "and":
+			op = "or"
+		case "or":
+			op = "and"
+		}
+	}
+
+	switch op {
+	case "not":
+		return nftDNF(f.left, !negate)
+	case "or":
+		left, err := nftDNF(f.left, negate)
+		if err != nil {
+			return nil, err
+		}
+		right, err := nftDNF(f.right, negate)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	case "and":
+		left, err := nftDNF(f.left, negate)
+		if err != nil {
+			return nil, err
+		}
+		right, err := nftDNF(f.right, negate)
+		if err != nil {
+			return nil, err
+		}
+		var product [][]nftTerm
+		for _, l := range left {
+			for _, r := range right {
+				terms := make([]nftTerm, 0, len(l)+len(r))
+				terms = append(terms, l...)
+				terms = append(terms, r...)
+				product = append(product, terms)
+			}
+		}
+		return product, nil
+	}
+
+	terms, ok, err := nftLeaf(f, negate)
+	if err != nil || !ok {
+		return nil, err
+	}
+	//a field is false on packets of another protocol, so its negation is
+	//true there, while nft never matches them on the negated field
+	if negate {
+		if proto := nftFieldProtocol(f.field); proto != "" {
+			return [][]nftTerm{{{expr: proto}}, terms}, nil
+		}
+	}
+	return [][]nftTerm{terms}, nil
+}
+
+// nftFieldProtocol returns the match of the packets that do not carry the
+// protocol of field, or "" if field is not one of a protocol.
+func nftFieldProtocol(field string) string {
+	switch {
+	case strings.HasPrefix(field, "tcp."):
+		return "meta l4proto != tcp"
+	case strings.HasPrefix(field, "udp."):
+		return "meta l4proto != udp"
+	case strings.HasPrefix(field, "ip."):
+		return "meta nfproto != ipv4"
+	case strings.HasPrefix(field, "ipv6."):
+		return "meta nfproto != ipv6"
+	}
+	return ""
+}
+
+func nftTableName(queue uint16) string {
+	return fmt.Sprintf("ghostcp%d", queue)
+}
+
+// NFTablesRuleset translates a WinDivert filter into an nft script that
+// queues the matching packets to the given NFQUEUE number. Packets carrying
+// DivertMark are never queued.
+func NFTablesRuleset(filter string, layer uint8, priority uint16, queue uint16) (string, error) {
+	f, err := parseDivertFilter(filter)
+	if err != nil {
+		return "", err
+	}
+	dnf, err := nftDNF(f, false)
+	if err != nil {
+		return "", err
+	}
+
+	chains := map[string][]string{}
+	for _, conj := range dnf {
+		direction := nftAnyDirection
+		var exprs []string
+		conflict := false
+		for _, t := range conj {
+			if t.direction == nftAnyDirection {
+				exprs = append(exprs, t.expr)
+			} else if direction == nftAnyDirection {
+				direction = t.direction
+			} else if direction != t.direction {
+				conflict = true
+			}
+		}
+		if conflict {
+			continue
+		}
+
+		rule := fmt.Sprintf("meta mark != 0x%x", DivertMark)
+		if len(exprs) > 0 {
+			rule += " " + strings.Join(exprs, " ")
+		}
+		rule += fmt.Sprintf(" queue num %d bypass", queue)
+
+		var hooks []string
+		if layer == DIVERT_LAYER_FORWARD {
+			hooks = []string{"forward"}
+		} else {
+			switch direction {
+			case nftInbound:
+				hooks = []string{"input"}
+			case nftOutbound:
+				hooks = []string{"output"}
+			default:
+				hooks = []string{"input", "output"}
+			}
+		}
+		for _, hook := range hooks {
+			chains[hook] = append(chains[hook], rule)
+		}
+	}
+
+	table := nftTableName(queue)
+	script := fmt.Sprintf("table inet %s {\n", table)
+	for _, hook := range []string{"input", "forward", "output"} {
+		rules, ok := chains[hook]
+		if !ok {
+			continue
+		}
+		script += fmt.Sprintf("\tchain %s {\n", hook)
+		script += fmt.Sprintf("\t\ttype filter hook %s priority %d; policy accept;\n", hook, -150+int(int16(priority)))
+		for _, rule := range rules {
+			script += "\t\t" + rule + "\n"
+		}
+		script += "\t}\n"
+	}
+	script += "}\n"
+
+	return script, nil
+}
@@ -0,0 +1,131 @@
+package ghostcp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNFTablesRuleset(t *testing.T) {
+	tests := []struct {
+		filter string
+		layer  uint8
+		rules  map[string][]string
+	}{
+		{"outbound and tcp.DstPort == 443", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {"tcp dport 443"},
+		}},
+		{"outbound and ip.DstAddr = 1.2.3.4 and tcp.DstPort == 53", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {"ip daddr 1.2.3.4 tcp dport 53"},
+		}},
+		{"inbound and tcp.SrcPort == 443 and (tcp.Syn or tcp.Rst)", DIVERT_LAYER_NETWORK, map[string][]string{
+			"input": {
+				"tcp sport 443 tcp flags & syn == syn",
+				"tcp sport 443 tcp flags & rst == rst",
+			},
+		}},
+		{"tcp.SrcPort == 443 and (tcp.Syn)", DIVERT_LAYER_FORWARD, map[string][]string{
+			"forward": {"tcp sport 443 tcp flags & syn == syn"},
+		}},
+		{"tcp.DstPort == 80", DIVERT_LAYER_FORWARD, map[string][]string{
+			"forward": {"tcp dport 80"},
+		}},
+		{"outbound and udp.DstPort == 53", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {"udp dport 53"},
+		}},
+		{"udp.SrcPort == 53", DIVERT_LAYER_NETWORK, map[string][]string{
+			"input":  {"udp sport 53"},
+			"output": {"udp sport 53"},
+		}},
+		{"ip.DstAddr=1.2.3.4 or ipv6.SrcAddr=2001:db8::1", DIVERT_LAYER_NETWORK, map[string][]string{
+			"input":  {"ip daddr 1.2.3.4", "ip6 saddr 2001:db8::1"},
+			"output": {"ip daddr 1.2.3.4", "ip6 saddr 2001:db8::1"},
+		}},
+		{"(outbound and ip.DstAddr=1.2.3.4) or (inbound and ipv6.SrcAddr=2001:db8::1)", DIVERT_LAYER_NETWORK, map[string][]string{
+			"input":  {"ip6 saddr 2001:db8::1"},
+			"output": {"ip daddr 1.2.3.4"},
+		}},
+		{"outbound and (ip or ipv6) and tcp and ip.TTL <= 5", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {
+				"meta nfproto ipv4 meta l4proto tcp ip ttl <= 5",
+				"meta nfproto ipv6 meta l4proto tcp ip ttl <= 5",
+			},
+		}},
+		//a negated field also matches the packets without its protocol
+		{"outbound and not tcp.Syn", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {"meta l4proto != tcp", "tcp flags & syn == 0"},
+		}},
+		{"outbound and not (udp.DstPort == 53 or tcp)", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {
+				"meta l4proto != udp meta l4proto != tcp",
+				"udp dport != 53 meta l4proto != tcp",
+			},
+		}},
+		{"outbound and inbound", DIVERT_LAYER_NETWORK, map[string][]string{}},
+		{"outbound and false", DIVERT_LAYER_NETWORK, map[string][]string{}},
+		{"outbound and not false", DIVERT_LAYER_NETWORK, map[string][]string{
+			"output": {""},
+		}},
+	}
+
+	for _, test := range tests {
+		script, err := NFTablesRuleset(test.filter, test.layer, 1, 6300)
+		if err != nil {
+			t.Errorf("%q: %v", test.filter, err)
+			continue
+		}
+
+		want := "table inet ghostcp6300 {\n"
+		for _, hook := range []string{"input", "forward", "output"} {
+			rules, ok := test.rules[hook]
+			if !ok {
+				continue
+			}
+			want += "\tchain " + hook + " {\n"
+			want += "\t\ttype filter hook " + hook + " priority -149; policy accept;\n"
+			for _, rule := range rules {
+				if rule != "" {
+					rule = " " + rule
+				}
+				want += "\t\tmeta mark != 0x6763" + rule + " queue num 6300 bypass\n"
+			}
+			want += "\t}\n"
+		}
+		want += "}\n"
+
+		if script != want {
+			t.Errorf("%q:\n%s\nwant:\n%s", test.filter, script, want)
+		}
+	}
+}
+
+func TestNFTablesRulesetErrors(t *testing.T) {
+	for _, filter := range []string{
+		"tcp.PayloadLength > 0",
+		"outbound and udp.PayloadLength == 0",
+		"tcp.DstPort ==",
+		"(tcp",
+	} {
+		if script, err := NFTablesRuleset(filter, DIVERT_LAYER_NETWORK, 0, 6300); err == nil {
+			t.Errorf("%q: no error:\n%s", filter, script)
+		}
+	}
+}
+
+func TestNFTablesRulesetPriority(t *testing.T) {
+	for _, test := range []struct {
+		priority uint16
+		want     string
+	}{
+		{0, "priority -150;"},
+		{1, "priority -149;"},
+		{0xFFFF, "priority -151;"},
+	} {
+		script, err := NFTablesRuleset("tcp", DIVERT_LAYER_NETWORK, test.priority, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(script, test.want) || !strings.HasPrefix(script, "table inet ghostcp7 {") {
+			t.Errorf("priority %d:\n%s", test.priority, script)
+		}
+	}
+}
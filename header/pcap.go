@@ -0,0 +1,179 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	LINKTYPE_NULL      = 0
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_RAW       = 101
+	LINKTYPE_LOOP      = 108
+	LINKTYPE_LINUX_SLL = 113
+	LINKTYPE_IPV4      = 228
+	LINKTYPE_IPV6      = 229
+)
+
+// ReadPcap reads a libpcap capture and returns the IP packets it contains.
+// A packet is marked outbound when its source is one of local, or, when
+// local is empty, when its source matches the first packet of the file.
+func ReadPcap(r io.Reader, local ...net.IP) ([]*Packet, error) {
+	var head [24]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	nano := false
+	switch binary.LittleEndian.Uint32(head[:4]) {
+	case 0xA1B2C3D4:
+		order = binary.LittleEndian
+	case 0xA1B23C4D:
+		order = binary.LittleEndian
+		nano = true
+	case 0xD4C3B2A1:
+		order = binary.BigEndian
+	case 0x4D3CB2A1:
+		order = binary.BigEndian
+		nano = true
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	linkType := order.Uint32(head[20:24]) & 0xFFFF
+
+	var packets []*Packet
+	var record [16]byte
+	for {
+		_, err := io.ReadFull(r, record[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sec := int64(order.Uint32(record[0:4]))
+		frac := int64(order.Uint32(record[4:8]))
+		capLen := order.Uint32(record[8:12])
+		if capLen > 0x40000 {
+			return nil, fmt.Errorf("bad pcap record length %d", capLen)
+		}
+		frame := make([]byte, capLen)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+
+		raw := pcapPayload(frame, linkType)
+		if len(raw) < 20 {
+			continue
+		}
+		version := raw[0] >> 4
+		if version != 4 && version != 6 {
+			continue
+		}
+		if version == 6 && len(raw) < 40 {
+			continue
+		}
+
+		if !nano {
+			frac *= 1000
+		}
+		packet := &Packet{
+			Raw:       raw,
+			PacketLen: uint(len(raw)),
+			Addr:      &Address{Timestamp: sec*1000000000 + frac},
+		}
+		if len(local) == 0 {
+			local = append(local, packet.SrcIP())
+		}
+		outbound := false
+		src := packet.SrcIP()
+		for _, ip := range local {
+			if ip.Equal(src) {
+				outbound = true
+				break
+			}
+		}
+		if !outbound {
+			packet.Addr.Data |= ADDR_INBOUND
+		}
+		packets = append(packets, packet)
+	}
+
+	return packets, nil
+}
+
+func pcapPayload(frame []byte, linkType uint32) []byte {
+	switch linkType {
+	case LINKTYPE_ETHERNET:
+		if len(frame) < 14 {
+			return nil
+		}
+		offset := 12
+		etherType := binary.BigEndian.Uint16(frame[offset:])
+		for etherType == 0x8100 || etherType == 0x88A8 {
+			offset += 4
+			if offset+2 > len(frame) {
+				return nil
+			}
+			etherType = binary.BigEndian.Uint16(frame[offset:])
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil
+		}
+		return frame[offset+2:]
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		if len(frame) < 4 {
+			return nil
+		}
+		return frame[4:]
+	case LINKTYPE_LINUX_SLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		return frame[16:]
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6, 12, 14:
+		return frame
+	}
+	return nil
+}
+
+// WritePcap writes packets as a LINKTYPE_RAW capture, so that the output of
+// a PacketReplay can be inspected with the usual tools.
+func WritePcap(w io.Writer, packets []*Packet) error {
+	var head [24]byte
+	binary.LittleEndian.PutUint32(head[0:], 0xA1B23C4D)
+	binary.LittleEndian.PutUint16(head[4:], 2)
+	binary.LittleEndian.PutUint16(head[6:], 4)
+	binary.LittleEndian.PutUint32(head[16:], 0xFFFF)
+	binary.LittleEndian.PutUint32(head[20:], LINKTYPE_RAW)
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+
+	var record [16]byte
+	for _, packet := range packets {
+		raw := packet.Raw
+		if int(packet.PacketLen) < len(raw) {
+			raw = raw[:packet.PacketLen]
+		}
+		var ts int64
+		if packet.Addr != nil {
+			ts = packet.Addr.Timestamp
+		}
+		binary.LittleEndian.PutUint32(record[0:], uint32(ts/1000000000))
+		binary.LittleEndian.PutUint32(record[4:], uint32(ts%1000000000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(raw)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(raw)))
+		if _, err := w.Write(record[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
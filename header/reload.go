@@ -0,0 +1,243 @@
+package ghostcp
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type daemonKey struct {
+	address string
+	forward bool
+}
+
+var hostsFile string = ""
+var systemHostsFile string = ""
+var configHostsFile string = ""
+var hostsStatic bool = false
+var configFiles []string
+var ConfigReloadInterval = 5 * time.Second
+
+var reloadMutex sync.Mutex
+var loadedStamp string
+var configDaemons = make(map[daemonKey]PacketDiverter)
+
+// startConfig is the config LoadConfig started with, for the settings a
+// reload does not change.
+var startConfig *configFile
+var nat64Started = make(map[daemonKey]bool)
+
+// applyConfig puts a loaded config in use: the rules are swapped in, the
+// learned IPs follow their new rules and the ip:port daemons and the
+// subscriptions of the config are started or stopped. It is called with
+// reloadMutex held.
+func applyConfig(cfg *configFile) {
+	Rules.Swap(cfg.rules)
+	configFiles = cfg.files
+	configHostsFile = cfg.hosts
+	hostsStatic = cfg.hostsStatic
+	Forward = cfg.forward
+
+	count := Rules.Relearn(func(addr string, domain string) (IPConfig, bool) {
+		if cfg.rules.settings.ipBlock {
+			config, ok := IPBlockLookup(addr)
+			if ok {
+				return config, true
+			}
+		}
+		config, ok := domainLookup(domain)
+		return IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}, ok
+	})
+	if count > 0 {
+		logPrintln(2, count, "learned IPs dropped")
+	}
+
+	updateDaemons(cfg.daemons)
+	updateSubscriptions(cfg.subscriptions)
+	setDoHServers(cfg.doh)
+	setDoTServers(cfg.dot)
+	loadedStamp = configStamp()
+
+	for _, rule := range cfg.nat64 {
+		key := daemonKey{rule.ipv4.String(), false}
+		if nat64Started[key] {
+			continue
+		}
+		nat64Started[key] = true
+		if cfg.forward {
+			go NAT64(rule.ipv4, rule.prefix, true)
+		}
+		go NAT64(rule.ipv4, rule.prefix, false)
+	}
+}
+
+func updateDaemons(keys []daemonKey) {
+	daemons := make(map[daemonKey]PacketDiverter)
+	for _, key := range keys {
+		if _, ok := daemons[key]; ok {
+			continue
+		}
+		divert, ok := configDaemons[key]
+		if !ok {
+			logPrintln(1, "start", key.address, key.forward)
+			divert = tcpDaemon(key.address, key.forward)
+		}
+		daemons[key] = divert
+	}
+
+	for key, divert := range configDaemons {
+		if _, ok := daemons[key]; ok {
+			continue
+		}
+		logPrintln(1, "stop", key.address, key.forward)
+		if divert != nil {
+			divert.Close()
+		}
+	}
+
+	configDaemons = daemons
+}
+
+// ReloadConfig loads ConfigFile and the hosts file again and puts them in
+// use. If the config has an error the one in use is kept.
+func ReloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		logPrintln(1, "reload", ConfigFile, err)
+		return err
+	}
+	hosts := systemHostsFile
+	if cfg.hosts != "" {
+		hosts = cfg.hosts
+	}
+	if hosts != "" {
+		err = loadHosts(hosts, cfg.rules, cfg.hostsStatic)
+		if err != nil {
+			logPrintln(1, err)
+		}
+		hostsFile = hosts
+	}
+
+	if cfg.dns != DNS {
+		logPrintln(1, "server", cfg.dns, "takes effect after a restart")
+	} else {
+		daemon, recv := DNSModes(cfg.dns, cfg.upstreams)
+		daemon0, recv0 := DNSModes(DNS, DNSUpstreams)
+		if daemon && !daemon0 || recv && !recv0 {
+			logPrintln(1, "dns=", cfg.upstreams, "takes effect after a restart")
+		}
+	}
+	for _, addr := range cfg.divertedAddrs() {
+		if !containsString(DNSAddrs, addr) {
+			logPrintln(1, "dns=", addr, "is diverted after a restart")
+		}
+	}
+	if startConfig != nil && cfg.forward != startConfig.forward {
+		logPrintln(1, "forward", cfg.forward, "takes effect for the ip:port daemons, for the others after a restart")
+	}
+	if startConfig != nil && cfg.logLevel != startConfig.logLevel {
+		logPrintln(1, "log=", cfg.logLevel, "takes effect after a restart")
+	}
+	if cfg.tfoEnable && !TFOEnable || cfg.detectEnable && !DetectEnable || cfg.rstFilterEnable && !RSTFilterEnable {
+		logPrintln(1, "method= tfo, filter and no-rst take effect after a restart")
+	}
+	for _, diff := range diffRules(Rules, cfg.rules) {
+		logPrintln(1, diff)
+	}
+
+	applyConfig(cfg)
+	logPrintln(1, "reloaded", ConfigFile)
+
+	return nil
+}
+
+// diffRules lists the domain and IP rules added (+), removed (-) and
+// changed (~) from old to n.
+func diffRules(old *RuleStore, n *RuleStore) []string {
+	old.mutex.RLock()
+	oldDomains, oldIPs := old.domains, old.ips
+	old.mutex.RUnlock()
+	n.mutex.RLock()
+	domains, ips := n.domains, n.ips
+	n.mutex.RUnlock()
+
+	var diffs []string
+	for name, config := range domains {
+		oldConfig, ok := oldDomains[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("+ %s %d", name, config.Option))
+		} else if !reflect.DeepEqual(config, oldConfig) {
+			diffs = append(diffs, fmt.Sprintf("~ %s %d -> %d", name, oldConfig.Option, config.Option))
+		}
+	}
+	for name := range oldDomains {
+		if _, ok := domains[name]; !ok {
+			diffs = append(diffs, "- "+name)
+		}
+	}
+	for addr, config := range ips {
+		oldConfig, ok := oldIPs[addr]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("+ %s %d", addr, config.Option))
+		} else if config != oldConfig {
+			diffs = append(diffs, fmt.Sprintf("~ %s %d -> %d", addr, oldConfig.Option, config.Option))
+		}
+	}
+	for addr := range oldIPs {
+		if _, ok := ips[addr]; !ok {
+			diffs = append(diffs, "- "+addr)
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i][2:] < diffs[j][2:]
+	})
+	return diffs
+}
+
+// configStamp changes when a file the config was read from, or the hosts
+// file, changes.
+func configStamp() string {
+	stamp := ""
+	names := append([]string{hostsFile}, configFiles...)
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err == nil {
+			stamp += fmt.Sprint(info.ModTime().UnixNano(), info.Size(), " ")
+		}
+	}
+	return stamp
+}
+
+// WatchConfig reloads the config when ConfigFile, a file it includes or the
+// hosts file has changed, checked every ConfigReloadInterval, or when the
+// process gets SIGHUP.
+func WatchConfig() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	ticker := time.NewTicker(ConfigReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+		case <-ticker.C:
+			reloadMutex.Lock()
+			changed := configStamp() != loadedStamp
+			reloadMutex.Unlock()
+			if !changed {
+				continue
+			}
+		}
+		ReloadConfig()
+	}
+}
@@ -0,0 +1,112 @@
+package ghostcp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testConfig points ConfigFile at a file in a temporary directory and Rules
+// at an empty store until the test ends. It returns a function writing the
+// config file.
+func testConfig(t *testing.T) func(conf string) {
+	name := filepath.Join(t.TempDir(), "default.conf")
+	configFile, rules := ConfigFile, Rules
+	ConfigFile, Rules = name, NewRuleStore()
+	t.Cleanup(func() {
+		ConfigFile, Rules = configFile, rules
+	})
+	return func(conf string) {
+		if err := ioutil.WriteFile(name, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	write := testConfig(t)
+
+	write("ip-limit=5\nsubdomain=0\ndns-race=true\nmethod=ttl\n*\n10.0.0.0/8\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	settings := Rules.Settings()
+	if settings.learnLimit != 5 || settings.subdomainDepth != 0 || !settings.dnsRace || !settings.ipBlock {
+		t.Errorf("settings %+v", settings)
+	}
+	if settings.defaultConfig == nil || settings.defaultConfig.Option != OPT_TTL {
+		t.Errorf("default config %+v", settings.defaultConfig)
+	}
+	if config, ok := domainLookup("www.example.com"); !ok || config.ANCount4 != 0 {
+		t.Errorf("subdomain=0: got %+v %v", config, ok)
+	}
+
+	//a failed reload keeps every setting
+	write("ip-limit=7\nsubdomain=3\ndns-race=false\nttl=x\n")
+	if err := ReloadConfig(); err == nil {
+		t.Fatal("no error")
+	}
+	if Rules.Settings() != settings {
+		t.Errorf("settings %+v after a failed reload, want %+v", Rules.Settings(), settings)
+	}
+
+	//the settings read when the daemons start are kept
+	logLevel, tfo := LogLevel, TFOEnable
+	write("log=3\nmethod=tfo\n1.2.3.4\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if LogLevel != logLevel || TFOEnable != tfo {
+		t.Errorf("log %d tfo %v", LogLevel, TFOEnable)
+	}
+	settings = Rules.Settings()
+	if settings.learnLimit != 10000 || settings.subdomainDepth != 2 || settings.dnsRace || settings.ipBlock || settings.defaultConfig != nil {
+		t.Errorf("default settings %+v", settings)
+	}
+	if _, ok := domainLookup("www.example.com"); ok {
+		t.Error("www.example.com has a rule without *")
+	}
+}
+
+func TestReloadForward(t *testing.T) {
+	write := testConfig(t)
+	forward := Forward
+	defer func() { Forward = forward }()
+	Forward = false
+
+	//loading a config does not change the one in use
+	write("forward\nmethod=ttl\n1.2.3.4:443\n")
+	cfg, err := loadConfigFile(ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Forward {
+		t.Error("loading set Forward")
+	}
+	if len(cfg.daemons) != 2 || !cfg.daemons[0].forward {
+		t.Errorf("daemons %v", cfg.daemons)
+	}
+
+	write("forward\nttl=x\n")
+	if err := ReloadConfig(); err == nil {
+		t.Fatal("no error")
+	}
+	if Forward {
+		t.Error("a failed reload set Forward")
+	}
+
+	write("forward\nmethod=ttl\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !Forward {
+		t.Error("forward not applied")
+	}
+	write("method=ttl\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if Forward {
+		t.Error("forward kept after it was removed")
+	}
+}
@@ -0,0 +1,231 @@
+package ghostcp
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+// PacketReplay is an in-memory diverter backend. Packets injected into it
+// are handed to the handles opened through Open whose filter matches, one
+// at a time, and every packet the handles send back is recorded. Set
+// OpenDiverter to its Open method before starting the daemons.
+//
+// Re-injected packets are recorded only; they are not diverted again to
+// lower priority handles as WinDivert would do.
+type PacketReplay struct {
+	mutex   sync.Mutex
+	handles []*replayHandle
+	sent    []*Packet
+	passed  []*Packet
+}
+
+type replayHandle struct {
+	replay   *PacketReplay
+	filter   *divertFilter
+	layer    uint8
+	priority uint16
+	flags    uint8
+	queue    chan *Packet
+	done     chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+	inflight bool
+}
+
+const (
+	DIVERT_FLAG_SNIFF = 0x1 << 0
+	DIVERT_FLAG_DROP  = 0x1 << 1
+)
+
+func NewPacketReplay() *PacketReplay {
+	return &PacketReplay{}
+}
+
+func copyPacket(packet *Packet) *Packet {
+	size := int(packet.PacketLen)
+	if size > len(packet.Raw) {
+		size = len(packet.Raw)
+	}
+	p := &Packet{Raw: make([]byte, size), PacketLen: uint(size)}
+	copy(p.Raw, packet.Raw)
+	if packet.Addr != nil {
+		addr := *packet.Addr
+		p.Addr = &addr
+	} else {
+		p.Addr = &Address{}
+	}
+	return p
+}
+
+func (r *PacketReplay) Open(filter string, layer uint8, priority uint16, flags uint8) (PacketDiverter, error) {
+	f, err := parseDivertFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &replayHandle{
+		replay:   r,
+		filter:   f,
+		layer:    layer,
+		priority: priority,
+		flags:    flags,
+		queue:    make(chan *Packet),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	r.mutex.Lock()
+	r.handles = append(r.handles, h)
+	//WinDivert 1.x delivers to lower priority values first
+	sort.SliceStable(r.handles, func(i, j int) bool {
+		return int16(r.handles[i].priority) < int16(r.handles[j].priority)
+	})
+	r.mutex.Unlock()
+
+	return h, nil
+}
+
+func (r *PacketReplay) dispatch(packet *Packet, layer uint8) bool {
+	r.mutex.Lock()
+	handles := make([]*replayHandle, len(r.handles))
+	copy(handles, r.handles)
+	r.mutex.Unlock()
+
+	for _, h := range handles {
+		if h.layer != layer || !h.filter.Match(packet) {
+			continue
+		}
+		if h.flags&DIVERT_FLAG_DROP != 0 {
+			return true
+		}
+		if !h.deliver(copyPacket(packet)) {
+			continue
+		}
+		if h.flags&DIVERT_FLAG_SNIFF != 0 {
+			continue
+		}
+		return true
+	}
+
+	r.mutex.Lock()
+	r.passed = append(r.passed, copyPacket(packet))
+	r.mutex.Unlock()
+	return false
+}
+
+// Inject feeds a packet on the network layer and waits until the handle it
+// was diverted to asks for the next packet. It reports whether any handle
+// took the packet.
+func (r *PacketReplay) Inject(packet *Packet) bool {
+	return r.dispatch(packet, DIVERT_LAYER_NETWORK)
+}
+
+// Forward is Inject for the forward layer.
+func (r *PacketReplay) Forward(packet *Packet) bool {
+	return r.dispatch(packet, DIVERT_LAYER_FORWARD)
+}
+
+func (r *PacketReplay) Replay(packets []*Packet) {
+	for _, packet := range packets {
+		r.Inject(packet)
+	}
+}
+
+// Sent returns copies of the packets re-injected by the handles, in order.
+func (r *PacketReplay) Sent() []*Packet {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	packets := make([]*Packet, len(r.sent))
+	copy(packets, r.sent)
+	return packets
+}
+
+// Passed returns the injected packets that no handle diverted.
+func (r *PacketReplay) Passed() []*Packet {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	packets := make([]*Packet, len(r.passed))
+	copy(packets, r.passed)
+	return packets
+}
+
+func (r *PacketReplay) Reset() {
+	r.mutex.Lock()
+	r.sent = nil
+	r.passed = nil
+	r.mutex.Unlock()
+}
+
+func (r *PacketReplay) Close() {
+	r.mutex.Lock()
+	handles := r.handles
+	r.handles = nil
+	r.mutex.Unlock()
+
+	for _, h := range handles {
+		h.Close()
+	}
+}
+
+func (h *replayHandle) deliver(packet *Packet) bool {
+	select {
+	case h.queue <- packet:
+	case <-h.closed:
+		return false
+	}
+	select {
+	case <-h.done:
+	case <-h.closed:
+	}
+	return true
+}
+
+func (h *replayHandle) Recv() (*Packet, error) {
+	if h.inflight {
+		h.inflight = false
+		select {
+		case h.done <- struct{}{}:
+		case <-h.closed:
+			return nil, ErrDiverterClosed
+		}
+	}
+
+	select {
+	case packet := <-h.queue:
+		h.inflight = true
+		return packet, nil
+	case <-h.closed:
+		return nil, ErrDiverterClosed
+	}
+}
+
+func (h *replayHandle) Send(packet *Packet) (uint, error) {
+	select {
+	case <-h.closed:
+		return 0, ErrDiverterClosed
+	default:
+	}
+
+	p := copyPacket(packet)
+	h.replay.mutex.Lock()
+	h.replay.sent = append(h.replay.sent, p)
+	h.replay.mutex.Unlock()
+	return p.PacketLen, nil
+}
+
+func (h *replayHandle) CalcChecksum(packet *Packet) {
+	size := int(packet.PacketLen)
+	if size > len(packet.Raw) {
+		size = len(packet.Raw)
+	}
+	layers.CalcChecksums(packet.Raw[:size])
+}
+
+func (h *replayHandle) Close() error {
+	h.once.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,245 @@
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+// testPacket builds a packet from src:sport to dst:dport, TCP if proto is 6
+// and UDP otherwise, with valid checksums.
+func testPacket(proto uint8, src string, sport uint16, dst string, dport uint16, flags uint8, payload []byte, inbound bool) *Packet {
+	l := &layers.Packet{Payload: payload}
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		l.IPv4 = &layers.IPv4{ID: 0x1234, TTL: 64, Src: srcIP.To4(), Dst: dstIP.To4()}
+	} else {
+		l.IPv6 = &layers.IPv6{HopLimit: 64, Src: srcIP, Dst: dstIP}
+	}
+	if proto == layers.ProtocolTCP {
+		l.TCP = &layers.TCP{SrcPort: sport, DstPort: dport, Seq: 1000, Ack: 2000, Flags: flags, Window: 64240}
+	} else {
+		l.UDP = &layers.UDP{SrcPort: sport, DstPort: dport}
+	}
+	raw := l.Serialize(nil, true)
+	addr := &Address{}
+	if inbound {
+		addr.Data |= ADDR_INBOUND
+	}
+	return &Packet{Raw: raw, Addr: addr, PacketLen: uint(len(raw))}
+}
+
+func TestDivertFilter(t *testing.T) {
+	syn := testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 443, TCP_SYN, nil, false)
+	synAck := testPacket(6, "1.2.3.4", 443, "10.0.0.2", 50000, TCP_SYN|TCP_ACK, nil, true)
+	rst := testPacket(6, "1.2.3.4", 443, "10.0.0.2", 50000, TCP_RST, nil, true)
+	data := testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 443, TCP_ACK|TCP_PSH, []byte("hello"), false)
+	dns := testPacket(17, "10.0.0.2", 53000, "8.8.8.8", 53, 0, make([]byte, 29), false)
+	dnsAnswer := testPacket(17, "8.8.8.8", 53, "10.0.0.2", 53000, 0, make([]byte, 45), true)
+	syn6 := testPacket(6, "2001:db8::2", 50000, "2001:db8::1", 443, TCP_SYN, nil, false)
+	quic := testPacket(17, "10.0.0.2", 50001, "1.2.3.4", 443, 0, make([]byte, 1200), false)
+
+	tests := []struct {
+		filter string
+		packet *Packet
+		match  bool
+	}{
+		{"outbound and tcp.DstPort == 443", syn, true},
+		{"outbound and tcp.DstPort == 443", synAck, false},
+		{"outbound and tcp.DstPort == 443", syn6, true},
+		{"outbound and ip.DstAddr = 1.2.3.4 and tcp.DstPort == 443", syn, true},
+		{"outbound and ip.DstAddr = 1.2.3.5 and tcp.DstPort == 443", syn, false},
+		{"outbound and ip.DstAddr = 1.2.3.4 and tcp.DstPort == 443", syn6, false},
+		{"inbound and tcp.SrcPort == 443 and (tcp.Syn or tcp.Rst)", synAck, true},
+		{"inbound and tcp.SrcPort == 443 and (tcp.Syn or tcp.Rst)", rst, true},
+		{"inbound and tcp.SrcPort == 443 and (tcp.Syn or tcp.Rst)", data, false},
+		{"inbound and ip.SrcAddr = 1.2.3.4 and tcp.SrcPort == 443 and (tcp.Rst)", rst, true},
+		{"tcp.SrcPort == 443 and (tcp.Syn)", synAck, true},
+		{"outbound and udp.DstPort == 53", dns, true},
+		{"outbound and udp.DstPort == 53", dnsAnswer, false},
+		{"udp.SrcPort == 53", dnsAnswer, true},
+		{"udp.SrcPort == 53", syn, false},
+		{"outbound and udp.DstPort == 443", quic, true},
+		{"outbound and udp.DstPort == 443", syn, false},
+		{"tcp.PayloadLength > 0", data, true},
+		{"tcp.PayloadLength > 0", syn, false},
+		{"udp.PayloadLength == 1200", quic, true},
+		{"ip.TTL == 64 and ip.Protocol == 6", syn, true},
+		{"ipv6.HopLimit == 64", syn6, true},
+		{"ipv6.HopLimit == 64", syn, false},
+		{"ip.DstAddr=1.2.3.4 or ipv6.SrcAddr=2001:db8::2", syn, true},
+		{"ip.DstAddr=1.2.3.4 or ipv6.SrcAddr=2001:db8::2", syn6, true},
+		{"(outbound and ip.DstAddr=1.2.3.4) or (inbound and ipv6.SrcAddr=2001:db8::2)", syn6, false},
+		{"not tcp.Syn", data, true},
+		{"!tcp.Syn", syn, false},
+		{"tcp.SrcPort=6", syn, false},
+		{"true", quic, true},
+		{"false", quic, false},
+	}
+
+	for _, test := range tests {
+		f, err := parseDivertFilter(test.filter)
+		if err != nil {
+			t.Errorf("%q: %v", test.filter, err)
+			continue
+		}
+		if match := f.Match(test.packet); match != test.match {
+			sport, _ := test.packet.SrcPort()
+			t.Errorf("%q on %s:%d: got %v, want %v", test.filter, test.packet.SrcIP(), sport, match, test.match)
+		}
+	}
+
+	for _, filter := range []string{"", "tcp.DstPort ==", "(tcp.Syn", "tcp.Unknown == 1", "ip.DstAddr = x"} {
+		if _, err := parseDivertFilter(filter); err == nil {
+			t.Errorf("%q: no error", filter)
+		}
+	}
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	packets := []*Packet{
+		testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 443, TCP_SYN, nil, false),
+		testPacket(6, "1.2.3.4", 443, "10.0.0.2", 50000, TCP_SYN|TCP_ACK, nil, true),
+		testPacket(17, "2001:db8::2", 53000, "2001:db8::1", 53, 0, []byte("query"), false),
+	}
+	for i, packet := range packets {
+		packet.Addr.Timestamp = int64(i)*1500000000 + 123456789
+	}
+
+	var buf bytes.Buffer
+	if err := WritePcap(&buf, packets); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPcap(bytes.NewReader(buf.Bytes()), net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(packets) {
+		t.Fatalf("read %d packets, wrote %d", len(read), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(read[i].Raw, packets[i].Raw) {
+			t.Errorf("packet %d: raw differs", i)
+		}
+		if *read[i].Addr != *packets[i].Addr {
+			t.Errorf("packet %d: addr %+v, want %+v", i, *read[i].Addr, *packets[i].Addr)
+		}
+	}
+}
+
+func TestReadPcapEthernet(t *testing.T) {
+	packet := testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 80, TCP_SYN, nil, false)
+
+	var buf bytes.Buffer
+	head := make([]byte, 24)
+	binary.BigEndian.PutUint32(head[0:], 0xA1B2C3D4)
+	binary.BigEndian.PutUint32(head[20:], LINKTYPE_ETHERNET)
+	buf.Write(head)
+	frames := [][]byte{
+		append([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 0x08, 0x00}, packet.Raw...),
+		//802.1Q tagged
+		append([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 0x81, 0x00, 0, 5, 0x08, 0x00}, packet.Raw...),
+		//ARP, skipped
+		append([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 0x08, 0x06}, make([]byte, 28)...),
+	}
+	for _, frame := range frames {
+		record := make([]byte, 16)
+		binary.BigEndian.PutUint32(record[0:], 1)
+		binary.BigEndian.PutUint32(record[4:], 2)
+		binary.BigEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(frame)))
+		buf.Write(record)
+		buf.Write(frame)
+	}
+
+	read, err := ReadPcap(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("read %d packets, want 2", len(read))
+	}
+	for _, p := range read {
+		if !bytes.Equal(p.Raw, packet.Raw) || p.Addr.Inbound() || p.Addr.Timestamp != 1000002000 {
+			t.Errorf("got %x %+v", p.Raw, *p.Addr)
+		}
+	}
+
+	if _, err := ReadPcap(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Error("no error for a file without pcap magic")
+	}
+}
+
+func TestPacketReplay(t *testing.T) {
+	replay := NewPacketReplay()
+	defer replay.Close()
+
+	sniff, _ := replay.Open("tcp", 0, 0, DIVERT_FLAG_SNIFF)
+	handle, err := replay.Open("outbound and tcp.DstPort == 443", 0, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniffed := make(chan *Packet, 10)
+	go func() {
+		for {
+			packet, err := sniff.Recv()
+			if err != nil {
+				return
+			}
+			sniffed <- packet
+		}
+	}()
+	go func() {
+		for {
+			packet, err := handle.Recv()
+			if err != nil {
+				return
+			}
+			//re-inject with a lower TTL, as a method would
+			packet.Raw[8] = 1
+			handle.CalcChecksum(packet)
+			handle.Send(packet)
+		}
+	}()
+
+	syn := testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 443, TCP_SYN, nil, false)
+	other := testPacket(6, "10.0.0.2", 50000, "1.2.3.4", 80, TCP_SYN, nil, false)
+	if !replay.Inject(syn) {
+		t.Error("443 SYN not diverted")
+	}
+	if replay.Inject(other) {
+		t.Error("80 SYN diverted")
+	}
+
+	sent := replay.Sent()
+	if len(sent) != 1 || sent[0].Raw[8] != 1 {
+		t.Fatalf("sent %d packets", len(sent))
+	}
+	want := make([]byte, len(sent[0].Raw))
+	copy(want, sent[0].Raw)
+	layers.CalcChecksums(want)
+	if !bytes.Equal(want, sent[0].Raw) {
+		t.Error("bad checksum on the sent packet")
+	}
+	if syn.Raw[8] != 64 {
+		t.Error("the injected packet was modified")
+	}
+	if passed := replay.Passed(); len(passed) != 1 || !bytes.Equal(passed[0].Raw, other.Raw) {
+		t.Errorf("passed %d packets", len(passed))
+	}
+	if len(sniffed) != 2 {
+		t.Errorf("sniffed %d packets, want 2", len(sniffed))
+	}
+
+	replay.Reset()
+	if len(replay.Sent()) != 0 || len(replay.Passed()) != 0 {
+		t.Error("Reset kept packets")
+	}
+	handle.Close()
+	if replay.Inject(syn) {
+		t.Error("diverted to a closed handle")
+	}
+}
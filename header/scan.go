@@ -2,7 +2,6 @@ package ghostcp
 
 import (
 	"crypto/tls"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
@@ -10,7 +9,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/macronut/godivert"
+	"github.com/macronut/ghostcp/header/layers"
 )
 
 func inc(ip net.IP) {
@@ -24,40 +23,29 @@ func inc(ip net.IP) {
 
 func Scan(ipRange string, speed int) {
 	mutex.Lock()
-	winDivert, err := godivert.NewWinDivertHandle("false")
+	divert, err := OpenDiverter("false", 0, 0, 0)
 	mutex.Unlock()
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	var winDivertAddr godivert.WinDivertAddress
-
-	var packet godivert.Packet
-	winDivertAddr.Data = 1 << 4
-	packet.Addr = &winDivertAddr
-	packet.Raw = []byte{
-		0x45, 0, 0, 0,
-		0, 0, 0x40, 0,
-		byte(64), 6, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0x80, TCP_SYN, 0xFA, 0xF0,
-		0, 0, 0, 0,
-		2, 4, 0x5, 0xB4,
-		1, 3, 0x3, 0x8,
-		1, 1, 4, 0x2}
-	packet.PacketLen = uint(len(packet.Raw))
-	binary.BigEndian.PutUint16(packet.Raw[2:], uint16(packet.PacketLen))
+	var divertAddr Address
+	divertAddr.Data = 1 << 4
 
 	srcIP := getMyIPv4()
-	copy(packet.Raw[12:], srcIP)
 
-	binary.BigEndian.PutUint16(packet.Raw[20:], uint16(2))
-	binary.BigEndian.PutUint16(packet.Raw[22:], uint16(443))
+	syn := &layers.Packet{
+		IPv4: &layers.IPv4{Flags: layers.IPv4DontFragment, TTL: 64, Src: srcIP},
+		TCP: &layers.TCP{
+			SrcPort: 2,
+			DstPort: 443,
+			Flags:   TCP_SYN,
+			Window:  0xFAF0,
+			Options: []byte{2, 4, 0x5, 0xB4, 1, 3, 0x3, 0x8, 1, 1, 4, 0x2},
+		},
+	}
+	rawbuf := make([]byte, syn.Len())
 
 	fmt.Println("Start scanning", ipRange, "from", srcIP)
 
@@ -73,11 +61,10 @@ func Scan(ipRange string, speed int) {
 	for iptmp := ip.Mask(ipNet.Mask); ipNet.Contains(iptmp); inc(iptmp) {
 		ip4 := iptmp.To4()
 		if ip4 != nil {
-			copy(packet.Raw[16:], ip4)
-			packet.CalcNewChecksum(winDivert)
-			_, err := winDivert.Send(&packet)
+			syn.IPv4.Dst = ip4
+			err := sendLayers(divert, &divertAddr, syn, rawbuf, true)
 			if err != nil {
-				log.Println(err, packet)
+				log.Println(err, ip4)
 			}
 		}
 		i++
@@ -103,7 +90,7 @@ func CheckServer(URL string, ip net.IP, timeout uint) {
 
 	c, ok := domainLookup(u.Host)
 	if ok {
-		IPMap[ip.String()] = IPConfig{c.Option, c.TTL, c.MAXTTL, c.MSS}
+		Rules.SetIP(ip.String(), IPConfig{c.Option, c.TTL, c.MAXTTL, c.MSS})
 		time.Sleep(time.Millisecond)
 	}
 
@@ -0,0 +1,338 @@
+package ghostcp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// RuleStore holds the domain and IP rules together with what the daemons
+// learn at run time: the IPs resolved for configured domains, the IPs that
+// failed detection and the TCP Fast Open cookies. DNS, TCP and UDP
+// goroutines read and write it concurrently.
+//
+// IPs learned from DNS answers are kept apart from the static rules of
+// default.conf: they expire with the TTL of the answer and the least recently
+// used ones are dropped once the ip-limit of the config is reached. Static
+// rules never expire.
+type RuleStore struct {
+	mutex    sync.RWMutex
+	domains  map[string]Config
+	names    domainTree
+	ips      map[string]IPConfig
+	cidrs    ipTree
+	badIPs   map[string]bool
+	cookies  map[string][]byte
+	settings ruleSettings
+
+	learnMutex sync.Mutex
+	learned    map[string]*list.Element
+	lru        *list.List
+}
+
+type learnedIP struct {
+	addr   string
+	config IPConfig
+	domain string
+	expire time.Time
+}
+
+// ruleSettings are the settings of a config the lookups depend on. They are
+// swapped in together with its rules.
+type ruleSettings struct {
+	defaultConfig  *Config
+	ipBlock        bool
+	dnsRace        bool
+	subdomainDepth int
+	learnLimit     int
+}
+
+var Rules = NewRuleStore()
+
+// LearnMinTTL is the shortest time a learned IP is kept whatever the TTL of
+// its answer.
+var LearnMinTTL = 5 * time.Minute
+var LearnExpireInterval = time.Minute
+
+func NewRuleStore() *RuleStore {
+	return &RuleStore{
+		domains:  make(map[string]Config),
+		ips:      make(map[string]IPConfig),
+		badIPs:   make(map[string]bool),
+		cookies:  make(map[string][]byte),
+		learned:  make(map[string]*list.Element),
+		lru:      list.New(),
+		settings: ruleSettings{subdomainDepth: 2, learnLimit: 10000},
+	}
+}
+
+// Settings returns the settings of the config the rules come from.
+func (s *RuleStore) Settings() ruleSettings {
+	s.mutex.RLock()
+	settings := s.settings
+	s.mutex.RUnlock()
+	return settings
+}
+
+func (s *RuleStore) Domain(name string) (Config, bool) {
+	s.mutex.RLock()
+	config, ok := s.domains[name]
+	s.mutex.RUnlock()
+	return config, ok
+}
+
+func (s *RuleStore) SetDomain(name string, config Config) {
+	s.mutex.Lock()
+	s.domains[name] = config
+	s.names.insert(name, config)
+	s.mutex.Unlock()
+}
+
+// MatchDomain returns the rule of the longest suffix of name that has one
+// and the name of the rule. If name is excluded by a !domain rule it
+// returns the name of that rule and false.
+func (s *RuleStore) MatchDomain(name string) (Config, string, bool) {
+	config, rule, ok, _ := s.matchDomain(name)
+	return config, rule, ok
+}
+
+// matchDomain is MatchDomain that also returns the settings the rules were
+// loaded with.
+func (s *RuleStore) matchDomain(name string) (Config, string, bool, ruleSettings) {
+	s.mutex.RLock()
+	config, rule, ok := s.names.match(name)
+	settings := s.settings
+	s.mutex.RUnlock()
+	return config, rule, ok, settings
+}
+
+// IP looks up an address or a CIDR string in the static rules, then in the
+// learned IPs.
+func (s *RuleStore) IP(addr string) (IPConfig, bool) {
+	s.mutex.RLock()
+	config, ok := s.ips[addr]
+	s.mutex.RUnlock()
+	if ok {
+		return config, true
+	}
+
+	s.learnMutex.Lock()
+	defer s.learnMutex.Unlock()
+	e, ok := s.learned[addr]
+	if !ok {
+		return config, false
+	}
+	entry := e.Value.(*learnedIP)
+	if time.Now().After(entry.expire) {
+		s.lru.Remove(e)
+		delete(s.learned, addr)
+		return config, false
+	}
+	s.lru.MoveToFront(e)
+	return entry.config, true
+}
+
+func (s *RuleStore) SetIP(addr string, config IPConfig) {
+	s.mutex.Lock()
+	s.ips[addr] = config
+	s.mutex.Unlock()
+}
+
+// SetCIDR adds a CIDR rule. It can still be looked up by IP with its
+// ipnet.String() form.
+func (s *RuleStore) SetCIDR(ipnet *net.IPNet, config IPConfig) {
+	s.mutex.Lock()
+	s.ips[ipnet.String()] = config
+	s.cidrs.insert(ipnet, config)
+	s.mutex.Unlock()
+}
+
+// CIDR returns the rule of the longest CIDR prefix containing ip.
+func (s *RuleStore) CIDR(ip net.IP) (IPConfig, bool) {
+	s.mutex.RLock()
+	config, ok := s.cidrs.lookup(ip)
+	s.mutex.RUnlock()
+	return config, ok
+}
+
+// LearnIP stores config for an IP resolved from domain. The entry expires
+// after ttl, or LearnMinTTL if that is longer.
+func (s *RuleStore) LearnIP(addr string, config IPConfig, domain string, ttl time.Duration) {
+	if ttl < LearnMinTTL {
+		ttl = LearnMinTTL
+	}
+	expire := time.Now().Add(ttl)
+	limit := s.Settings().learnLimit
+
+	s.learnMutex.Lock()
+	defer s.learnMutex.Unlock()
+	e, ok := s.learned[addr]
+	if ok {
+		entry := e.Value.(*learnedIP)
+		entry.config = config
+		entry.domain = domain
+		entry.expire = expire
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.learned[addr] = s.lru.PushFront(&learnedIP{addr, config, domain, expire})
+	for limit > 0 && s.lru.Len() > limit {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.learned, oldest.Value.(*learnedIP).addr)
+	}
+}
+
+// RefreshIP extends a learned IP resolved again from domain and reports
+// whether there was one.
+func (s *RuleStore) RefreshIP(addr string, domain string, ttl time.Duration) bool {
+	if ttl < LearnMinTTL {
+		ttl = LearnMinTTL
+	}
+
+	s.learnMutex.Lock()
+	defer s.learnMutex.Unlock()
+	e, ok := s.learned[addr]
+	if !ok {
+		return false
+	}
+	entry := e.Value.(*learnedIP)
+	entry.domain = domain
+	entry.expire = time.Now().Add(ttl)
+	s.lru.MoveToFront(e)
+	return true
+}
+
+// Expire drops the learned IPs that expired before now and returns how many
+// were dropped.
+func (s *RuleStore) Expire(now time.Time) int {
+	s.learnMutex.Lock()
+	defer s.learnMutex.Unlock()
+	count := 0
+	for e := s.lru.Back(); e != nil; {
+		prev := e.Prev()
+		entry := e.Value.(*learnedIP)
+		if now.After(entry.expire) {
+			logPrintln(4, "expire", entry.addr, entry.domain)
+			s.lru.Remove(e)
+			delete(s.learned, entry.addr)
+			count++
+		}
+		e = prev
+	}
+	return count
+}
+
+// Swap replaces the static rules and the settings with those of n, in one
+// step for the readers. Learned IPs, bad IPs and cookies are kept.
+func (s *RuleStore) Swap(n *RuleStore) {
+	n.mutex.RLock()
+	domains, names, ips, cidrs, settings := n.domains, n.names, n.ips, n.cidrs, n.settings
+	n.mutex.RUnlock()
+
+	s.mutex.Lock()
+	s.domains = domains
+	s.names = names
+	s.ips = ips
+	s.cidrs = cidrs
+	s.settings = settings
+	s.mutex.Unlock()
+}
+
+// Relearn updates the config of every learned IP with lookup, which gets
+// the address and the domain it was resolved from. The IPs lookup returns
+// false for are dropped and counted.
+func (s *RuleStore) Relearn(lookup func(addr string, domain string) (IPConfig, bool)) int {
+	s.learnMutex.Lock()
+	entries := make([]learnedIP, 0, s.lru.Len())
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		entries = append(entries, *e.Value.(*learnedIP))
+	}
+	s.learnMutex.Unlock()
+
+	//lookup may read the store, so it runs unlocked
+	configs := make([]IPConfig, len(entries))
+	found := make([]bool, len(entries))
+	for i, entry := range entries {
+		configs[i], found[i] = lookup(entry.addr, entry.domain)
+	}
+
+	s.learnMutex.Lock()
+	defer s.learnMutex.Unlock()
+	count := 0
+	for i, entry := range entries {
+		e, ok := s.learned[entry.addr]
+		if !ok {
+			continue
+		}
+		if found[i] {
+			e.Value.(*learnedIP).config = configs[i]
+		} else {
+			s.lru.Remove(e)
+			delete(s.learned, entry.addr)
+			count++
+		}
+	}
+	return count
+}
+
+var expireOnce sync.Once
+
+// startExpiry runs Expire on the current Rules and on DNSCache every
+// LearnExpireInterval, and logs the counters of DNSCache when they changed.
+func startExpiry() {
+	expireOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(LearnExpireInterval)
+			defer ticker.Stop()
+			var queries uint64
+			for now := range ticker.C {
+				count := Rules.Expire(now)
+				if count > 0 {
+					logPrintln(3, count, "learned IPs expired")
+				}
+				count = DNSCache.Expire(now)
+				if count > 0 {
+					logPrintln(3, count, "DNS answers expired")
+				}
+				hits, stale, misses, shared := DNSCache.Stats()
+				if hits+stale+misses+shared != queries {
+					queries = hits + stale + misses + shared
+					logPrintln(2, "DNS cache hits", hits, "stale", stale, "misses", misses, "shared", shared)
+				}
+			}
+		}()
+	})
+}
+
+func (s *RuleStore) BadIP(addr string) bool {
+	s.mutex.RLock()
+	bad := s.badIPs[addr]
+	s.mutex.RUnlock()
+	return bad
+}
+
+func (s *RuleStore) SetBadIP(addr string) {
+	s.mutex.Lock()
+	s.badIPs[addr] = true
+	s.mutex.Unlock()
+}
+
+// Cookies returns the TCP Fast Open cookie received from addr, if any.
+func (s *RuleStore) Cookies(addr string) []byte {
+	s.mutex.RLock()
+	cookies := s.cookies[addr]
+	s.mutex.RUnlock()
+	return cookies
+}
+
+// SetCookies stores a copy of cookies.
+func (s *RuleStore) SetCookies(addr string, cookies []byte) {
+	tmp_cookies := make([]byte, len(cookies))
+	copy(tmp_cookies, cookies)
+	s.mutex.Lock()
+	s.cookies[addr] = tmp_cookies
+	s.mutex.Unlock()
+}
@@ -0,0 +1,142 @@
+package ghostcp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRuleStoreLearn(t *testing.T) {
+	s := NewRuleStore()
+	s.settings.learnLimit = 3
+	s.SetIP("1.1.1.1", IPConfig{OPT_TTL, 5, 0, 0})
+
+	for i := 1; i <= 4; i++ {
+		s.LearnIP(fmt.Sprintf("2.2.2.%d", i), IPConfig{OPT_WMD5, 0, 0, 0}, "example.com", time.Hour)
+		if i == 2 {
+			//used, so 2.2.2.2 is the least recently used one
+			s.IP("2.2.2.1")
+		}
+	}
+	for i, want := range []bool{true, false, true, true} {
+		addr := fmt.Sprintf("2.2.2.%d", i+1)
+		if _, ok := s.IP(addr); ok != want {
+			t.Errorf("%s: learned %v, want %v", addr, ok, want)
+		}
+	}
+
+	//static rules win over learned IPs
+	s.settings.learnLimit = 10
+	s.LearnIP("1.1.1.1", IPConfig{OPT_WMD5, 0, 0, 0}, "example.com", time.Hour)
+	if config, _ := s.IP("1.1.1.1"); config.Option != OPT_TTL {
+		t.Errorf("static rule replaced by %+v", config)
+	}
+
+	if !s.RefreshIP("2.2.2.3", "example.com", 2*time.Hour) || s.RefreshIP("3.3.3.3", "example.com", time.Hour) {
+		t.Error("RefreshIP")
+	}
+	//2.2.2.1, 2.2.2.4 and the learned 1.1.1.1
+	if count := s.Expire(time.Now().Add(90 * time.Minute)); count != 3 {
+		t.Errorf("expired %d, want 3", count)
+	}
+
+	count := s.Relearn(func(addr string, domain string) (IPConfig, bool) {
+		return IPConfig{OPT_BAD, 0, 0, 0}, addr != "2.2.2.3"
+	})
+	if _, ok := s.IP("2.2.2.3"); count != 1 || ok {
+		t.Errorf("relearn dropped %d", count)
+	}
+}
+
+// TestRuleStoreConcurrent runs the store accesses of DNSDaemon, TCPDaemon,
+// TCPRecv and the expiry while the config is reloaded, for go test -race.
+// Each lookup must see the rules and the settings of one of the configs.
+func TestRuleStoreConcurrent(t *testing.T) {
+	write := testConfig(t)
+	configs := []string{
+		"ip-limit=50\nmethod=ttl\nwww.example.com\n1.1.1.1\n",
+		"ip-limit=50\nmethod=w-md5\n*\nwww.example.com\n10.0.0.0/8\n",
+	}
+	write(configs[0])
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 100)
+	loop := func(f func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := f(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for g := 0; g < 4; g++ {
+		g := g
+		//DNSDaemon
+		loop(func(i int) error {
+			config, ok := domainLookup("www.example.com")
+			if !ok || config.Option != OPT_TTL && config.Option != OPT_WMD5 {
+				return fmt.Errorf("www.example.com: %+v %v", config, ok)
+			}
+			//only the second config has a * rule
+			other, ok := domainLookup(fmt.Sprintf("host%d.example.org", i%10))
+			if ok && other.Option != OPT_WMD5 {
+				return fmt.Errorf("example.org: %+v", other)
+			}
+			learnIPs("www.example.com", []string{fmt.Sprintf("10.%d.%d.1", g, i%200)}, 60, config)
+			return nil
+		})
+		//TCPDaemon and TCPRecv
+		loop(func(i int) error {
+			addr := fmt.Sprintf("10.%d.%d.1", g, i%200)
+			IPLookup(addr)
+			IPLookup("1.1.1.1")
+			if i%50 == 0 {
+				Rules.SetBadIP(addr)
+				Rules.SetCookies(addr, []byte{1, 2, 3, 4})
+			}
+			Rules.BadIP(addr)
+			Rules.Cookies(addr)
+			return nil
+		})
+	}
+	loop(func(i int) error {
+		Rules.Expire(time.Now().Add(time.Duration(i%3) * time.Hour))
+		return nil
+	})
+
+	for i := 0; i < 20; i++ {
+		write(configs[i%2])
+		if err := ReloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	Rules.learnMutex.Lock()
+	learned := Rules.lru.Len()
+	Rules.learnMutex.Unlock()
+	if learned > 50 {
+		t.Errorf("%d learned IPs, ip-limit=50", learned)
+	}
+}
@@ -0,0 +1,178 @@
+package ghostcp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// subscription is a rule list downloaded from url every interval. The last
+// download is kept in cache, next to the config file, and read like a
+// list=format:cache line.
+type subscription struct {
+	url      string
+	format   string
+	cache    string
+	interval time.Duration
+}
+
+var SubscribeInterval = 24 * time.Hour
+var SubscribeRetryInterval = 10 * time.Minute
+var SubscribeTimeout = 30 * time.Second
+
+var subscriptions = make(map[subscription]chan struct{})
+
+// parseSubscription reads the value of a subscribe= line in file:
+// [format:]url [interval=24h]. The format is plain if it is left out.
+func parseSubscription(value string, file string) (subscription, error) {
+	s := subscription{format: "plain", interval: SubscribeInterval}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return s, errors.New("subscribe needs a URL")
+	}
+
+	s.url = fields[0]
+	keys := strings.SplitN(s.url, ":", 2)
+	if _, ok := listFormats[keys[0]]; ok && len(keys) == 2 {
+		s.format = keys[0]
+		s.url = keys[1]
+	}
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return s, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return s, errors.New("subscribe needs an http or https URL, not " + s.url)
+	}
+
+	for _, option := range fields[1:] {
+		keys := strings.SplitN(option, "=", 2)
+		if len(keys) < 2 || keys[0] != "interval" {
+			return s, errors.New("unknown subscribe option " + option)
+		}
+		s.interval, err = time.ParseDuration(keys[1])
+		if err != nil {
+			return s, err
+		}
+		if s.interval < time.Minute {
+			return s, errors.New("subscribe interval must be at least 1m")
+		}
+	}
+
+	sum := sha1.Sum([]byte(s.format + ":" + s.url))
+	s.cache = filepath.Join(filepath.Dir(file), "subscribe-"+hex.EncodeToString(sum[:8])+".txt")
+	return s, nil
+}
+
+// subscribe reads the cached copy of the list of a subscribe= line. The
+// line is kept ahead of the list for the loader to start the download.
+func (r *includeReader) subscribe(line ConfigLine) ([]ConfigLine, error) {
+	if len(line.Keys) < 2 {
+		return nil, errors.New("subscribe needs a URL")
+	}
+	s, err := parseSubscription(line.Keys[1], line.File)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []ConfigLine{line}
+	if _, err := os.Stat(s.cache); err != nil {
+		logPrintln(2, s.url, "not downloaded yet")
+		return lines, nil
+	}
+	listed, err := r.readList(line, listFormats[s.format], s.cache)
+	if err != nil {
+		return nil, err
+	}
+	return append(lines, listed...), nil
+}
+
+// fetch downloads the list into the cache.
+func (s subscription) fetch() error {
+	client := &http.Client{Timeout: SubscribeTimeout}
+	resp, err := client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+
+	tmp := s.cache + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cache)
+}
+
+// run downloads the list when the cache is older than the interval and
+// reloads the config. If a download fails the cache stays in use and it is
+// tried again after SubscribeRetryInterval.
+func (s subscription) run(stop chan struct{}) {
+	failed := false
+	for {
+		wait := time.Duration(0)
+		info, err := os.Stat(s.cache)
+		if err == nil {
+			wait = s.interval - time.Since(info.ModTime())
+		}
+		if failed && wait < SubscribeRetryInterval {
+			wait = SubscribeRetryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err = s.fetch()
+		if err != nil {
+			logPrintln(1, "subscribe", s.url, err)
+			failed = true
+			continue
+		}
+		failed = false
+		logPrintln(1, "subscribe", s.url, "downloaded")
+		ReloadConfig()
+	}
+}
+
+func updateSubscriptions(subs []subscription) {
+	running := make(map[subscription]chan struct{})
+	for _, s := range subs {
+		if _, ok := running[s]; ok {
+			continue
+		}
+		stop, ok := subscriptions[s]
+		if !ok {
+			stop = make(chan struct{})
+			go s.run(stop)
+		}
+		running[s] = stop
+	}
+
+	for s, stop := range subscriptions {
+		if _, ok := running[s]; !ok {
+			close(stop)
+		}
+	}
+
+	subscriptions = running
+}
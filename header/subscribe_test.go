@@ -0,0 +1,113 @@
+package ghostcp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// stopSubscriptions stops the downloads started by the config, once the
+// reload in progress is done.
+func stopSubscriptions() {
+	reloadMutex.Lock()
+	updateSubscriptions(nil)
+	reloadMutex.Unlock()
+}
+
+// waitDomain waits until domain has a rule in Rules.
+func waitDomain(t *testing.T, domain string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, ok := Rules.MatchDomain(domain); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(domain, "has no rule")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sub.example\n!no.sub.example\n"))
+	}))
+	defer server.Close()
+
+	write := testConfig(t)
+	write("method=ttl\nlocal.example\nsubscribe=plain:" + server.URL + "/list.txt\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopSubscriptions()
+
+	//downloaded, the list is merged with the rules of the config
+	waitDomain(t, "www.sub.example")
+	if _, _, ok := Rules.MatchDomain("local.example"); !ok {
+		t.Error("the rules of the config were dropped")
+	}
+	if _, rule, ok := Rules.MatchDomain("no.sub.example"); ok || rule == "" {
+		t.Error("no.sub.example not excluded")
+	}
+
+	s, err := parseSubscription("plain:"+server.URL+"/list.txt", ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(s.cache); err != nil || string(data) != "sub.example\n!no.sub.example\n" {
+		t.Errorf("cache %q %v", data, err)
+	}
+}
+
+func TestSubscribeFailure(t *testing.T) {
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	write := testConfig(t)
+	value := "plain:" + server.URL + "/list.txt"
+	s, err := parseSubscription(value, ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.fetch(); err == nil {
+		t.Fatal("no error for a 500")
+	}
+	<-requests
+
+	//an old cache is downloaded again, and kept when that fails
+	if err := ioutil.WriteFile(s.cache, []byte("cached.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(s.cache, old, old)
+
+	write("method=ttl\nsubscribe=" + value + "\n")
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopSubscriptions()
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no download")
+	}
+	stopSubscriptions()
+
+	if _, _, ok := Rules.MatchDomain("cached.example"); !ok {
+		t.Error("the cached list is not in use")
+	}
+	if data, err := ioutil.ReadFile(s.cache); err != nil || string(data) != "cached.example\n" {
+		t.Errorf("cache %q %v", data, err)
+	}
+	if _, err := os.Stat(s.cache + ".tmp"); err == nil {
+		t.Error("temporary file left")
+	}
+}
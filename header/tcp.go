@@ -9,7 +9,7 @@ import (
 	"net"
 	"time"
 
-	"github.com/macronut/godivert"
+	"github.com/macronut/ghostcp/header/layers"
 )
 
 type ConnInfo struct {
@@ -19,9 +19,6 @@ type ConnInfo struct {
 	MAXTTL byte
 }
 
-var PortList4 [65536]*ConnInfo
-var PortList6 [65536]*ConnInfo
-var CookiesMap map[string][]byte
 var SynOption []byte
 
 const (
@@ -43,23 +40,8 @@ const (
 )
 
 func getCookies(option []byte) []byte {
-	optOff := 0
-	for {
-		if optOff >= len(option) {
-			return nil
-		}
-
-		if option[optOff] == 1 {
-			optOff++
-		} else if option[optOff] == 34 {
-			optLen := int(option[optOff+1])
-			return option[optOff+2 : optOff+optLen]
-		} else {
-			optOff += int(option[optOff+1])
-		}
-	}
-
-	return nil
+	tcp := layers.TCP{Options: option}
+	return tcp.Option(layers.TCPOptionFastOpen)
 }
 
 func TCPRecv(address string, forward bool) {
@@ -115,7 +97,7 @@ func TCPRecv(address string, forward bool) {
 	filter += ")"
 
 	mutex.Lock()
-	winDivert, err := godivert.WinDivertOpen(filter, layer, 1, 0)
+	divert, err := OpenDiverter(filter, layer, 1, 0)
 	mutex.Unlock()
 
 	if err != nil {
@@ -126,29 +108,38 @@ func TCPRecv(address string, forward bool) {
 	}
 
 	go func() {
-		defer winDivert.Close()
+		defer divert.Close()
+
+		rawbuf := make([]byte, 1500)
 
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
+				if err == ErrDiverterClosed {
+					return
+				}
 				if LogLevel > 0 {
 					log.Println(err)
 				}
 				continue
 			}
 
-			ipv6 := packet.Raw[0]>>4 == 6
-			var ipheadlen int
-			if ipv6 {
-				ipheadlen = 40
-			} else {
-				ipheadlen = int(packet.Raw[0]&0xF) * 4
+			p, err := packet.Layers()
+			if err != nil || p.TCP == nil {
+				_, err = divert.Send(packet)
+				if err != nil {
+					if LogLevel > 0 {
+						log.Println(err)
+					}
+				}
+				continue
 			}
+			ipv6 := p.IsIPv6()
 
 			if forward && !ipv6 {
 				lanAddr := [4]byte{192, 168, 137, 0}
-				if bytes.Compare(packet.Raw[16:19], lanAddr[:3]) == 0 {
-					_, err = winDivert.Send(packet)
+				if bytes.Compare(p.Dst()[:3], lanAddr[:3]) == 0 {
+					_, err = divert.Send(packet)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -158,35 +149,28 @@ func TCPRecv(address string, forward bool) {
 				}
 			}
 
-			dstPort := binary.BigEndian.Uint16(packet.Raw[ipheadlen+2:])
+			dstPort := p.TCP.DstPort
 
-			if packet.Raw[ipheadlen+13] == TCP_SYN|TCP_ACK {
+			if p.TCP.Flags == TCP_SYN|TCP_ACK {
 				switch dstPort {
 				case 1:
-					BadIPMap[packet.SrcIP().String()] = true
+					Rules.SetBadIP(p.Src().String())
 					continue
 				case 2:
 					goodIP := packet.SrcIP()
-					_, ok := IPMap[goodIP.String()]
+					_, ok := Rules.IP(goodIP.String())
 					if ok {
 						continue
 					}
 
-					myIP := packet.DstIP()
-					packet.SetSrcIP(myIP)
-					packet.SetDstIP(goodIP)
-					srcPort := binary.BigEndian.Uint16(packet.Raw[ipheadlen:])
-					packet.SetSrcPort(dstPort)
-					packet.SetDstPort(srcPort)
-					seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4:])
-					ackNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+8:])
-					binary.BigEndian.PutUint32(packet.Raw[ipheadlen+4:], ackNum)
-					binary.BigEndian.PutUint32(packet.Raw[ipheadlen+8:], seqNum+1)
-					packet.Raw[ipheadlen+13] = TCP_RST | TCP_ACK
+					rst := p.Clone()
+					rst.Reverse()
+					rst.TCP.Seq = p.TCP.Ack
+					rst.TCP.Ack = p.TCP.Seq + 1
+					rst.TCP.Flags = TCP_RST | TCP_ACK
 					packet.Addr.Data = 1 << 4
 
-					packet.CalcNewChecksum(winDivert)
-					_, err := winDivert.Send(packet)
+					err := sendLayers(divert, packet.Addr, rst, rawbuf, true)
 					if err != nil {
 						log.Println(err)
 					}
@@ -198,64 +182,52 @@ func TCPRecv(address string, forward bool) {
 					}
 					continue
 				case 3:
-					tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-					optStart := ipheadlen + 20
-					option := packet.Raw[optStart : ipheadlen+tcpheadlen]
-					cookies := getCookies(option)
+					cookies := getCookies(p.TCP.Options)
 					if cookies != nil {
-						tmp_cookies := make([]byte, len(cookies))
-						copy(tmp_cookies, cookies)
-						CookiesMap[packet.SrcIP().String()] = tmp_cookies
+						Rules.SetCookies(p.Src().String(), cookies)
 					}
 					continue
 				default:
-					var info *ConnInfo
-					if ipv6 {
-						info = PortList6[dstPort]
-					} else {
-						info = PortList4[dstPort]
+					key := replyConnKey(p)
+					info, _ := Conns.Lookup(key)
+					if info != nil {
+						Conns.SetState(key, CONN_ESTABLISHED)
 					}
 
 					if info != nil && info.Option&OPT_TFO != 0 {
-						tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-						optStart := ipheadlen + 20
-						option := packet.Raw[optStart : ipheadlen+tcpheadlen]
-						cookies := getCookies(option)
+						cookies := getCookies(p.TCP.Options)
 						if cookies != nil {
-							tmp_cookies := make([]byte, len(cookies))
-							copy(tmp_cookies, cookies)
-							CookiesMap[packet.SrcIP().String()] = tmp_cookies
+							Rules.SetCookies(p.Src().String(), cookies)
 							continue
-						} else {
-							ackNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+8:])
-							ackNum = info.SeqNum + 1
-							binary.BigEndian.PutUint32(packet.Raw[ipheadlen+8:], ackNum)
-							packet.CalcNewChecksum(winDivert)
 						}
+
+						p.TCP.Ack = info.SeqNum + 1
+						err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+						if err != nil {
+							if LogLevel > 0 {
+								log.Println(err)
+							}
+						}
+						continue
 					}
 				}
-			} else if packet.Raw[ipheadlen+13]|TCP_RST != 0 {
+			} else if p.TCP.Flags&TCP_RST != 0 {
 				if DetectEnable {
-					dstPort, _ := packet.DstPort()
 					if dstPort == 1 {
-						BadIPMap[packet.SrcIP().String()] = true
+						Rules.SetBadIP(p.Src().String())
 						continue
 					}
 				}
 
-				var info *ConnInfo
-				if ipv6 {
-					info = PortList6[dstPort]
-				} else {
-					info = PortList4[dstPort]
-				}
-
-				if info != nil && info.Option&OPT_NORST != 0 {
+				key := replyConnKey(p)
+				info, state := Conns.Lookup(key)
+				if info != nil && info.Option&OPT_NORST != 0 && state != CONN_CLOSED {
 					continue
 				}
+				Conns.SetState(key, CONN_CLOSED)
 			}
 
-			_, err = winDivert.Send(packet)
+			_, err = divert.Send(packet)
 			if err != nil {
 				if LogLevel > 0 {
 					log.Println(err)
@@ -267,200 +239,142 @@ func TCPRecv(address string, forward bool) {
 
 const domainBytes = "abcdefghijklmnopqrstuvwxyz0123456789-"
 
-func SendFakePacket(winDivert *godivert.WinDivertHandle, info *ConnInfo, packet *godivert.Packet, host_offset int, host_length int, count int) (int, error) {
-	rawbuf := make([]byte, 1500)
+var md5Option = []byte{layers.TCPOptionMD5, 18, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+var ipOption = []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0}
 
-	ipv6 := packet.Raw[0]>>4 == 6
-	var ipheadlen int
-	if ipv6 {
-		ipheadlen = 40
-	} else {
-		ipheadlen = int(packet.Raw[0]&0xF) * 4
-	}
-
-	tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-
-	fake_packet := *packet
-	copy(rawbuf, packet.Raw)
+func SendFakePacket(divert PacketDiverter, info *ConnInfo, addr *Address, p *layers.Packet, host_offset int, host_length int, count int) (int, error) {
+	rawbuf := make([]byte, 1500)
 
-	total_host_offset := ipheadlen + tcpheadlen + host_offset
+	fake := p.Clone()
+	payload := fake.Payload
 	if host_length == 1 { //DNS
-		dot := int(rawbuf[total_host_offset] + 1)
-		for i := 1; i < int(packet.PacketLen); i++ {
+		dot := int(payload[host_offset]) + 1
+		for i := 1; host_offset+i < len(payload); i++ {
 			if i == dot {
-				off := rawbuf[i+total_host_offset]
+				off := payload[host_offset+i]
 				if off == 0 {
 					host_length = i
 					break
 				}
 				dot += int(off) + 1
 			} else {
-				rawbuf[i+total_host_offset] = domainBytes[rand.Intn(len(domainBytes))]
+				payload[host_offset+i] = domainBytes[rand.Intn(len(domainBytes))]
 			}
 		}
 	} else {
-		for i := total_host_offset; i < total_host_offset+host_length-3; i++ {
-			if rawbuf[i] != '.' {
-				rawbuf[i] = domainBytes[rand.Intn(len(domainBytes))]
+		for i := host_offset; i < host_offset+host_length-3; i++ {
+			if payload[i] != '.' {
+				payload[i] = domainBytes[rand.Intn(len(domainBytes))]
 			}
 		}
 	}
 
-	var err error
-
-	if (info.Option & OPT_WCSUM) != 0 {
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
+	send := func(f *layers.Packet, checksum bool, count int) error {
+		fake_packet := Packet{Addr: addr}
+		fake_packet.Raw = f.Serialize(rawbuf, checksum)
+		fake_packet.PacketLen = uint(len(fake_packet.Raw))
 		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
+			_, err := divert.Send(&fake_packet)
 			if err != nil {
-				return 0, err
+				return err
 			}
 		}
+		return nil
 	}
 
-	if (info.Option & OPT_TTL) > 0 {
-		if ipv6 {
-			rawbuf[7] = byte(info.TTL)
-		} else {
-			rawbuf[8] = byte(info.TTL)
-		}
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
+	//OPT_SEQ shifts whichever fake was sent last
+	last := fake
 
-		fake_packet.CalcNewChecksum(winDivert)
-
-		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
-			if err != nil {
-				return 0, err
-			}
+	if (info.Option & OPT_WCSUM) != 0 {
+		err := send(fake, false, count)
+		if err != nil {
+			return 0, err
 		}
 	}
 
-	if (info.Option & OPT_WACK) != 0 {
-		copy(rawbuf, packet.Raw[:ipheadlen+tcpheadlen])
-		ackNum := binary.BigEndian.Uint32(rawbuf[ipheadlen+8:])
-		ackNum += uint32(binary.BigEndian.Uint16(rawbuf[ipheadlen+14:]))
-		binary.BigEndian.PutUint32(rawbuf[ipheadlen+8:], ackNum)
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
-		fake_packet.CalcNewChecksum(winDivert)
-
-		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
-			if err != nil {
-				return 0, err
-			}
+	if (info.Option & OPT_TTL) > 0 {
+		f := fake.Clone()
+		f.SetTTL(info.TTL)
+		err := send(f, true, count)
+		if err != nil {
+			return 0, err
 		}
+		last = f
 	}
 
-	if (info.Option & OPT_IPOPT) != 0 {
-		copy(rawbuf, packet.Raw[:ipheadlen+tcpheadlen])
-		fakeipheadlen := ipheadlen + 32
-		copy(rawbuf[fakeipheadlen:], packet.Raw[ipheadlen:ipheadlen+tcpheadlen])
-		if ipv6 {
-		} else {
-			rawbuf[0] = rawbuf[0]&0xF0 | byte(fakeipheadlen/4)
-		}
-		for i := 0; i < 31; i++ {
-			rawbuf[ipheadlen+i] = 1
+	if (info.Option & OPT_WACK) != 0 {
+		f := fake.Clone()
+		f.TCP.Ack += uint32(f.TCP.Window)
+		err := send(f, true, count)
+		if err != nil {
+			return 0, err
 		}
-		rawbuf[ipheadlen+31] = 0
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
-		fake_packet.CalcNewChecksum(winDivert)
+		last = f
+	}
 
-		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
-			if err != nil {
-				return 0, err
-			}
+	if (info.Option&OPT_IPOPT) != 0 && fake.IPv4 != nil {
+		f := fake.Clone()
+		f.IPv4.Options = ipOption
+		err := send(f, true, count)
+		if err != nil {
+			return 0, err
 		}
+		last = f
 	}
 
 	if (info.Option & OPT_BAD) != 0 {
-		copy(rawbuf, packet.Raw[:ipheadlen+tcpheadlen])
-		rawbuf[ipheadlen+12] = 4 << 4
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
-		fake_packet.CalcNewChecksum(winDivert)
-
-		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
-			if err != nil {
-				return 0, err
-			}
+		f := fake.Clone()
+		f.TCP.DataOffset = 4
+		err := send(f, true, count)
+		if err != nil {
+			return 0, err
 		}
+		last = f
 	}
 
 	if info.Option&OPT_SEQ != 0 {
-		seqNum := binary.BigEndian.Uint32(rawbuf[ipheadlen+4:])
-		seqNum -= 32767
-		binary.BigEndian.PutUint32(rawbuf[ipheadlen+4:], seqNum)
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
-		fake_packet.CalcNewChecksum(winDivert)
-		_, err = winDivert.Send(&fake_packet)
+		f := last.Clone()
+		f.TCP.Seq -= 32767
+		err := send(f, true, 1)
 		if err != nil {
 			return 0, err
 		}
 	}
 
 	if (info.Option & OPT_WMD5) != 0 {
-		copy(rawbuf, packet.Raw[:ipheadlen+tcpheadlen])
-		copy(rawbuf[ipheadlen+20:], []byte{19, 18, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
-		rawbuf[ipheadlen+12] = 10 << 4
-		copy(rawbuf[ipheadlen+40:], rawbuf[ipheadlen+tcpheadlen:len(packet.Raw)])
-		fake_packet.Raw = rawbuf[:len(packet.Raw)]
-
-		fake_packet.CalcNewChecksum(winDivert)
-
-		for i := 0; i < count; i++ {
-			_, err = winDivert.Send(&fake_packet)
-			if err != nil {
-				return 0, err
-			}
+		f := fake.Clone()
+		f.TCP.Options = md5Option
+		err := send(f, true, count)
+		if err != nil {
+			return 0, err
 		}
 	}
 
 	return host_length, nil
 }
 
-func TCPDetection(winDivert *godivert.WinDivertHandle, winDivertAddr godivert.WinDivertAddress, srcIP []byte, ips []string, port, ttl int) []string {
-	var packet godivert.Packet
-	packet.PacketLen = 40
-	winDivertAddr.Data = 1 << 4
-	packet.Addr = &winDivertAddr
-	packet.Raw = []byte{
-		0x45, 0, 0, 40,
-		0, 0, 0x40, 0,
-		byte(ttl), 6, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0, 1, 0, 0,
-		0, 0, 0, 0,
-		0, 0, 0, 0,
-		0x50, TCP_SYN, 0, 0,
-		0, 0, 0, 0}
-
-	if srcIP != nil {
-		copy(packet.Raw[12:], srcIP)
-	} else {
-		srcIP := getMyIPv4()
-		copy(packet.Raw[12:], srcIP)
+func TCPDetection(divert PacketDiverter, divertAddr Address, srcIP []byte, ips []string, port, ttl int) []string {
+	divertAddr.Data = 1 << 4
+
+	src := net.IP(srcIP).To4()
+	if src == nil {
+		src = getMyIPv4()
 	}
 
-	binary.BigEndian.PutUint16(packet.Raw[22:], uint16(port))
+	syn := &layers.Packet{
+		IPv4: &layers.IPv4{Flags: layers.IPv4DontFragment, TTL: byte(ttl), Src: src},
+		TCP:  &layers.TCP{SrcPort: 1, DstPort: uint16(port), Flags: TCP_SYN},
+	}
+	rawbuf := make([]byte, syn.Len())
 
 	for _, addr := range ips {
 		ip := net.ParseIP(addr)
 		ip4 := ip.To4()
 		if ip4 != nil {
-			copy(packet.Raw[16:], ip4)
-			packet.CalcNewChecksum(winDivert)
-			_, err := winDivert.Send(&packet)
+			syn.IPv4.Dst = ip4
+			err := sendLayers(divert, &divertAddr, syn, rawbuf, true)
 			if err != nil {
-				log.Println(err, packet)
+				log.Println(err, addr)
 			}
 		}
 	}
@@ -469,8 +383,7 @@ func TCPDetection(winDivert *godivert.WinDivertHandle, winDivertAddr godivert.Wi
 
 	var new_ips []string = nil
 	for _, ip := range ips {
-		bad, ok := BadIPMap[ip]
-		if !ok || !bad {
+		if !Rules.BadIP(ip) {
 			new_ips = append(new_ips, ip)
 		}
 	}
@@ -479,6 +392,12 @@ func TCPDetection(winDivert *godivert.WinDivertHandle, winDivertAddr godivert.Wi
 }
 
 func TCPDaemon(address string, forward bool) {
+	tcpDaemon(address, forward)
+}
+
+// tcpDaemon starts the daemon of TCPDaemon and returns its diverter, which
+// stops it when closed.
+func tcpDaemon(address string, forward bool) PacketDiverter {
 	wg.Add(1)
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
@@ -486,7 +405,7 @@ func TCPDaemon(address string, forward bool) {
 		if LogLevel > 0 {
 			log.Println(err)
 		}
-		return
+		return nil
 	}
 
 	var filter string
@@ -508,43 +427,50 @@ func TCPDaemon(address string, forward bool) {
 	}
 
 	mutex.Lock()
-	winDivert, err := godivert.WinDivertOpen(filter, layer, 1, 0)
+	divert, err := OpenDiverter(filter, layer, 1, 0)
 	mutex.Unlock()
 	if err != nil {
 		if LogLevel > 0 {
 			log.Println(err, filter)
 		}
-		return
+		return nil
 	}
+	startConnGC()
 
 	go func() {
 		defer wg.Done()
-		defer winDivert.Close()
+		defer divert.Close()
 
 		rawbuf := make([]byte, 1500)
-		tmp_rawbuf := make([]byte, 1500)
 
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
+				if err == ErrDiverterClosed {
+					return
+				}
 				if LogLevel > 0 {
 					log.Println(err)
 				}
 				continue
 			}
 
-			ipv6 := packet.Raw[0]>>4 == 6
-			var ipheadlen int
-			if ipv6 {
-				ipheadlen = 40
-			} else {
-				ipheadlen = int(packet.Raw[0]&0xF) * 4
+			p, err := packet.Layers()
+			if err != nil || p.TCP == nil {
+				_, err = divert.Send(packet)
+				if err != nil {
+					if LogLevel > 0 {
+						log.Println(err)
+					}
+				}
+				continue
 			}
+			ipv6 := p.IsIPv6()
 
 			if forward && !ipv6 {
 				lanAddr := [4]byte{192, 168, 137, 0}
-				if bytes.Compare(packet.Raw[12:15], lanAddr[:3]) == 0 {
-					_, err = winDivert.Send(packet)
+				if bytes.Compare(p.Src()[:3], lanAddr[:3]) == 0 {
+					_, err = divert.Send(packet)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -554,18 +480,17 @@ func TCPDaemon(address string, forward bool) {
 				}
 			}
 
-			srcPort := int(binary.BigEndian.Uint16(packet.Raw[ipheadlen:]))
+			key := connKey(p)
 
-			if (packet.Raw[ipheadlen+13] & TCP_ACK) != 0 {
-				var info *ConnInfo
-				if ipv6 {
-					info = PortList6[srcPort]
-				} else {
-					info = PortList4[srcPort]
+			if (p.TCP.Flags & TCP_ACK) != 0 {
+				info, state := Conns.Lookup(key)
+				if info != nil && p.TCP.Flags&(TCP_FIN|TCP_RST) != 0 {
+					Conns.SetState(key, CONN_CLOSED)
+					state = CONN_CLOSED
 				}
 
-				if info == nil || info.Option == 0 {
-					_, err = winDivert.Send(packet)
+				if info == nil || info.Option == 0 || state == CONN_CLOSED {
+					_, err = divert.Send(packet)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -574,66 +499,51 @@ func TCPDaemon(address string, forward bool) {
 					continue
 				}
 
-				tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-				dstPort := int(binary.BigEndian.Uint16(packet.Raw[ipheadlen+2:]))
+				if state == CONN_SYN_SENT {
+					Conns.SetState(key, CONN_ESTABLISHED)
+				}
+
+				dstPort := int(p.TCP.DstPort)
 
-				payloadLen := int(packet.PacketLen) - ipheadlen - tcpheadlen
+				payloadLen := len(p.Payload)
 
 				if payloadLen == 0 {
 					if info.Option&OPT_SYN != 0 {
-						_, err := winDivert.Send(packet)
+						_, err := divert.Send(packet)
 
-						seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4:])
-						ackNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+8:])
-						if seqNum != info.SeqNum+1 {
+						if p.TCP.Seq != info.SeqNum+1 {
 							continue
 						}
-						/*
-							if ipv6 {
-								packet.Raw[7] = byte(info.TTL)
-							} else {
-								packet.Raw[8] = byte(info.TTL)
-							}
-						*/
+
 						var offset uint32 = 32768
 
-						binary.BigEndian.PutUint32(packet.Raw[ipheadlen+4:], info.SeqNum-offset)
-						binary.BigEndian.PutUint32(packet.Raw[ipheadlen+8:], 0)
-						packet.Raw[ipheadlen+13] = TCP_SYN
-						packet.CalcNewChecksum(winDivert)
-						_, err = winDivert.Send(packet)
+						syn := p.Clone()
+						syn.TCP.Seq = info.SeqNum - offset
+						syn.TCP.Ack = 0
+						syn.TCP.Flags = TCP_SYN
+						err = sendLayers(divert, packet.Addr, syn, rawbuf, true)
 						if err != nil {
 							log.Println(err)
 						}
 
-						seqNum -= offset
-						binary.BigEndian.PutUint32(packet.Raw[ipheadlen+4:], seqNum)
-						binary.BigEndian.PutUint32(packet.Raw[ipheadlen+8:], ackNum)
-						packet.Raw[ipheadlen+13] = TCP_ACK
-						packet.CalcNewChecksum(winDivert)
-						_, err = winDivert.Send(packet)
+						ack := p.Clone()
+						ack.TCP.Seq -= offset
+						ack.TCP.Flags = TCP_ACK
+						err = sendLayers(divert, packet.Addr, ack, rawbuf, true)
 						if err != nil {
 							log.Println(err)
 						}
 
-						copy(rawbuf, packet.Raw)
-						packet.PacketLen += 16
-						if ipv6 {
-							binary.BigEndian.PutUint16(rawbuf[4:], uint16(int(packet.PacketLen)-ipheadlen))
-						} else {
-							binary.BigEndian.PutUint16(rawbuf[2:], uint16(packet.PacketLen))
-						}
-						rawbuf[ipheadlen+13] = TCP_PSH | TCP_ACK
-						packet.Raw = rawbuf[:packet.PacketLen]
-						packet.CalcNewChecksum(winDivert)
-						_, err = winDivert.Send(packet)
+						ack.TCP.Flags = TCP_PSH | TCP_ACK
+						ack.Payload = make([]byte, 16)
+						err = sendLayers(divert, packet.Addr, ack, rawbuf, true)
 						if err != nil {
 							log.Println(err)
 						}
 						continue
 					}
 
-					_, err = winDivert.Send(packet)
+					_, err = divert.Send(packet)
 					continue
 				}
 
@@ -656,24 +566,20 @@ func TCPDaemon(address string, forward bool) {
 				case TCP_DNS:
 					if info.Option&OPT_TFO != 0 {
 						continue
-					} else if payloadLen > 0 {
-						if len(packet.Raw[ipheadlen+tcpheadlen:]) > 21 {
+					} else {
+						if state == CONN_CH_SENT {
+							break
+						}
+						if payloadLen > 21 {
 							host_offset = 14
 							host_length = 1
 						}
-						if ipv6 {
-							PortList6[srcPort] = nil
-						} else {
-							PortList4[srcPort] = nil
-						}
+						Conns.SetState(key, CONN_CH_SENT)
 					}
 				case TCP_HTTP:
-					request := packet.Raw[ipheadlen+tcpheadlen:]
+					request := p.Payload
 
 					if info.Option&OPT_HTTPS != 0 {
-						if payloadLen == 0 {
-							continue
-						}
 						host_offset, host_length = getHost(request)
 
 						resStart := bytes.Index(request, []byte(" "))
@@ -685,66 +591,32 @@ func TCPDaemon(address string, forward bool) {
 						if resLen == -1 {
 							continue
 						}
-						seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4:])
-
-						copy(rawbuf, packet.Raw)
-						head := []byte("HTTP/1.1 301 Moved Permanently\r\nConnection: close\r\nContent-Length: 0\r\nLocation: https://")
-						offset := ipheadlen + 20
-						copy(rawbuf[offset:], head)
-						offset += len(head)
-						copy(rawbuf[offset:], request[host_offset:host_offset+host_length])
-						offset += host_length
-						copy(rawbuf[offset:], request[resStart:resStart+resLen])
-						offset += resLen
-						copy(rawbuf[offset:], []byte("\r\n\r\n"))
-						offset += 4
-
-						packet.PacketLen = uint(offset)
-
-						if ipv6 {
-							binary.BigEndian.PutUint16(rawbuf[4:], uint16(int(packet.PacketLen)-ipheadlen))
-							copy(rawbuf[8:], packet.Raw[24:40])
-							copy(rawbuf[24:], packet.Raw[8:24])
-						} else {
-							binary.BigEndian.PutUint16(rawbuf[2:], uint16(packet.PacketLen))
-							copy(rawbuf[12:], packet.Raw[16:20])
-							copy(rawbuf[16:], packet.Raw[12:16])
-						}
-						copy(rawbuf[ipheadlen:], packet.Raw[ipheadlen+2:ipheadlen+4])
-						copy(rawbuf[ipheadlen+2:], packet.Raw[ipheadlen:ipheadlen+2])
-						rawbuf[ipheadlen+12] = 5 << 4
 
-						binary.BigEndian.PutUint32(rawbuf[ipheadlen+4:], 1)
-						binary.BigEndian.PutUint32(rawbuf[ipheadlen+8:], seqNum+uint32(payloadLen))
-
-						rawbuf[ipheadlen+13] = TCP_PSH | TCP_ACK
-						packet.Raw = rawbuf[:packet.PacketLen]
+						location := "HTTP/1.1 301 Moved Permanently\r\nConnection: close\r\nContent-Length: 0\r\nLocation: https://"
+						location += string(request[host_offset : host_offset+host_length])
+						location += string(request[resStart:resStart+resLen]) + "\r\n\r\n"
+
+						response := p.Clone()
+						response.Reverse()
+						response.TCP.Options = nil
+						response.TCP.Seq = 1
+						response.TCP.Ack = p.TCP.Seq + uint32(payloadLen)
+						response.TCP.Flags = TCP_PSH | TCP_ACK
+						response.Payload = []byte(location)
 						packet.Addr.Data |= 0x1
 
-						packet.CalcNewChecksum(winDivert)
-
-						_, err = winDivert.Send(packet)
+						err = sendLayers(divert, packet.Addr, response, rawbuf, true)
 						if err != nil {
 							if LogLevel > 0 {
 								log.Println(err)
 							}
 						}
 
-						rst_packet := *packet
-						rst_packet.PacketLen = uint(ipheadlen + 20)
-						if ipv6 {
-							binary.BigEndian.PutUint16(rawbuf[4:], uint16(int(rst_packet.PacketLen)-ipheadlen))
-						} else {
-							binary.BigEndian.PutUint16(rawbuf[2:], uint16(rst_packet.PacketLen))
-						}
-						rawbuf[ipheadlen+13] = TCP_RST
-						binary.BigEndian.PutUint32(rawbuf[ipheadlen+4:], uint32(offset+1))
-						binary.BigEndian.PutUint32(rawbuf[ipheadlen+8:], 0)
-
-						rst_packet.Raw = rawbuf[:ipheadlen+20]
-						packet.Addr.Data |= 0x1
-						rst_packet.CalcNewChecksum(winDivert)
-						_, err = winDivert.Send(&rst_packet)
+						response.TCP.Seq += uint32(len(response.Payload))
+						response.TCP.Ack = 0
+						response.TCP.Flags = TCP_RST
+						response.Payload = nil
+						err = sendLayers(divert, packet.Addr, response, rawbuf, true)
 						if err != nil {
 							if LogLevel > 0 {
 								log.Println(err)
@@ -752,37 +624,36 @@ func TCPDaemon(address string, forward bool) {
 						}
 
 						continue
-					} else if payloadLen > 0 {
+					} else {
 						host_offset, host_length = getHost(request)
 					}
 				case TCP_TLS:
-					seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4:])
-					if seqNum == info.SeqNum+1 {
+					if p.TCP.Seq == info.SeqNum+1 {
 						if info.Option&OPT_TFO != 0 {
 							if payloadLen > 3 {
-								packet.Raw[ipheadlen+tcpheadlen] = 0xFF
-								packet.Raw[ipheadlen+tcpheadlen+1] = 0xFF
-								packet.Raw[ipheadlen+tcpheadlen+2] = 0xFF
+								p.Payload[0] = 0xFF
+								p.Payload[1] = 0xFF
+								p.Payload[2] = 0xFF
 							} else {
-								seqNum += 3
-								binary.BigEndian.PutUint32(packet.Raw[ipheadlen+4:], seqNum)
+								p.TCP.Seq += 3
 							}
 
-							packet.CalcNewChecksum(winDivert)
-						} else if payloadLen > 0 {
-							hello := packet.Raw[ipheadlen+tcpheadlen:]
-							host_offset, host_length = getSNI(hello)
+							err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+							if err != nil {
+								if LogLevel > 0 {
+									log.Println(err)
+								}
+							}
+							continue
+						} else {
+							host_offset, host_length = getSNI(p.Payload)
 						}
 					} else {
-						if info.Option&OPT_SAT != 0 && payloadLen > 0 {
+						if info.Option&OPT_SAT != 0 {
 							host_offset = 0
 							host_length = payloadLen
 						} else {
-							if ipv6 {
-								PortList6[srcPort] = nil
-							} else {
-								PortList4[srcPort] = nil
-							}
+							Conns.SetState(key, CONN_CH_SENT)
 						}
 					}
 				default:
@@ -790,7 +661,7 @@ func TCPDaemon(address string, forward bool) {
 				}
 
 				if host_length == 0 {
-					_, err = winDivert.Send(packet)
+					_, err = divert.Send(packet)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -800,24 +671,13 @@ func TCPDaemon(address string, forward bool) {
 				}
 
 				if (info.Option&OPT_SSEG) != 0 && payloadLen > 4 {
-					copy(tmp_rawbuf, packet.Raw[:ipheadlen+tcpheadlen+4])
-					if ipv6 {
-						binary.BigEndian.PutUint16(tmp_rawbuf[4:], uint16(tcpheadlen+4))
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[7] = info.MAXTTL
-						}
-					} else {
-						binary.BigEndian.PutUint16(tmp_rawbuf[2:], uint16(ipheadlen+tcpheadlen+4))
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[8] = info.MAXTTL
-						}
+					prefix := p.Clone()
+					prefix.Payload = prefix.Payload[:4]
+					if info.MAXTTL > 0 {
+						prefix.SetTTL(info.MAXTTL)
 					}
 
-					prefix_packet := *packet
-					prefix_packet.Raw = tmp_rawbuf[:ipheadlen+tcpheadlen+4]
-					prefix_packet.PacketLen = uint(ipheadlen + tcpheadlen + 4)
-					prefix_packet.CalcNewChecksum(winDivert)
-					_, err = winDivert.Send(&prefix_packet)
+					err = sendLayers(divert, packet.Addr, prefix, rawbuf, true)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -830,8 +690,8 @@ func TCPDaemon(address string, forward bool) {
 				if (info.Option & 0xFFFF) != 0 {
 					if info.Option&OPT_MODE2 == 0 {
 						if info.Option&OPT_DF != 0 {
-							host_length, err = SendFakePacket(winDivert, info, packet, host_offset, host_length, 2)
-							_, err = winDivert.Send(packet)
+							host_length, err = SendFakePacket(divert, info, packet.Addr, p, host_offset, host_length, 2)
+							_, err = divert.Send(packet)
 							if err != nil {
 								if LogLevel > 0 {
 									log.Println(err)
@@ -839,7 +699,7 @@ func TCPDaemon(address string, forward bool) {
 							}
 							continue
 						}
-						host_length, err = SendFakePacket(winDivert, info, packet, host_offset, host_length, count)
+						host_length, err = SendFakePacket(divert, info, packet.Addr, p, host_offset, host_length, count)
 						if err != nil {
 							if LogLevel > 0 {
 								log.Println(err)
@@ -852,67 +712,32 @@ func TCPDaemon(address string, forward bool) {
 				}
 
 				if info.Option&OPT_DF != 0 {
-					winDivert.Send(packet)
+					divert.Send(packet)
 					continue
 				}
 
 				if info.Option&OPT_MD5 != 0 {
-					copy(tmp_rawbuf, packet.Raw[ipheadlen+tcpheadlen:])
-					copy(packet.Raw[ipheadlen+20:], []byte{19, 18, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
-					packet.Raw[ipheadlen+12] = 10 << 4
-					tcpheadlen = 40
-					copy(packet.Raw[ipheadlen+20:], tmp_rawbuf[:int(packet.PacketLen)-ipheadlen-tcpheadlen])
+					p.TCP.Options = md5Option
 				}
 
 				host_cut_offset := host_offset + host_length/2
-				total_cut_offset := ipheadlen + tcpheadlen + host_cut_offset
-
-				copy(tmp_rawbuf, packet.Raw[:total_cut_offset])
 
+				prefix := p.Clone()
+				prefix.Payload = prefix.Payload[:host_cut_offset]
 				if (info.Option & OPT_NOFLAG) != 0 {
-					tmp_rawbuf[ipheadlen+13] = 0
+					prefix.TCP.Flags = 0
 				} else {
-					tmp_rawbuf[ipheadlen+13] &= ^TCP_PSH
+					prefix.TCP.Flags &= ^TCP_PSH
 				}
-
-				seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4 : ipheadlen+8])
-				prefix_packet := *packet
-				if (info.Option&OPT_SSEG) != 0 && payloadLen > 4 {
-					copy(tmp_rawbuf[ipheadlen+tcpheadlen:], packet.Raw[ipheadlen+tcpheadlen+4:total_cut_offset])
-					totallen := uint16(total_cut_offset - 4)
-					binary.BigEndian.PutUint32(tmp_rawbuf[ipheadlen+4:], seqNum+4)
-					if ipv6 {
-						binary.BigEndian.PutUint16(tmp_rawbuf[4:], totallen-uint16(ipheadlen))
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[7] = info.MAXTTL
-						}
-					} else {
-						binary.BigEndian.PutUint16(tmp_rawbuf[2:], totallen)
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[8] = info.MAXTTL
-						}
-					}
-
-					prefix_packet.Raw = tmp_rawbuf[:totallen]
-					prefix_packet.PacketLen = uint(totallen)
-				} else {
-					if ipv6 {
-						binary.BigEndian.PutUint16(tmp_rawbuf[4:], uint16(total_cut_offset-ipheadlen))
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[7] = info.MAXTTL
-						}
-					} else {
-						binary.BigEndian.PutUint16(tmp_rawbuf[2:], uint16(total_cut_offset))
-						if info.MAXTTL > 0 {
-							tmp_rawbuf[8] = info.MAXTTL
-						}
-					}
-
-					prefix_packet.Raw = tmp_rawbuf[:total_cut_offset]
-					prefix_packet.PacketLen = uint(total_cut_offset)
+				if (info.Option&OPT_SSEG) != 0 && payloadLen > 4 && host_cut_offset > 4 {
+					prefix.Payload = prefix.Payload[4:]
+					prefix.TCP.Seq += 4
 				}
-				prefix_packet.CalcNewChecksum(winDivert)
-				_, err = winDivert.Send(&prefix_packet)
+				if info.MAXTTL > 0 {
+					prefix.SetTTL(info.MAXTTL)
+				}
+
+				err = sendLayers(divert, packet.Addr, prefix, rawbuf, true)
 				if err != nil {
 					if LogLevel > 0 {
 						log.Println(err)
@@ -921,7 +746,7 @@ func TCPDaemon(address string, forward bool) {
 				}
 
 				if (info.Option & 0xFFFF) != 0 {
-					_, err = SendFakePacket(winDivert, info, packet, host_offset, host_length, count)
+					_, err = SendFakePacket(divert, info, packet.Addr, p, host_offset, host_length, count)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -930,73 +755,41 @@ func TCPDaemon(address string, forward bool) {
 					}
 				}
 
-				copy(tmp_rawbuf, packet.Raw[:ipheadlen+tcpheadlen])
-				copy(tmp_rawbuf[ipheadlen+tcpheadlen:], packet.Raw[total_cut_offset:])
-				totallen := uint16(packet.PacketLen) - uint16(host_cut_offset)
-				if ipv6 {
-					binary.BigEndian.PutUint16(tmp_rawbuf[4:], totallen-uint16(ipheadlen))
-					if info.MAXTTL > 0 {
-						tmp_rawbuf[7] = info.MAXTTL + 1
-					}
-				} else {
-					binary.BigEndian.PutUint16(tmp_rawbuf[2:], totallen)
-					if info.MAXTTL > 0 {
-						tmp_rawbuf[8] = info.MAXTTL + 1
-					}
+				p.Payload = p.Payload[host_cut_offset:]
+				p.TCP.Seq += uint32(host_cut_offset)
+				if info.MAXTTL > 0 {
+					p.SetTTL(info.MAXTTL + 1)
 				}
-				binary.BigEndian.PutUint32(tmp_rawbuf[ipheadlen+4:], seqNum+uint32(host_cut_offset))
-				packet.Raw = tmp_rawbuf[:totallen]
-				packet.PacketLen = uint(totallen)
-				packet.CalcNewChecksum(winDivert)
 
-				_, err = winDivert.Send(packet)
+				err = sendLayers(divert, packet.Addr, p, rawbuf, true)
 				if err != nil {
 					if LogLevel > 0 {
 						log.Println(err)
 					}
 					continue
 				}
-			} else if packet.Raw[ipheadlen+13] == TCP_SYN {
+			} else if p.TCP.Flags == TCP_SYN {
 				dstIP := packet.DstIP()
 				dstAddr := dstIP.String()
 				config, ok := IPLookup(dstAddr)
 
+				modified := false
 				if ok && config.Option != 0 {
-					seqNum := binary.BigEndian.Uint32(packet.Raw[ipheadlen+4:])
-					if ipv6 {
-						PortList6[srcPort] = &ConnInfo{config.Option, seqNum, config.TTL, config.MAXTTL}
-					} else {
-						PortList4[srcPort] = &ConnInfo{config.Option, seqNum, config.TTL, config.MAXTTL}
-					}
-
-					tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
+					seqNum := p.TCP.Seq
+					Conns.Add(key, &ConnInfo{config.Option, seqNum, config.TTL, config.MAXTTL})
 
 					if config.Option&OPT_HTTPS != 0 {
 						if tcpAddr.Port == 80 {
-							copy(rawbuf, packet.Raw)
-							binary.BigEndian.PutUint32(rawbuf[ipheadlen+4:], 0)
-							binary.BigEndian.PutUint32(rawbuf[ipheadlen+8:], seqNum+1)
-							rawbuf[ipheadlen+13] = TCP_SYN | TCP_ACK
-
-							packet.PacketLen = uint(ipheadlen + 32)
-							if ipv6 {
-								binary.BigEndian.PutUint16(rawbuf[4:], uint16(int(packet.PacketLen)-ipheadlen))
-								copy(rawbuf[8:], packet.Raw[24:40])
-								copy(rawbuf[24:], packet.Raw[8:24])
-							} else {
-								binary.BigEndian.PutUint16(rawbuf[2:], uint16(packet.PacketLen))
-								copy(rawbuf[12:], packet.Raw[16:20])
-								copy(rawbuf[16:], packet.Raw[12:16])
-							}
-							copy(rawbuf[ipheadlen:], packet.Raw[ipheadlen+2:ipheadlen+4])
-							copy(rawbuf[ipheadlen+2:], packet.Raw[ipheadlen:ipheadlen+2])
-							copy(rawbuf[ipheadlen+20:], []byte{0x02, 0x04, 0x05, 0xa8, 0x01, 0x01, 0x04, 0x02, 0x01, 0x03, 0x03, 0x09})
-							rawbuf[ipheadlen+12] = 8 << 4
+							synack := p.Clone()
+							synack.Reverse()
+							synack.TCP.Seq = 0
+							synack.TCP.Ack = seqNum + 1
+							synack.TCP.Flags = TCP_SYN | TCP_ACK
+							synack.TCP.Options = []byte{0x02, 0x04, 0x05, 0xa8, 0x01, 0x01, 0x04, 0x02, 0x01, 0x03, 0x03, 0x09}
+							synack.Payload = nil
 							packet.Addr.Data |= 0x1
-							packet.Raw = rawbuf[:ipheadlen+32]
 
-							packet.CalcNewChecksum(winDivert)
-							_, err = winDivert.Send(packet)
+							err = sendLayers(divert, packet.Addr, synack, rawbuf, true)
 							if err != nil {
 								if LogLevel > 0 {
 									log.Println(err)
@@ -1008,104 +801,62 @@ func TCPDaemon(address string, forward bool) {
 
 					if config.Option&(OPT_TFO|OPT_WTFO) != 0 {
 						if config.Option&OPT_TFO != 0 {
-							SynOption = make([]byte, tcpheadlen-20)
-							copy(SynOption, packet.Raw[ipheadlen+20:])
+							SynOption = make([]byte, len(p.TCP.Options))
+							copy(SynOption, p.TCP.Options)
 
-							copy(rawbuf, packet.Raw)
-							cookies, _ := CookiesMap[dstAddr]
+							cookies := Rules.Cookies(dstAddr)
 
 							if cookies != nil {
-								cookiesLen := len(cookies)
-								optLen := cookiesLen + 2
-								offset := byte((optLen + 3) / 4)
-								rawbuf[ipheadlen+12] += offset << 4
-								rawbuf[int(packet.PacketLen)] = 34
-								rawbuf[int(packet.PacketLen)+1] = byte(optLen)
-								copy(rawbuf[int(packet.PacketLen)+2:], cookies)
-								packet.PacketLen += uint(offset * 4)
+								p.TCP.AddOption(layers.TCPOptionFastOpen, cookies)
 
 								if tcpAddr.Port == 53 {
-									binary.BigEndian.PutUint32(rawbuf[ipheadlen+4:], seqNum-uint32(len(TFOPayload)))
-									copy(rawbuf[packet.PacketLen:], TFOPayload)
-									packet.PacketLen += uint(len(TFOPayload))
+									payload := tfoPayload((&net.TCPAddr{IP: dstIP, Port: int(p.TCP.DstPort)}).String())
+									p.TCP.Seq = seqNum - uint32(len(payload))
+									p.Payload = payload
 								} else {
-									rawbuf[packet.PacketLen] = 0x16
-									rawbuf[packet.PacketLen+1] = 0x03
-									rawbuf[packet.PacketLen+2] = 0x01
-									packet.PacketLen += 3
+									p.Payload = []byte{0x16, 0x03, 0x01}
 								}
 							} else {
-								binary.BigEndian.PutUint16(rawbuf[ipheadlen:], 3)
-								packet.PacketLen += 4
-								rawbuf[ipheadlen+12] += 1 << 4
-								rawbuf[ipheadlen+tcpheadlen] = 34
-								rawbuf[ipheadlen+tcpheadlen+1] = 2
-								rawbuf[ipheadlen+tcpheadlen+2] = 1
-								rawbuf[ipheadlen+tcpheadlen+3] = 1
+								//ask for a cookie, TCPRecv picks up the answer on port 3
+								p.TCP.SrcPort = 3
+								p.TCP.AddOption(layers.TCPOptionFastOpen, nil)
 							}
 						} else {
-							cookiesLen := 16
-							optLen := cookiesLen + 2
-							offset := byte((optLen + 3) / 4)
-							rawbuf[ipheadlen+12] += offset << 4
-							rawbuf[int(packet.PacketLen)] = 34
-							rawbuf[int(packet.PacketLen)+1] = byte(optLen)
-							packet.PacketLen += uint(offset * 4)
-
-							rawbuf[packet.PacketLen] = 0x00
-							rawbuf[packet.PacketLen+1] = 0x00
-							rawbuf[packet.PacketLen+2] = 0x00
-							rawbuf[packet.PacketLen+3] = 0x00
-							rawbuf[packet.PacketLen+4] = 0x00
-							packet.PacketLen += 512
+							p.TCP.AddOption(layers.TCPOptionFastOpen, make([]byte, 16))
+							p.Payload = make([]byte, 512)
 						}
-
-						if ipv6 {
-							PortList6[srcPort].SeqNum = seqNum
-							binary.BigEndian.PutUint16(rawbuf[4:], uint16(int(packet.PacketLen)-ipheadlen))
-						} else {
-							PortList4[srcPort].SeqNum = seqNum
-							binary.BigEndian.PutUint16(rawbuf[2:], uint16(packet.PacketLen))
-						}
-
-						packet.Raw = rawbuf[:packet.PacketLen]
-
-						packet.CalcNewChecksum(winDivert)
+						modified = true
 					}
-					/*
-						if config.Option&OPT_SYN != 0 {
-							binary.BigEndian.PutUint32(packet.Raw[ipheadlen+4:], seqNum-32767)
-							packet.CalcNewChecksum(winDivert)
-						}
-					*/
+
 					if (config.Option & OPT_MSS) != 0 {
-						if tcpheadlen >= 24 {
-							tcpOption := packet.Raw[ipheadlen+20]
-							if tcpOption == 2 {
-								binary.BigEndian.PutUint16(packet.Raw[ipheadlen+22:], config.MSS)
-								packet.CalcNewChecksum(winDivert)
-							}
+						mss := p.TCP.Option(layers.TCPOptionMSS)
+						if len(mss) == 2 {
+							binary.BigEndian.PutUint16(mss, config.MSS)
+							modified = true
 						}
 					}
 
-					logPrintln(2, packet.DstIP(), config.Option)
+					logPrintln(2, dstIP, config.Option)
 				} else {
-					if ipv6 {
-						PortList6[srcPort] = nil
-					} else {
-						PortList4[srcPort] = nil
-					}
-					logPrintln(3, packet.DstIP(), tcpAddr.Port)
+					Conns.Remove(key)
+					logPrintln(3, dstIP, tcpAddr.Port)
 				}
 
-				_, err = winDivert.Send(packet)
+				if modified {
+					err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+				} else {
+					_, err = divert.Send(packet)
+				}
 				if err != nil {
 					if LogLevel > 0 {
 						log.Println(err)
 					}
 				}
 			} else {
-				_, err = winDivert.Send(packet)
+				if p.TCP.Flags&TCP_RST != 0 {
+					Conns.SetState(key, CONN_CLOSED)
+				}
+				_, err = divert.Send(packet)
 				if err != nil {
 					if LogLevel > 0 {
 						log.Println(err)
@@ -1114,6 +865,8 @@ func TCPDaemon(address string, forward bool) {
 			}
 		}
 	}()
+
+	return divert
 }
 
 func NAT64(ipv4 net.IP, ipv6 net.IP, forward bool) {
@@ -1132,7 +885,7 @@ func NAT64(ipv4 net.IP, ipv6 net.IP, forward bool) {
 	}
 
 	mutex.Lock()
-	winDivert, err := godivert.WinDivertOpen(filter, layer, 0, 0)
+	divert, err := OpenDiverter(filter, layer, 0, 0)
 	mutex.Unlock()
 	if err != nil {
 		if LogLevel > 0 {
@@ -1140,7 +893,7 @@ func NAT64(ipv4 net.IP, ipv6 net.IP, forward bool) {
 		}
 		return
 	}
-	defer winDivert.Close()
+	defer divert.Close()
 
 	myIPv6 := getMyIPv6()
 	if myIPv6 == nil {
@@ -1148,11 +901,11 @@ func NAT64(ipv4 net.IP, ipv6 net.IP, forward bool) {
 	}
 
 	rawbuf := make([]byte, 1500)
-	srcIP := make([]byte, 4)
+	srcIP := make(net.IP, 4)
 	mss := uint16(1440)
 
 	for {
-		packet, err := winDivert.Recv()
+		packet, err := divert.Recv()
 		if err != nil {
 			if LogLevel > 0 {
 				log.Println(err)
@@ -1160,81 +913,64 @@ func NAT64(ipv4 net.IP, ipv6 net.IP, forward bool) {
 			return
 		}
 
-		ipVer := packet.Raw[0] >> 4
+		p, err := packet.Layers()
+		if err != nil {
+			continue
+		}
 
-		if ipVer == 4 {
+		if !p.IsIPv6() {
 			if packet.PacketLen > 1500-20 {
 				continue
 			}
 
-			ipheadlen := int(packet.Raw[0]&0xF) * 4
-			payloadLen := int(packet.PacketLen) - ipheadlen
-
-			if packet.Raw[9] == 6 {
-				if packet.Raw[ipheadlen+13] == TCP_SYN {
-					tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-					if tcpheadlen >= 24 {
-						tcpOption := packet.Raw[ipheadlen+20]
-						if tcpOption == 2 {
-							mss = binary.BigEndian.Uint16(packet.Raw[ipheadlen+22:])
-							mss -= 20
-							binary.BigEndian.PutUint16(packet.Raw[ipheadlen+22:], mss)
-						}
-					}
+			if p.TCP != nil && p.TCP.Flags == TCP_SYN {
+				option := p.TCP.Option(layers.TCPOptionMSS)
+				if len(option) == 2 {
+					mss = binary.BigEndian.Uint16(option)
+					mss -= 20
+					binary.BigEndian.PutUint16(option, mss)
 				}
 			}
 
-			copy(srcIP, packet.Raw[12:16])
-
-			copy(rawbuf, []byte{0x60, 0x00, 0x00, 0x00})
-			binary.BigEndian.PutUint16(rawbuf[4:], uint16(payloadLen))
-			rawbuf[6] = packet.Raw[9]
-			rawbuf[7] = packet.Raw[8]
-			copy(rawbuf[8:], myIPv6[:16])
-			copy(rawbuf[24:], ipv6[:16])
-			copy(rawbuf[40:], packet.Raw[ipheadlen:])
-
-			packet6 := *packet
-			packet6.Raw = rawbuf[:40+payloadLen]
-			packet6.PacketLen = uint(payloadLen + 40)
-			packet6.CalcNewChecksum(winDivert)
-
-			_, err = winDivert.Send(&packet6)
-		} else if ipVer == 6 {
-			ipheadlen := 40
-			payloadLen := int(packet.PacketLen) - ipheadlen
-
-			if packet.Raw[6] == 6 {
-				if packet.Raw[ipheadlen+13] == TCP_SYN|TCP_ACK {
-					tcpheadlen := int(packet.Raw[ipheadlen+12]>>4) * 4
-					if tcpheadlen >= 24 {
-						tcpOption := packet.Raw[ipheadlen+20]
-						if tcpOption == 2 {
-							if mss < binary.BigEndian.Uint16(packet.Raw[ipheadlen+22:]) {
-								binary.BigEndian.PutUint16(packet.Raw[ipheadlen+22:], mss)
-							}
-						}
+			copy(srcIP, p.IPv4.Src)
+
+			packet6 := &layers.Packet{
+				IPv6: &layers.IPv6{
+					NextHeader: p.IPv4.Protocol,
+					HopLimit:   p.IPv4.TTL,
+					Src:        myIPv6,
+					Dst:        ipv6,
+				},
+				TCP:     p.TCP,
+				UDP:     p.UDP,
+				Payload: p.Payload,
+			}
+
+			err = sendLayers(divert, packet.Addr, packet6, rawbuf, true)
+		} else {
+			if p.TCP != nil && p.TCP.Flags == TCP_SYN|TCP_ACK {
+				option := p.TCP.Option(layers.TCPOptionMSS)
+				if len(option) == 2 {
+					if mss < binary.BigEndian.Uint16(option) {
+						binary.BigEndian.PutUint16(option, mss)
 					}
 				}
 			}
 
-			copy(rawbuf, []byte{0x45, 0x00})
-			binary.BigEndian.PutUint16(rawbuf[2:], uint16(20+payloadLen))
-			copy(rawbuf[4:], []byte{0x00, 0x00})
-			copy(rawbuf[6:], []byte{0x40, 0x00})
-			rawbuf[8] = packet.Raw[7]
-			rawbuf[9] = packet.Raw[6]
-			copy(rawbuf[10:], []byte{0x00, 0x00})
-			copy(rawbuf[12:], ipv4)
-			copy(rawbuf[16:], srcIP)
-			copy(rawbuf[20:], packet.Raw[ipheadlen:])
-
-			packet4 := *packet
-			packet4.Raw = rawbuf[:20+payloadLen]
-			packet4.PacketLen = uint(20 + payloadLen)
-			packet4.CalcNewChecksum(winDivert)
-
-			_, err = winDivert.Send(&packet4)
+			packet4 := &layers.Packet{
+				IPv4: &layers.IPv4{
+					Flags:    layers.IPv4DontFragment,
+					TTL:      p.IPv6.HopLimit,
+					Protocol: p.IPv6.NextHeader,
+					Src:      ipv4,
+					Dst:      srcIP,
+				},
+				TCP:     p.TCP,
+				UDP:     p.UDP,
+				Payload: p.Payload,
+			}
+
+			err = sendLayers(divert, packet.Addr, packet4, rawbuf, true)
 		}
 
 		if err != nil {
@@ -1267,7 +1003,7 @@ func ProxyRedirect(forward bool) {
 	}
 
 	mutex.Lock()
-	winDivert, err := godivert.WinDivertOpen(filter, layer, 0, 0)
+	divert, err := OpenDiverter(filter, layer, 0, 0)
 	mutex.Unlock()
 
 	if err != nil {
@@ -1278,29 +1014,38 @@ func ProxyRedirect(forward bool) {
 	}
 
 	go func() {
-		defer winDivert.Close()
+		defer divert.Close()
+
+		rawbuf := make([]byte, 1500)
 
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
+				if err == ErrDiverterClosed {
+					return
+				}
 				if LogLevel > 0 {
 					log.Println(err)
 				}
 				continue
 			}
 
-			ipv6 := packet.Raw[0]>>4 == 6
-			var ipheadlen int
-			if ipv6 {
-				ipheadlen = 40
-			} else {
-				ipheadlen = int(packet.Raw[0]&0xF) * 4
+			p, err := packet.Layers()
+			if err != nil || p.TCP == nil {
+				_, err = divert.Send(packet)
+				if err != nil {
+					if LogLevel > 0 {
+						log.Println(err)
+					}
+				}
+				continue
 			}
+			ipv6 := p.IsIPv6()
 
 			if forward && !ipv6 {
 				lanAddr := [4]byte{192, 168, 137, 0}
-				if bytes.Compare(packet.Raw[16:19], lanAddr[:3]) == 0 {
-					_, err = winDivert.Send(packet)
+				if bytes.Compare(p.Dst()[:3], lanAddr[:3]) == 0 {
+					_, err = divert.Send(packet)
 					if err != nil {
 						if LogLevel > 0 {
 							log.Println(err)
@@ -1310,7 +1055,7 @@ func ProxyRedirect(forward bool) {
 				}
 			}
 
-			dstPort := binary.BigEndian.Uint16(packet.Raw[ipheadlen+2:])
+			dstPort := p.TCP.DstPort
 			var info *ProxyInfo
 			if ipv6 {
 				info = ProxyList6[dstPort]
@@ -1319,13 +1064,13 @@ func ProxyRedirect(forward bool) {
 			}
 
 			if info != nil {
-				packet.SetDstIP(info.SrcIP)
-				packet.SetSrcIP(info.DstIP)
-				packet.SetSrcPort(info.Port)
-				packet.CalcNewChecksum(winDivert)
+				p.SetDst(info.SrcIP)
+				p.SetSrc(info.DstIP)
+				p.TCP.SrcPort = info.Port
+				err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+			} else {
+				_, err = divert.Send(packet)
 			}
-
-			_, err = winDivert.Send(packet)
 			if err != nil {
 				if LogLevel > 0 {
 					log.Println(err)
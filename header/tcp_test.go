@@ -0,0 +1,317 @@
+package ghostcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/macronut/ghostcp/header/layers"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const goldenISN = 1000
+
+var goldenSynOptions = []byte{layers.TCPOptionMSS, 4, 0x05, 0xb4, 4, 2, 1, 1}
+
+// clientHello returns a TLS ClientHello for host, with a 32-byte session ID
+// and the server name as its only extension.
+func clientHello(host string) []byte {
+	sni := make([]byte, 9+len(host))
+	binary.BigEndian.PutUint16(sni[2:], uint16(5+len(host)))
+	binary.BigEndian.PutUint16(sni[4:], uint16(3+len(host)))
+	binary.BigEndian.PutUint16(sni[7:], uint16(len(host)))
+	copy(sni[9:], host)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 32)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0, 4, 0x13, 0x01, 0x13, 0x02)
+	body = append(body, 1, 0)
+	body = append(body, byte(len(sni)>>8), byte(len(sni)))
+	body = append(body, sni...)
+
+	hello := []byte{0x16, 0x03, 0x01, 0, 0, 0x01, 0, 0, 0}
+	binary.BigEndian.PutUint16(hello[3:], uint16(4+len(body)))
+	hello[7] = byte(len(body) >> 8)
+	hello[8] = byte(len(body))
+	return append(hello, body...)
+}
+
+// goldenPacket builds an outbound TCP segment of the golden connection.
+func goldenPacket(dst string, seq uint32, flags uint8, options []byte, payload []byte) *Packet {
+	l := &layers.Packet{
+		IPv4: &layers.IPv4{ID: 0x1234, Flags: layers.IPv4DontFragment, TTL: 64,
+			Src: net.ParseIP("10.0.0.2").To4(), Dst: net.ParseIP(dst).To4()},
+		TCP: &layers.TCP{SrcPort: 50000, DstPort: 443, Seq: seq, Flags: flags,
+			Window: 64240, Options: options},
+		Payload: payload,
+	}
+	if flags&TCP_ACK != 0 {
+		l.TCP.Ack = 5001
+	}
+	raw := l.Serialize(nil, true)
+	return &Packet{Raw: raw, Addr: &Address{}, PacketLen: uint(len(raw))}
+}
+
+// describePacket prints the fields of a sent IPv4 TCP packet the methods
+// change. Payloads are shown as the range of the ClientHello they carry, as
+// fake when they are a ClientHello with another host, or by length.
+func describePacket(raw []byte, hello []byte) (string, bool) {
+	ihl := int(raw[0]&0xF) * 4
+	tcp := raw[ihl:]
+	seq := binary.BigEndian.Uint32(tcp[4:])
+	doff := int(tcp[12] >> 4)
+	hlen := doff * 4
+	if hlen < 20 {
+		hlen = 20
+	}
+	options := tcp[20:hlen]
+	payload := tcp[hlen:]
+
+	checked := make([]byte, len(raw))
+	copy(checked, raw)
+	layers.CalcChecksums(checked)
+	csumOK := bytes.Equal(checked, raw)
+
+	var flags string
+	for i, c := range "FSRPAUEC" {
+		if tcp[13]&(1<<uint(i)) != 0 {
+			flags += string(c)
+		}
+	}
+	if flags == "" {
+		flags = "-"
+	}
+
+	s := fmt.Sprintf("ttl=%d", raw[8])
+	if ihl > 20 {
+		s += fmt.Sprintf(" ipopt=%d", ihl-20)
+	}
+	if sport := binary.BigEndian.Uint16(tcp); sport != 50000 {
+		s += fmt.Sprintf(" sport=%d", sport)
+	}
+	s += fmt.Sprintf(" seq=%+d ack=%d %s doff=%d", int32(seq-goldenISN), binary.BigEndian.Uint32(tcp[8:]), flags, doff)
+	if len(options) > 0 {
+		s += " opt=" + hex.EncodeToString(options)
+	}
+
+	off := int(int32(seq - goldenISN - 1))
+	switch {
+	case len(payload) == 0:
+	case off >= 0 && off+len(payload) <= len(hello) && bytes.Equal(payload, hello[off:off+len(payload)]):
+		s += fmt.Sprintf(" data[%d:%d]", off, off+len(payload))
+	case len(payload) == len(hello) && bytes.Equal(payload[:40], hello[:40]):
+		s += " fake"
+	default:
+		s += fmt.Sprintf(" len=%d", len(payload))
+	}
+	if !csumOK {
+		s += " bad-csum"
+	}
+	return s, csumOK
+}
+
+type methodCase struct {
+	name   string
+	config IPConfig
+}
+
+// methodCases returns every method of MethodMap, and every method sending
+// fake packets combined with each method changing how they are sent.
+func methodCases() []methodCase {
+	var names []string
+	for name := range MethodMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, fake := range []string{"ttl", "w-md5", "w-ack", "w-csum", "bad", "ipopt", "seq"} {
+		for _, mode := range []string{"mode2", "df", "md5", "no-flag", "s-seg"} {
+			names = append(names, fake+","+mode)
+		}
+	}
+	names = append(names, "ttl,w-ack,seq", "ttl,mss,s-seg,md5")
+
+	var cases []methodCase
+	for _, name := range names {
+		var option uint32
+		for _, m := range strings.Split(name, ",") {
+			option |= MethodMap[m]
+		}
+		cases = append(cases, methodCase{name, IPConfig{option, 5, 0, 1200}})
+	}
+	cases = append(cases, methodCase{"ttl maxttl=10", IPConfig{OPT_TTL, 5, 10, 0}})
+	cases = append(cases, methodCase{"ttl,s-seg maxttl=10", IPConfig{OPT_TTL | OPT_SSEG, 5, 10, 0}})
+	return cases
+}
+
+// TestTCPMethods runs a SYN, its ACK and a ClientHello through TCPDaemon for
+// each method and compares the packets it sends with
+// testdata/tcp_methods.golden. Run with -update to rewrite it.
+func TestTCPMethods(t *testing.T) {
+	replay := NewPacketReplay()
+	defer replay.Close()
+	OpenDiverter = replay.Open
+	defer func() { OpenDiverter = nil }()
+
+	divert := tcpDaemon(":443", false)
+	if divert == nil {
+		t.Fatal("TCPDaemon not started")
+	}
+	defer divert.Close()
+
+	const dst = "203.0.113.1"
+	hello := clientHello("www.example.com")
+	stages := []struct {
+		name   string
+		packet *Packet
+	}{
+		{"syn", goldenPacket(dst, goldenISN, TCP_SYN, goldenSynOptions, nil)},
+		{"ack", goldenPacket(dst, goldenISN+1, TCP_ACK, nil, nil)},
+		{"hello", goldenPacket(dst, goldenISN+1, TCP_PSH|TCP_ACK, nil, hello)},
+	}
+
+	var out bytes.Buffer
+	for _, c := range methodCases() {
+		Rules.SetIP(dst, c.config)
+		replay.Reset()
+
+		fmt.Fprintf(&out, "== %s\n", c.name)
+		for _, stage := range stages {
+			if !replay.Inject(stage.packet) {
+				t.Fatalf("%s: %s not diverted", c.name, stage.name)
+			}
+			for _, p := range replay.Sent() {
+				s, csumOK := describePacket(p.Raw, hello)
+				fmt.Fprintf(&out, "%-5s %s\n", stage.name, s)
+				if !csumOK && c.config.Option&OPT_WCSUM == 0 {
+					t.Errorf("%s: bad checksum: %s", c.name, s)
+				}
+			}
+			replay.Reset()
+		}
+
+		syn, _ := stages[0].packet.Layers()
+		Conns.Remove(connKey(syn))
+	}
+	Rules.SetIP(dst, IPConfig{})
+
+	golden := filepath.Join("testdata", "tcp_methods.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		diffGolden(t, string(want), out.String())
+	}
+}
+
+// diffGolden reports the sections of got that differ from want.
+func diffGolden(t *testing.T, want, got string) {
+	sections := func(s string) map[string]string {
+		m := make(map[string]string)
+		for _, section := range strings.Split(s, "== ")[1:] {
+			name := section[:strings.Index(section, "\n")]
+			m[name] = section
+		}
+		return m
+	}
+	w, g := sections(want), sections(got)
+	for name, section := range g {
+		if w[name] != section {
+			t.Errorf("%s:\n%s\nwant:\n%s", name, section, w[name])
+		}
+	}
+	for name := range w {
+		if _, ok := g[name]; !ok {
+			t.Errorf("%s: missing", name)
+		}
+	}
+}
+
+// TestTFOPayload dials two DNS servers with TFO at once: each SYN carries
+// the query of its own server.
+func TestTFOPayload(t *testing.T) {
+	testConfig(t)
+	replay := NewPacketReplay()
+	defer replay.Close()
+	OpenDiverter = replay.Open
+	defer func() { OpenDiverter = nil }()
+
+	divert := tcpDaemon(":53", false)
+	if divert == nil {
+		t.Fatal("TCPDaemon not started")
+	}
+	defer divert.Close()
+
+	for i, dst := range []string{"203.0.113.1", "203.0.113.2"} {
+		Rules.SetIP(dst, IPConfig{OPT_TFO, 5, 0, 0})
+		Rules.SetCookies(dst, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+		query := dnsMessage(uint16(i), fmt.Sprintf("%d.example.com", i), 1)
+		setTFOPayload(dst+":53", query)
+		defer setTFOPayload(dst+":53", nil)
+	}
+
+	for i, dst := range []string{"203.0.113.1", "203.0.113.2"} {
+		l := &layers.Packet{
+			IPv4: &layers.IPv4{ID: 0x1234, TTL: 64,
+				Src: net.ParseIP("10.0.0.2").To4(), Dst: net.ParseIP(dst).To4()},
+			TCP: &layers.TCP{SrcPort: 50000, DstPort: 53, Seq: goldenISN, Flags: TCP_SYN,
+				Window: 64240, Options: goldenSynOptions},
+		}
+		raw := l.Serialize(nil, true)
+		replay.Reset()
+		if !replay.Inject(&Packet{Raw: raw, Addr: &Address{}, PacketLen: uint(len(raw))}) {
+			t.Fatal(dst, "not diverted")
+		}
+		sent := replay.Sent()
+		if len(sent) != 1 {
+			t.Fatal(dst, len(sent), "packets sent")
+		}
+		syn, err := sent[0].Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qname, _, _ := getQName(syn.Payload); qname != fmt.Sprintf("%d.example.com", i) {
+			t.Errorf("%s: the SYN carries %x", dst, syn.Payload)
+		}
+		if syn.TCP.Seq != goldenISN-uint32(len(syn.Payload)) {
+			t.Errorf("%s: seq %d", dst, syn.TCP.Seq)
+		}
+		Conns.Remove(connKey(syn))
+	}
+}
+
+func TestGetCookies(t *testing.T) {
+	options := []byte{layers.TCPOptionMSS, 4, 0x05, 0xb4, 1, layers.TCPOptionFastOpen, 10, 1, 2, 3, 4, 5, 6, 7, 8}
+	if cookies := getCookies(options); !bytes.Equal(cookies, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("got %x", cookies)
+	}
+	if cookies := getCookies(options[:len(options)-1]); cookies != nil {
+		t.Errorf("truncated: got %x", cookies)
+	}
+}
+
+func FuzzGetCookies(f *testing.F) {
+	f.Add(goldenSynOptions)
+	f.Add([]byte{layers.TCPOptionFastOpen, 10, 1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add([]byte{layers.TCPOptionFastOpen, 1})
+	f.Fuzz(func(t *testing.T, options []byte) {
+		getCookies(options)
+	})
+}
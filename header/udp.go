@@ -3,28 +3,26 @@ package ghostcp
 import (
 	"encoding/binary"
 	"log"
-	"os/exec"
 	"strconv"
+	"time"
 
-	"github.com/macronut/godivert"
+	"github.com/macronut/ghostcp/header/layers"
 )
 
 func DNSDaemon() {
 	wg.Add(1)
 
-	arg := []string{"/flushdns"}
-	cmd := exec.Command("ipconfig", arg...)
-	d, err := cmd.CombinedOutput()
+	err := flushDNS()
 	if err != nil {
 		if LogLevel > 0 {
-			log.Println(string(d), err)
+			log.Println(err)
 		}
 		return
 	}
 
 	filter := "outbound and udp.DstPort == 53"
 	mutex.Lock()
-	winDivert, err := godivert.NewWinDivertHandle(filter)
+	divert, err := OpenDiverter(filter, 0, 0, 0)
 	mutex.Unlock()
 	if err != nil {
 		if LogLevel > 0 {
@@ -35,28 +33,29 @@ func DNSDaemon() {
 
 	go func() {
 		defer wg.Done()
-		defer winDivert.Close()
+		defer divert.Close()
 
 		rawbuf := make([]byte, 1500)
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
+				if err == ErrDiverterClosed {
+					return
+				}
 				if LogLevel > 0 {
 					log.Println(err)
 				}
 				continue
 			}
 
-			ipv6 := packet.Raw[0]>>4 == 6
-
-			var ipheadlen int
-			if ipv6 {
-				ipheadlen = 40
-			} else {
-				ipheadlen = int(packet.Raw[0]&0xF) * 4
+			p, err := packet.Layers()
+			if err != nil || p.UDP == nil {
+				_, err = divert.Send(packet)
+				continue
 			}
-			udpheadlen := 8
-			qname, qtype, off := getQName(packet.Raw[ipheadlen+udpheadlen:])
+			ipv6 := p.IsIPv6()
+
+			qname, qtype, off := getQName(p.Payload)
 			if qname == "" {
 				logPrintln(2, "DNS Segmentation fault")
 				continue
@@ -75,110 +74,56 @@ func DNSDaemon() {
 					anCount = config.ANCount6
 				}
 
+				server := DNS
+				if config.Server != "" {
+					server = config.Server
+				}
+				if anCount < 0 && (server == "" || server == DNS_SYSTEM) {
+					logPrintln(3, qname, "system")
+					_, err = divert.Send(packet)
+					continue
+				}
+
 				packet.Addr.Data = 0x1
 
 				if anCount == 0 {
-					request := packet.Raw[ipheadlen+udpheadlen:]
-					udpsize := len(request) + 8
-
-					var packetsize int
-					if ipv6 {
-						copy(rawbuf, []byte{96, 12, 19, 68, 0, 98, 17, 128})
-						packetsize = 40 + udpsize
-						binary.BigEndian.PutUint16(rawbuf[4:], uint16(udpsize))
-						copy(rawbuf[8:], packet.Raw[24:40])
-						copy(rawbuf[24:], packet.Raw[8:24])
-					} else {
-						copy(rawbuf, []byte{69, 0, 1, 32, 141, 152, 64, 0, 64, 17, 150, 46})
-						packetsize = 20 + udpsize
-						binary.BigEndian.PutUint16(rawbuf[2:], uint16(packetsize))
-						copy(rawbuf[12:], packet.Raw[16:20])
-						copy(rawbuf[16:], packet.Raw[12:16])
-						ipheadlen = 20
-					}
-
-					copy(rawbuf[ipheadlen:], packet.Raw[ipheadlen+2:ipheadlen+4])
-					copy(rawbuf[ipheadlen+2:], packet.Raw[ipheadlen:ipheadlen+2])
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+4:], uint16(udpsize))
-					copy(rawbuf[ipheadlen+8:], request)
-					rawbuf[ipheadlen+10] = 0x81
-					rawbuf[ipheadlen+11] = 0x80
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+14:], 0)
-
-					packet.PacketLen = uint(packetsize)
-					packet.Raw = rawbuf[:packetsize]
-					packet.CalcNewChecksum(winDivert)
+					message := make([]byte, len(p.Payload))
+					copy(message, p.Payload)
+					message[2] = 0x81
+					message[3] = 0x80
+					binary.BigEndian.PutUint16(message[6:], 0)
 
-					_, err = winDivert.Send(packet)
+					err = sendLayers(divert, packet.Addr, dnsResponse(p, message), rawbuf, true)
 				} else if anCount > 0 {
 					logPrintln(2, qname, qtype)
-					request := packet.Raw[ipheadlen+udpheadlen:]
-					udpsize := len(request) + len(answers) + 8
-
-					var packetsize int
-					if ipv6 {
-						copy(rawbuf, []byte{96, 12, 19, 68, 0, 98, 17, 128})
-						packetsize = 40 + udpsize
-						binary.BigEndian.PutUint16(rawbuf[4:], uint16(udpsize))
-						copy(rawbuf[8:], packet.Raw[24:40])
-						copy(rawbuf[24:], packet.Raw[8:24])
-						copy(rawbuf[ipheadlen:], packet.Raw[ipheadlen+2:ipheadlen+4])
-						copy(rawbuf[ipheadlen+2:], packet.Raw[ipheadlen:ipheadlen+2])
-					} else {
-						copy(rawbuf, []byte{69, 0, 1, 32, 141, 152, 64, 0, 64, 17, 150, 46})
-						packetsize = 20 + udpsize
-						binary.BigEndian.PutUint16(rawbuf[2:], uint16(packetsize))
-						copy(rawbuf[12:], packet.Raw[16:20])
-						copy(rawbuf[16:], packet.Raw[12:16])
-						copy(rawbuf[20:], packet.Raw[ipheadlen+2:ipheadlen+4])
-						copy(rawbuf[22:], packet.Raw[ipheadlen:ipheadlen+2])
-						ipheadlen = 20
-					}
-
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+4:], uint16(udpsize))
-					copy(rawbuf[ipheadlen+8:], request)
-					rawbuf[ipheadlen+10] = 0x81
-					rawbuf[ipheadlen+11] = 0x80
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+14:], uint16(anCount))
-					copy(rawbuf[ipheadlen+8+len(request):], answers)
-
-					packet.PacketLen = uint(packetsize)
-					packet.Raw = rawbuf[:packetsize]
-					packet.CalcNewChecksum(winDivert)
-
-					_, err = winDivert.Send(packet)
+					message := make([]byte, len(p.Payload), len(p.Payload)+len(answers))
+					copy(message, p.Payload)
+					message[2] = 0x81
+					message[3] = 0x80
+					binary.BigEndian.PutUint16(message[6:], uint16(anCount))
+					message = append(message, answers...)
+
+					err = sendLayers(divert, packet.Addr, dnsResponse(p, message), rawbuf, true)
 				} else {
 					logPrintln(2, qname, config.Option)
-					go func(packet godivert.Packet, answers6 []byte, offset int) {
+					tasks.Add(1)
+					go func(packet Packet, p *layers.Packet, answers6 []byte, offset int) {
+						defer tasks.Done()
 						rawbuf := make([]byte, 1500)
-						if ipv6 {
-							copy(rawbuf, []byte{96, 12, 19, 68, 0, 98, 17, 128})
-							copy(rawbuf[8:], packet.Raw[24:40])
-							copy(rawbuf[24:], packet.Raw[8:24])
-							copy(rawbuf[ipheadlen:], packet.Raw[ipheadlen+2:ipheadlen+4])
-							copy(rawbuf[ipheadlen+2:], packet.Raw[ipheadlen:ipheadlen+2])
-						} else {
-							copy(rawbuf, []byte{69, 0, 1, 32, 141, 152, 64, 0, 64, 17, 150, 46})
-							copy(rawbuf[12:], packet.Raw[16:20])
-							copy(rawbuf[16:], packet.Raw[12:16])
-							copy(rawbuf[20:], packet.Raw[ipheadlen+2:ipheadlen+4])
-							copy(rawbuf[22:], packet.Raw[ipheadlen:ipheadlen+2])
-							ipheadlen = 20
-						}
 
-						request := packet.Raw[ipheadlen+udpheadlen:]
+						request := p.Payload
 
 						if config.ECS != nil {
 							request = AddECS(request, config.ECS)
 						}
 
-						var response []byte
-						var err error
-						if qtype == 28 && answers6 != nil {
-							response, err = TCPlookupDNS64(request, DNS, offset, answers6)
-						} else {
-							response, err = TCPlookup(request, DNS)
-						}
+						key := dnsCacheKey(qname, qtype, server, config.ECS, answers6)
+						response, err := DNSCache.Lookup(key, request, func() ([]byte, error) {
+							if qtype == 28 && answers6 != nil {
+								return TCPlookupDNS64(request, server, offset, answers6)
+							}
+							return lookup(request, server)
+						})
 
 						if err != nil {
 							if LogLevel > 0 {
@@ -192,16 +137,14 @@ func DNSDaemon() {
 
 						count := int(binary.BigEndian.Uint16(response[6:8]))
 
-						ips := getAnswers(response[off:], count)
+						ips, ttl := getAnswers(response[off:], count)
 
 						//Filter
 						if config.Option&OPT_FILTER != 0 {
-							if qtype == 28 && ipv6 {
-								ips = TCPDetection(winDivert, *packet.Addr, rawbuf[24:40], ips, 443, int(config.TTL))
-							} else if qtype == 1 && !ipv6 {
-								ips = TCPDetection(winDivert, *packet.Addr, rawbuf[16:20], ips, 443, int(config.TTL))
+							if (qtype == 28 && ipv6) || (qtype == 1 && !ipv6) {
+								ips = TCPDetection(divert, *packet.Addr, p.Src(), ips, 443, int(config.TTL))
 							} else {
-								ips = TCPDetection(winDivert, *packet.Addr, nil, ips, 443, int(config.TTL))
+								ips = TCPDetection(divert, *packet.Addr, nil, ips, 443, int(config.TTL))
 							}
 							count, ans := packAnswers(ips, qtype)
 							binary.BigEndian.PutUint16(response[6:8], uint16(count))
@@ -210,55 +153,62 @@ func DNSDaemon() {
 							response = response[:off+len(ans)]
 						}
 
-						for _, ip := range ips {
-							_, ok := IPLookup(ip)
-							if IPBlock && !ok {
-								var ipconfig IPConfig
-								ipconfig, ok = IPBlockLookup(ip)
-								if ok {
-									logPrintln(3, ip, ipconfig.Option)
-									IPMap[ip] = ipconfig
-								}
-							}
-							if !ok {
-								logPrintln(3, ip, config.Option)
-								IPMap[ip] = IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}
-							}
-						}
+						learnIPs(qname, ips, ttl, config)
 
-						udpsize := len(response) + 8
-						var packetsize int
-						if ipv6 {
-							packetsize = 40 + udpsize
-							binary.BigEndian.PutUint16(rawbuf[4:], uint16(udpsize))
-						} else {
-							packetsize = 20 + udpsize
-							binary.BigEndian.PutUint16(rawbuf[2:], uint16(packetsize))
-						}
-
-						binary.BigEndian.PutUint16(rawbuf[ipheadlen+4:], uint16(udpsize))
-						copy(rawbuf[ipheadlen+8:], response)
-
-						packet.PacketLen = uint(packetsize)
-						packet.Raw = rawbuf[:packetsize]
-						packet.CalcNewChecksum(winDivert)
-
-						_, err = winDivert.Send(&packet)
-					}(*packet, config.Answers6, off)
+						err = sendLayers(divert, packet.Addr, dnsResponse(p, response), rawbuf, true)
+					}(*packet, p, config.Answers6, off)
 				}
 			} else {
 				logPrintln(3, qname)
-				_, err = winDivert.Send(packet)
+				_, err = divert.Send(packet)
 			}
 		}
 	}()
 }
 
+// learnIPs attaches the rule of the domain qname resolved to, or of the IP
+// block they fall in, to the IPs of its answer.
+func learnIPs(qname string, ips []string, ttl uint32, config Config) {
+	ipBlock := Rules.Settings().ipBlock
+	for _, ip := range ips {
+		if Rules.RefreshIP(ip, qname, time.Duration(ttl)*time.Second) {
+			continue
+		}
+		_, ok := IPLookup(ip)
+		if ipBlock && !ok {
+			var ipconfig IPConfig
+			ipconfig, ok = IPBlockLookup(ip)
+			if ok {
+				logPrintln(3, ip, ipconfig.Option)
+				Rules.LearnIP(ip, ipconfig, qname, time.Duration(ttl)*time.Second)
+			}
+		}
+		if !ok {
+			logPrintln(3, ip, config.Option)
+			Rules.LearnIP(ip, IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}, qname, time.Duration(ttl)*time.Second)
+		}
+	}
+}
+
+// dnsResponse builds the packet answering a DNS query with message.
+func dnsResponse(query *layers.Packet, message []byte) *layers.Packet {
+	response := &layers.Packet{
+		UDP:     &layers.UDP{SrcPort: query.UDP.DstPort, DstPort: query.UDP.SrcPort},
+		Payload: message,
+	}
+	if query.IsIPv6() {
+		response.IPv6 = &layers.IPv6{FlowLabel: 0xC1344, HopLimit: 128, Src: query.Dst(), Dst: query.Src()}
+	} else {
+		response.IPv4 = &layers.IPv4{ID: 0x8D98, Flags: layers.IPv4DontFragment, TTL: 64, Src: query.Dst(), Dst: query.Src()}
+	}
+	return response
+}
+
 func DNSRecvDaemon() {
 	wg.Add(1)
 
 	filter := "udp.SrcPort == 53"
-	winDivert, err := godivert.NewWinDivertHandle(filter)
+	divert, err := OpenDiverter(filter, 0, 0, 0)
 	if err != nil {
 		if LogLevel > 0 {
 			log.Println(err, filter)
@@ -268,10 +218,10 @@ func DNSRecvDaemon() {
 
 	go func() {
 		defer wg.Done()
-		defer winDivert.Close()
+		defer divert.Close()
 		rawbuf := make([]byte, 1500)
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
 				if LogLevel > 0 {
 					log.Println(err)
@@ -279,17 +229,13 @@ func DNSRecvDaemon() {
 				return
 			}
 
-			ipv6 := packet.Raw[0]>>4 == 6
-
-			var ipheadlen int
-			if ipv6 {
-				ipheadlen = 40
-			} else {
-				ipheadlen = int(packet.Raw[0]&0xF) * 4
+			p, err := packet.Layers()
+			if err != nil || p.UDP == nil {
+				_, err = divert.Send(packet)
+				continue
 			}
 
-			udpheadlen := 8
-			qname, qtype, off := getQName(packet.Raw[ipheadlen+udpheadlen:])
+			qname, qtype, off := getQName(p.Payload)
 			if qname == "" {
 				logPrintln(2, "DNS Segmentation fault")
 				continue
@@ -297,6 +243,7 @@ func DNSRecvDaemon() {
 
 			config, ok := domainLookup(qname)
 
+			modified := false
 			if ok {
 				var anCount int16 = 0
 				var answers []byte = nil
@@ -312,62 +259,31 @@ func DNSRecvDaemon() {
 				if anCount == 0 {
 					logPrintln(3, qname, qtype, "NoRecord")
 
-					udpsize := udpheadlen + off
-					packetsize := ipheadlen + udpsize
-					binary.BigEndian.PutUint16(packet.Raw[ipheadlen+14:], 0)
-					binary.BigEndian.PutUint16(packet.Raw[ipheadlen+4:], uint16(udpsize))
-					if ipv6 {
-						binary.BigEndian.PutUint16(packet.Raw[4:], uint16(packetsize-ipheadlen))
-					} else {
-						binary.BigEndian.PutUint16(packet.Raw[2:], uint16(packetsize))
-					}
-					packet.Raw = packet.Raw[:packetsize]
-
-					packet.PacketLen = uint(packetsize)
-					packet.CalcNewChecksum(winDivert)
+					p.Payload = p.Payload[:off]
+					binary.BigEndian.PutUint16(p.Payload[6:], 0)
+					modified = true
 				} else if anCount > 0 {
 					logPrintln(2, qname, qtype)
-					copy(rawbuf, packet.Raw[:ipheadlen+udpheadlen+off])
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+14:], uint16(anCount))
-					copy(rawbuf[ipheadlen+udpheadlen+off:], answers)
-
-					udpsize := udpheadlen + off + len(answers)
-					packetsize := ipheadlen + udpsize
-					binary.BigEndian.PutUint16(rawbuf[ipheadlen+4:], uint16(udpsize))
-					if ipv6 {
-						binary.BigEndian.PutUint16(rawbuf[4:], uint16(packetsize-ipheadlen))
-					} else {
-						binary.BigEndian.PutUint16(rawbuf[2:], uint16(packetsize))
-					}
-
-					packet.PacketLen = uint(packetsize)
-					packet.Raw = rawbuf[:packetsize]
-					packet.CalcNewChecksum(winDivert)
+					message := make([]byte, off, off+len(answers))
+					copy(message, p.Payload)
+					binary.BigEndian.PutUint16(message[6:], uint16(anCount))
+					p.Payload = append(message, answers...)
+					modified = true
 				} else if config.Option > 1 {
 					logPrintln(2, qname, config.Option)
-					response := packet.Raw[ipheadlen+udpheadlen:]
+					response := p.Payload
 					count := int(binary.BigEndian.Uint16(response[6:8]))
-					ips := getAnswers(response[off:], count)
-
-					for _, ip := range ips {
-						_, ok := IPLookup(ip)
-						if IPBlock && !ok {
-							var ipconfig IPConfig
-							ipconfig, ok = IPBlockLookup(ip)
-							if ok {
-								logPrintln(3, ip, ipconfig.Option)
-								IPMap[ip] = ipconfig
-							}
-						}
-						if !ok {
-							logPrintln(3, ip, config.Option)
-							IPMap[ip] = IPConfig{config.Option, config.TTL, config.MAXTTL, config.MSS}
-						}
-					}
+					ips, ttl := getAnswers(response[off:], count)
+
+					learnIPs(qname, ips, ttl, config)
 				}
 			}
 
-			_, err = winDivert.Send(packet)
+			if modified {
+				err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+			} else {
+				_, err = divert.Send(packet)
+			}
 		}
 	}()
 }
@@ -385,7 +301,7 @@ func UDPDaemon(dstPort int, forward bool) {
 		layer = 0
 	}
 
-	winDivert, err := godivert.WinDivertOpen(filter, layer, 1, 0)
+	divert, err := OpenDiverter(filter, layer, 1, 0)
 	if err != nil {
 		if LogLevel > 0 {
 			log.Println(err, filter)
@@ -395,11 +311,16 @@ func UDPDaemon(dstPort int, forward bool) {
 
 	go func() {
 		defer wg.Done()
-		defer winDivert.Close()
+		defer divert.Close()
+
+		rawbuf := make([]byte, 1500)
 
 		for {
-			packet, err := winDivert.Recv()
+			packet, err := divert.Recv()
 			if err != nil {
+				if err == ErrDiverterClosed {
+					return
+				}
 				if LogLevel > 0 {
 					log.Println(err)
 				}
@@ -409,22 +330,20 @@ func UDPDaemon(dstPort int, forward bool) {
 			config, ok := IPLookup(packet.DstIP().String())
 			if ok {
 				if config.Option == 0 || (config.Option&OPT_QUIC != 0) {
+					var p *layers.Packet
 					if config.Option&OPT_WULEN != 0 {
-						ipv6 := packet.Raw[0]>>4 == 6
-						var ipheadlen int
-						if ipv6 {
-							ipheadlen = 40
-						} else {
-							ipheadlen = int(packet.Raw[0]&0xF) * 4
-						}
-						//ulen := binary.BigEndian.Uint16(packet.Raw[ipheadlen+udpheadlen:])
-						binary.BigEndian.PutUint16(packet.Raw[ipheadlen+4:], 0)
-						packet.CalcNewChecksum(winDivert)
+						p, err = packet.Layers()
+					}
+					if p != nil && p.UDP != nil {
+						p.UDP.Length = 0
+						p.UDP.FixedLength = true
+						err = sendLayers(divert, packet.Addr, p, rawbuf, true)
+					} else {
+						_, err = divert.Send(packet)
 					}
-					_, err = winDivert.Send(packet)
 				}
 			} else {
-				_, err = winDivert.Send(packet)
+				_, err = divert.Send(packet)
 			}
 			if err != nil {
 				if LogLevel > 0 {
@@ -0,0 +1,384 @@
+package ghostcp
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An upstream of server= or dns= may be a list, server=1.1.1.1:53,8.8.8.8:53.
+// The servers are tried in order, or all at once with dns-race=true, and
+// the first answer is used. A server that fails UpstreamFailures times in a
+// row, or answers slower than UpstreamSlow, is down for UpstreamDownTime:
+// it is tried only when all the others are down too.
+var UpstreamTimeout = 5 * time.Second
+var UpstreamIdleTimeout = 60 * time.Second
+var UpstreamSlow = 2 * time.Second
+var UpstreamFailures = 2
+var UpstreamDownTime = 30 * time.Second
+
+type upstreamHealth struct {
+	failures int
+	down     time.Time
+}
+
+var healthMutex sync.Mutex
+var upstreamHealths = make(map[string]*upstreamHealth)
+
+// upstreamUp reports whether server is not marked down.
+func upstreamUp(server string) bool {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	h, ok := upstreamHealths[server]
+	return !ok || time.Now().After(h.down)
+}
+
+// upstreamResult records how a query to server went.
+func upstreamResult(server string, elapsed time.Duration, err error) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	h, ok := upstreamHealths[server]
+	if !ok {
+		h = &upstreamHealth{}
+		upstreamHealths[server] = h
+	}
+	if err == nil && elapsed < UpstreamSlow {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	if err == nil || h.failures >= UpstreamFailures {
+		if time.Now().After(h.down) {
+			logPrintln(1, server, "is down", elapsed, err)
+		}
+		h.down = time.Now().Add(UpstreamDownTime)
+		h.failures = 0
+	}
+}
+
+// lookup sends a DNS request to server, an ip:port or a DoH or DoT URL, or
+// a list of them.
+func lookup(request []byte, server string) ([]byte, error) {
+	if !strings.Contains(server, ",") {
+		return lookupServer(request, server)
+	}
+
+	var servers, down []string
+	for _, s := range strings.Split(server, ",") {
+		if upstreamUp(s) {
+			servers = append(servers, s)
+		} else {
+			down = append(down, s)
+		}
+	}
+	if servers == nil {
+		servers = down
+	}
+
+	if Rules.Settings().dnsRace && len(servers) > 1 {
+		return raceLookup(request, servers)
+	}
+	var err error
+	for _, s := range servers {
+		var response []byte
+		response, err = lookupServer(request, s)
+		if err == nil {
+			return response, nil
+		}
+		logPrintln(2, s, err)
+	}
+	return nil, err
+}
+
+// raceLookup sends request to all the servers and returns the first answer.
+func raceLookup(request []byte, servers []string) ([]byte, error) {
+	type result struct {
+		response []byte
+		err      error
+	}
+	results := make(chan result, len(servers))
+	for _, s := range servers {
+		go func(s string) {
+			response, err := lookupServer(request, s)
+			results <- result{response, err}
+		}(s)
+	}
+
+	var err error
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			return r.response, nil
+		}
+		err = r.err
+	}
+	return nil, err
+}
+
+func lookupServer(request []byte, server string) ([]byte, error) {
+	start := time.Now()
+	var response []byte
+	var err error
+	if isDoH(server) {
+		response, err = DoHlookup(request, server)
+	} else if isDoT(server) {
+		response, err = DoTlookup(request, server)
+	} else {
+		response, err = TCPlookup(request, server)
+	}
+	upstreamResult(server, time.Since(start), err)
+	return response, err
+}
+
+// pipeClient keeps a connection to a DNS server over TCP, or TLS if config
+// is set, and pipelines the queries on it under IDs of its own. The
+// connection is dialed on the first query and closed after
+// UpstreamIdleTimeout without one. Dials and writes are done without
+// mutex held, so that recv always hands out the answers it reads.
+type pipeClient struct {
+	addr   string
+	config *tls.Config
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	id      uint16
+	pending map[uint16]chan []byte
+	dialing *pipeDial
+
+	writeMutex sync.Mutex
+}
+
+// pipeDial is a dial in progress, the other queries wait for it.
+type pipeDial struct {
+	done chan struct{}
+	err  error
+}
+
+var tcpMutex sync.Mutex
+var tcpClients = make(map[string]*pipeClient)
+
+// close drops the connection conn, or the current one if conn is nil, and
+// fails the pending queries.
+func (c *pipeClient) close(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil || (conn != nil && c.conn != conn) {
+		return
+	}
+	c.conn.Close()
+	c.conn = nil
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// register returns a free ID and the channel its answer is handed to. It
+// is called with mutex held.
+func (c *pipeClient) register() (uint16, chan []byte) {
+	if c.pending == nil {
+		c.pending = make(map[uint16]chan []byte)
+	}
+	c.id++
+	for c.pending[c.id] != nil {
+		c.id++
+	}
+	ch := make(chan []byte, 1)
+	c.pending[c.id] = ch
+	return c.id, ch
+}
+
+func (c *pipeClient) unregister(id uint16, ch chan []byte) {
+	c.mutex.Lock()
+	if c.pending[id] == ch {
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+}
+
+// send writes request on the connection, dialing it if there is none, under
+// an ID registered for its answer. It returns the connection, whether it
+// was open already, and the ID and channel of the answer.
+func (c *pipeClient) send(request []byte) (net.Conn, bool, uint16, chan []byte, error) {
+	c.mutex.Lock()
+	for c.conn == nil && c.dialing != nil {
+		dial := c.dialing
+		c.mutex.Unlock()
+		<-dial.done
+		if dial.err != nil {
+			return nil, false, 0, nil, dial.err
+		}
+		c.mutex.Lock()
+	}
+	conn := c.conn
+	reused := conn != nil
+	id, ch := c.register()
+	var dial *pipeDial
+	if conn == nil {
+		dial = &pipeDial{done: make(chan struct{})}
+		c.dialing = dial
+	}
+	c.mutex.Unlock()
+
+	data := make([]byte, len(request)+2)
+	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
+	copy(data[2:], request)
+	binary.BigEndian.PutUint16(data[2:4], id)
+
+	sent := false
+	if dial != nil {
+		dialer := &net.Dialer{Timeout: UpstreamTimeout}
+		if c.config != nil {
+			conn, dial.err = tls.DialWithDialer(dialer, "tcp", c.addr, c.config)
+		} else {
+			//with TFO the request goes in the SYN, see TCPDaemon
+			if DNSOption&OPT_TFO != 0 {
+				setTFOPayload(c.addr, data)
+				sent = true
+			}
+			conn, dial.err = dialer.Dial("tcp", c.addr)
+			if sent {
+				setTFOPayload(c.addr, nil)
+			}
+		}
+
+		c.mutex.Lock()
+		c.dialing = nil
+		if dial.err == nil {
+			if c.conn == nil {
+				c.conn = conn
+				go c.recv(conn)
+			} else {
+				conn.Close()
+				conn = c.conn
+				reused = true
+				sent = false
+			}
+		}
+		c.mutex.Unlock()
+		close(dial.done)
+		if dial.err != nil {
+			c.unregister(id, ch)
+			return nil, false, 0, nil, dial.err
+		}
+	}
+
+	if !sent {
+		c.writeMutex.Lock()
+		conn.SetWriteDeadline(time.Now().Add(UpstreamTimeout))
+		_, err := conn.Write(data)
+		c.writeMutex.Unlock()
+		if err != nil {
+			c.unregister(id, ch)
+			return conn, reused, 0, nil, err
+		}
+	}
+	return conn, reused, id, ch, nil
+}
+
+// recv reads the answers of conn, of up to 64 KiB, and hands them to their
+// queries until the connection fails, is closed or is idle.
+func (c *pipeClient) recv(conn net.Conn) {
+	header := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(UpstreamIdleTimeout))
+		n, err := io.ReadFull(conn, header)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && n == 0 && c.busy() {
+				continue
+			}
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(UpstreamTimeout))
+		response := make([]byte, binary.BigEndian.Uint16(header))
+		_, err = io.ReadFull(conn, response)
+		if err != nil || len(response) < 12 {
+			break
+		}
+
+		id := binary.BigEndian.Uint16(response[:2])
+		c.mutex.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		if ch != nil {
+			ch <- response
+		}
+	}
+	c.close(conn)
+}
+
+func (c *pipeClient) busy() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending) > 0
+}
+
+// query sends request and waits for its answer. A query lost with a
+// connection that was already open, which the server may have closed in
+// the meantime, is sent again on a new one.
+func (c *pipeClient) query(request []byte) ([]byte, error) {
+	if len(request) < 12 {
+		return nil, errors.New("DNS request too short")
+	}
+	if len(request) > 65535 {
+		return nil, errors.New("DNS request too long")
+	}
+
+	for retry := 0; ; retry++ {
+		conn, reused, id, ch, err := c.send(request)
+		if err != nil {
+			if conn != nil {
+				c.close(conn)
+			}
+			if reused && retry == 0 {
+				continue
+			}
+			return nil, err
+		}
+
+		timer := time.NewTimer(UpstreamTimeout)
+		select {
+		case response, ok := <-ch:
+			timer.Stop()
+			if !ok {
+				if reused && retry == 0 {
+					continue
+				}
+				return nil, errors.New(c.addr + ": connection closed")
+			}
+			response[0], response[1] = request[0], request[1]
+			return response, nil
+		case <-timer.C:
+			c.unregister(id, ch)
+			return nil, errors.New(c.addr + ": timeout")
+		}
+	}
+}
+
+// addUpstream resolves the value of server= or dns= and keeps the DoH and
+// DoT servers it has for applyConfig. It returns the upstream as lookup
+// takes it and the addresses its connections go to.
+func (cfg *configFile) addUpstream(value string, network string) (string, []*net.TCPAddr, error) {
+	var servers []string
+	var addrs []*net.TCPAddr
+	for _, s := range strings.Split(value, ",") {
+		server, addr, err := resolveUpstream(strings.TrimSpace(s), network)
+		if err != nil {
+			return "", nil, err
+		}
+		if isDoH(server) {
+			cfg.doh[server] = addr.String()
+		} else if isDoT(server) {
+			cfg.dot[server] = addr.String()
+		}
+		servers = append(servers, server)
+		addrs = append(addrs, addr)
+	}
+	return strings.Join(servers, ","), addrs, nil
+}
@@ -0,0 +1,270 @@
+package ghostcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTCPServer starts a DNS server over TCP running handle on its
+// connections. Its client and health are dropped when the test ends.
+func testTCPServer(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveDNS(t, ln, handle)
+	addr := ln.Addr().String()
+	t.Cleanup(func() { dropUpstream(addr) })
+	return addr
+}
+
+// dropUpstream closes the client of addr and forgets its health.
+func dropUpstream(addr string) {
+	tcpMutex.Lock()
+	if c, ok := tcpClients[addr]; ok {
+		c.close(nil)
+		delete(tcpClients, addr)
+	}
+	tcpMutex.Unlock()
+	healthMutex.Lock()
+	delete(upstreamHealths, addr)
+	healthMutex.Unlock()
+}
+
+// deadServer returns an address nothing listens on.
+func deadServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	t.Cleanup(func() { dropUpstream(addr) })
+	return addr
+}
+
+// checkAnswer checks that response answers a query for name with ID id.
+func checkAnswer(t *testing.T, response []byte, id uint16, name string) {
+	t.Helper()
+	if len(response) < 12 {
+		t.Errorf("%s: got %x", name, response)
+		return
+	}
+	if qname, _, _ := getQName(response); qname != name || binary.BigEndian.Uint16(response) != id {
+		t.Errorf("%s: got %s ID %x", name, qname, response[:2])
+	}
+}
+
+func TestTCPlookupPipelining(t *testing.T) {
+	var conns int32
+	ids := make(chan uint16, 3)
+	addr := testTCPServer(t, func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		//three queries, answered in the reverse order
+		var queries [][]byte
+		for len(queries) < 3 {
+			query, err := readQuery(conn)
+			if err != nil {
+				return
+			}
+			ids <- binary.BigEndian.Uint16(query)
+			queries = append(queries, query)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			writeAnswer(conn, answerQuery(queries[i], "1.2.3.4"))
+		}
+		answerQueries(conn, "1.2.3.4")
+	})
+
+	//the queries have the same ID, the client gives them its own
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			response, err := TCPlookup(dnsMessage(7, name, 1), addr)
+			if err != nil {
+				t.Error(name, err)
+				return
+			}
+			checkAnswer(t, response, 7, name)
+		}(fmt.Sprintf("%d.example.com", i))
+	}
+	wg.Wait()
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		seen[<-ids] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("IDs on the wire %v", seen)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections", n)
+	}
+}
+
+func TestTCPlookupStalledWrite(t *testing.T) {
+	release := make(chan bool)
+	addr := testTCPServer(t, func(conn net.Conn) {
+		//the first query is answered once the server stops reading
+		query, err := readQuery(conn)
+		if err != nil {
+			return
+		}
+		<-release
+		time.Sleep(100 * time.Millisecond)
+		writeAnswer(conn, answerQuery(query, "1.2.3.4"))
+		<-release
+	})
+
+	answered := make(chan error, 1)
+	go func() {
+		response, err := TCPlookup(dnsMessage(1, "www.example.com", 1), addr)
+		if err == nil {
+			checkAnswer(t, response, 1, "www.example.com")
+		}
+		answered <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tcpMutex.Lock()
+		c := tcpClients[addr]
+		tcpMutex.Unlock()
+		if c != nil && c.busy() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the query was not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//large queries fill the socket buffers and block their writes
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := append(dnsMessage(2, "www.example.com", 1), make([]byte, 60000)...)
+			TCPlookup(query, addr)
+		}()
+	}
+	release <- true
+
+	select {
+	case err := <-answered:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(UpstreamTimeout / 2):
+		t.Error("the answer waited for the writes")
+	}
+	close(release)
+	dropUpstream(addr)
+	wg.Wait()
+}
+
+func TestTCPlookupLarge(t *testing.T) {
+	var ips []string
+	for i := 0; i < 200; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	addr := testTCPServer(t, func(conn net.Conn) {
+		answerQueries(conn, ips...)
+	})
+
+	response, err := TCPlookup(dnsMessage(1, "www.example.com", 1), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) <= 1024 {
+		t.Fatalf("%d bytes", len(response))
+	}
+	_, _, off := getQName(response)
+	if got, _ := getAnswers(response[off:], len(ips)); len(got) != len(ips) {
+		t.Errorf("%d answers", len(got))
+	}
+}
+
+func TestTCPlookupReconnect(t *testing.T) {
+	var conns int32
+	addr := testTCPServer(t, func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		//one answer, then the server closes the connection
+		query, err := readQuery(conn)
+		if err == nil {
+			writeAnswer(conn, answerQuery(query, "1.2.3.4"))
+		}
+	})
+
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("%d.example.com", i)
+		response, err := TCPlookup(dnsMessage(uint16(i), name, 1), addr)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		checkAnswer(t, response, uint16(i), name)
+	}
+	if n := atomic.LoadInt32(&conns); n != 3 {
+		t.Errorf("%d connections", n)
+	}
+}
+
+func TestLookupFailover(t *testing.T) {
+	testConfig(t)
+	dead := deadServer(t)
+	addr := testTCPServer(t, func(conn net.Conn) {
+		answerQueries(conn, "1.2.3.4")
+	})
+
+	//the dead server is tried first until it is marked down
+	for i := 0; i < UpstreamFailures+1; i++ {
+		response, err := lookup(dnsMessage(1, "www.example.com", 1), dead+","+addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, response, 1, "www.example.com")
+	}
+	if upstreamUp(dead) {
+		t.Error(dead, "is not down")
+	}
+	if !upstreamUp(addr) {
+		t.Error(addr, "is down")
+	}
+
+	//with all of them down, they are tried anyway
+	if _, err := lookup(dnsMessage(1, "www.example.com", 1), dead+","+dead); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestLookupRace(t *testing.T) {
+	testConfig(t)
+	Rules.settings.dnsRace = true
+
+	stop := make(chan bool)
+	defer close(stop)
+	slow := testTCPServer(t, func(conn net.Conn) {
+		readQuery(conn)
+		<-stop
+	})
+	fast := testTCPServer(t, func(conn net.Conn) {
+		answerQueries(conn, "1.2.3.4")
+	})
+
+	start := time.Now()
+	response, err := lookup(dnsMessage(1, "www.example.com", 1), slow+","+fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, response, 1, "www.example.com")
+	if elapsed := time.Since(start); elapsed >= UpstreamTimeout {
+		t.Errorf("answered after %v", elapsed)
+	}
+}
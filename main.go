@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,6 +19,11 @@ var ScanIPRange string = ""
 var ScanSpeed int = 1
 var ScanURL string = ""
 var ScanTimeout uint = 0
+var ReplayFile string = ""
+var RecordFile string = ""
+var CheckFile string = ""
+var ExplainTarget string = ""
+var ConvertFile string = ""
 
 func StartService() {
 	runtime.GOMAXPROCS(1)
@@ -35,6 +41,13 @@ func StartService() {
 		ghostcp.Logger = log.New(logFile, "\r\n", log.Ldate|log.Ltime|log.Lshortfile)
 	}
 
+	//before the config, which starts the daemons of its ip:port lines
+	var replay *ghostcp.PacketReplay
+	if ReplayFile != "" {
+		replay = ghostcp.NewPacketReplay()
+		ghostcp.OpenDiverter = replay.Open
+	}
+
 	err := ghostcp.LoadConfig()
 	if err != nil {
 		if ghostcp.LogLevel > 0 || !ServiceMode {
@@ -43,8 +56,7 @@ func StartService() {
 		return
 	}
 
-	Windir := os.Getenv("WINDIR")
-	err = ghostcp.LoadHosts(Windir + "\\System32\\drivers\\etc\\hosts")
+	err = ghostcp.LoadHosts(HostsPath())
 	if err != nil && !ServiceMode {
 		log.Println(err)
 		return
@@ -72,22 +84,118 @@ func StartService() {
 		ghostcp.TCPRecv(":443", true)
 	}
 
-	if ghostcp.DNS == "" {
+	dnsDaemon, dnsRecv := ghostcp.DNSModes(ghostcp.DNS, ghostcp.DNSUpstreams)
+	if dnsRecv {
 		ghostcp.DNSRecvDaemon()
-	} else {
-		ghostcp.TCPDaemon(ghostcp.DNS, false)
-		ghostcp.TCPRecv(ghostcp.DNS, false)
+	}
+	for _, addr := range ghostcp.DNSAddrs {
+		//a DoH server on 443 is already in the daemons above
+		if _, port, _ := net.SplitHostPort(addr); port != "443" && port != "80" {
+			ghostcp.TCPDaemon(addr, false)
+			ghostcp.TCPRecv(addr, false)
+		}
+	}
+	if dnsDaemon {
 		ghostcp.DNSDaemon()
 	}
 
+	if replay != nil {
+		err = ReplayPcap(replay)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
 	if ScanIPRange != "" {
 		go ghostcp.Scan(ScanIPRange, ScanSpeed)
 	}
 
+	go ghostcp.WatchConfig()
+
 	fmt.Println("Service Start")
 	ghostcp.Wait()
 }
 
+func HostsPath() string {
+	if runtime.GOOS == "windows" {
+		Windir := os.Getenv("WINDIR")
+		return Windir + "\\System32\\drivers\\etc\\hosts"
+	}
+	return "/etc/hosts"
+}
+
+func ReplayPcap(replay *ghostcp.PacketReplay) error {
+	defer replay.Close()
+
+	in, err := os.Open(ReplayFile)
+	if err != nil {
+		return err
+	}
+	packets, err := ghostcp.ReadPcap(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	replay.Replay(packets)
+	ghostcp.WaitTasks()
+
+	out, err := os.Create(RecordFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	sent := replay.Sent()
+	fmt.Println(len(packets), "packets replayed,", len(sent), "sent to", RecordFile)
+	return ghostcp.WritePcap(out, sent)
+}
+
+func CheckConfig() int {
+	diags, err := ghostcp.CheckConfig(CheckFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	errors := 0
+	for _, d := range diags {
+		fmt.Println(d)
+		if !d.Warning {
+			errors++
+		}
+	}
+	fmt.Println(errors, "errors,", len(diags)-errors, "warnings")
+
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func Explain() int {
+	lines, err := ghostcp.Explain(ExplainTarget, HostsPath())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return 0
+}
+
+func ConvertConfig() int {
+	data, err := ghostcp.ConvertConfig(ConvertFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
 func StopService() {
 	arg := []string{"/flushdns"}
 	cmd := exec.Command("ipconfig", arg...)
@@ -114,8 +222,24 @@ func main() {
 	flag.IntVar(&ScanSpeed, "scanspeed", 1, "Scan Speed")
 	flag.StringVar(&ScanURL, "scanurl", "", "Scan URL")
 	flag.UintVar(&ScanTimeout, "scantimeout", 0, "Scan Timeout")
+	flag.StringVar(&ReplayFile, "replay", "", "Replay a pcap through the daemons")
+	flag.StringVar(&RecordFile, "record", "replay.pcap", "Pcap to write the replayed packets to")
+	flag.StringVar(&CheckFile, "check", "", "Check a config file and exit")
+	flag.StringVar(&ExplainTarget, "explain", "", "Show the rule a domain, IP or ip:port gets and exit")
+	flag.StringVar(&ConvertFile, "convert", "", "Print a config converted between .conf and .json and exit")
+	flag.StringVar(&ghostcp.ConfigFile, "config", ghostcp.ConfigFile, "Config file, .conf or .json")
 	flag.Parse()
 
+	if CheckFile != "" {
+		os.Exit(CheckConfig())
+	}
+	if ExplainTarget != "" {
+		os.Exit(Explain())
+	}
+	if ConvertFile != "" {
+		os.Exit(ConvertConfig())
+	}
+
 	appPath, err := winsvc.GetAppPath()
 	if err != nil {
 		log.Fatal(err)
@@ -158,7 +282,7 @@ func main() {
 	}
 
 	// run as service
-	if !winsvc.IsAnInteractiveSession() {
+	if runtime.GOOS == "windows" && !winsvc.IsAnInteractiveSession() {
 		log.Println("main:", "runService")
 
 		if err := os.Chdir(filepath.Dir(appPath)); err != nil {